@@ -0,0 +1,232 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// BatchOptions configures the Batcher.
+type BatchOptions struct {
+	// MaxDelay is the longest time that a write waits for other writes to join its batch.
+	MaxDelay time.Duration
+	// MaxOps is the number of mutations that causes a batch to be written without waiting for MaxDelay.
+	MaxOps int
+}
+
+// SqliteBatchOptions are the default batch options for Sqlite. Transactions are cheap, so writes
+// wait briefly, and batches are kept small.
+var SqliteBatchOptions = BatchOptions{
+	MaxDelay: time.Millisecond,
+	MaxOps:   256,
+}
+
+// RqliteBatchOptions are the default batch options for Rqlite. Each transaction is a network round
+// trip and a Raft commit, so writes wait longer, and batches are larger.
+var RqliteBatchOptions = BatchOptions{
+	MaxDelay: 5 * time.Millisecond,
+	MaxOps:   1000,
+}
+
+// ErrWriteMayHaveBeenApplied is returned, wrapping the context's error, by a batched write whose context
+// was cancelled after it joined a batch. The batch is still written, so the write may have been made.
+var ErrWriteMayHaveBeenApplied = errors.New("write may have been applied")
+
+// WithBatching coalesces concurrent Put, Patch and PutPatches calls into a single transaction, see
+// NewBatcher. Zero options use the defaults for the database, SqliteBatchOptions or RqliteBatchOptions.
+func WithBatching(opts BatchOptions) StoreOption {
+	return func(s *Store) {
+		s.batching = &opts
+	}
+}
+
+// NewBatcher wraps a database, so that concurrent calls to Mutate that only contain puts and patches,
+// e.g. from Store.Put, Store.Patch and Store.PutPatches, are coalesced into a single transaction.
+// Other calls, and writes queued with RqliteWriteOptions, are passed through.
+//
+// The first write starts a batch, and waits for up to opts.MaxDelay, or until opts.MaxOps mutations
+// have joined the batch, before the batch is written. Each caller gets its own result, including its
+// own version mismatch errors. If a statement fails, the transaction is rolled back, and each
+// caller's mutations are run in their own transaction, so that only the caller that caused the
+// error gets it.
+//
+// Once a write has joined a batch, it's made even if the caller's context is cancelled. Callers other
+// than the first write of the batch don't wait for the batch, and return ErrWriteMayHaveBeenApplied,
+// wrapping the context's error.
+func NewBatcher(d db.DB, opts BatchOptions) *Batcher {
+	defaults := SqliteBatchOptions
+	if _, ok := unwrapDB(d).(*Rqlite); ok {
+		defaults = RqliteBatchOptions
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = defaults.MaxDelay
+	}
+	if opts.MaxOps <= 0 {
+		opts.MaxOps = defaults.MaxOps
+	}
+	return &Batcher{
+		db:   d,
+		opts: opts,
+	}
+}
+
+// Batcher is a db.DB that coalesces concurrent writes into a single transaction. See NewBatcher.
+type Batcher struct {
+	db   db.DB
+	opts BatchOptions
+
+	mutex   sync.Mutex
+	pending *writeBatch
+}
+
+type writeBatch struct {
+	calls []*batchedCall
+	ops   int
+	// full is closed when the batch has MaxOps mutations.
+	full chan struct{}
+	// done is closed when the batch has been written.
+	done chan struct{}
+}
+
+type batchedCall struct {
+	mutations    []db.Mutation
+	rowsAffected []int64
+	err          error
+}
+
+func (b *Batcher) isDB() db.DB { return b }
+
+// Unwrap returns the wrapped database.
+func (b *Batcher) Unwrap() db.DB { return b.db }
+
+func (b *Batcher) Query(ctx context.Context, queries ...db.Query) ([][]db.Record, error) {
+	return b.db.Query(ctx, queries...)
+}
+
+func (b *Batcher) QueryRows(ctx context.Context, queries ...db.Query) ([]db.Rows, error) {
+	return b.db.QueryRows(ctx, queries...)
+}
+
+func (b *Batcher) QueryScalarInt64(ctx context.Context, sql string, args map[string]any) (int64, error) {
+	return b.db.QueryScalarInt64(ctx, sql, args)
+}
+
+func (b *Batcher) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
+	// Queued rqlite writes are already batched by rqlite.
+	if wo, _ := ctx.Value(rqliteWriteOptionsKey{}).(RqliteWriteOptions); !isBatchable(mutations) || wo.Queue {
+		return b.db.Mutate(ctx, mutations...)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	call := &batchedCall{mutations: mutations}
+
+	b.mutex.Lock()
+	batch := b.pending
+	leader := batch == nil
+	if leader {
+		batch = &writeBatch{
+			full: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		b.pending = batch
+	}
+	batch.calls = append(batch.calls, call)
+	batch.ops += len(mutations)
+	if batch.ops >= b.opts.MaxOps && b.pending == batch {
+		// Later writes start a new batch.
+		b.pending = nil
+		close(batch.full)
+	}
+	b.mutex.Unlock()
+
+	// The first write of the batch waits for others to join, then writes the batch.
+	if leader {
+		timer := time.NewTimer(b.opts.MaxDelay)
+		select {
+		case <-timer.C:
+		case <-batch.full:
+			timer.Stop()
+		}
+		b.mutex.Lock()
+		if b.pending == batch {
+			b.pending = nil
+		}
+		b.mutex.Unlock()
+		b.write(context.WithoutCancel(ctx), batch)
+		close(batch.done)
+		return call.rowsAffected, call.err
+	}
+	select {
+	case <-batch.done:
+		return call.rowsAffected, call.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrWriteMayHaveBeenApplied, ctx.Err())
+	}
+}
+
+// write writes the batch in a single transaction, and sets the result of each call.
+func (b *Batcher) write(ctx context.Context, batch *writeBatch) {
+	if len(batch.calls) == 1 {
+		call := batch.calls[0]
+		call.rowsAffected, call.err = b.db.Mutate(ctx, call.mutations...)
+		return
+	}
+	all := make([]db.Mutation, 0, batch.ops)
+	for _, call := range batch.calls {
+		all = append(all, call.mutations...)
+	}
+	rowsAffected, err := b.db.Mutate(ctx, all...)
+	var be *BatchError
+	if (err != nil && (!errors.As(err, &be) || !onlyVersionMismatches(be))) || len(rowsAffected) != len(all) {
+		// The transaction was rolled back, so run each call in its own transaction.
+		for _, call := range batch.calls {
+			call.rowsAffected, call.err = b.db.Mutate(ctx, call.mutations...)
+		}
+		return
+	}
+	var offset int
+	for _, call := range batch.calls {
+		end := offset + len(call.mutations)
+		call.rowsAffected = rowsAffected[offset:end:end]
+		if be != nil {
+			call.err = newBatchError(be.Errors[offset:end:end])
+		}
+		offset = end
+	}
+}
+
+// isBatchable returns true if the mutations are puts and patches, which can be combined with other
+// writes without changing their results.
+func isBatchable(mutations []db.Mutation) bool {
+	for _, m := range mutations {
+		if len(m.Writes) == 0 {
+			return false
+		}
+	}
+	return len(mutations) > 0
+}
+
+func onlyVersionMismatches(be *BatchError) bool {
+	for _, err := range be.Errors {
+		if err != nil && !errors.Is(err, db.ErrVersionMismatch) {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapDB returns the innermost database wrapped by Instrumented, Batcher, or other wrappers with an Unwrap method.
+func unwrapDB(d db.DB) db.DB {
+	for {
+		u, ok := d.(interface{ Unwrap() db.DB })
+		if !ok {
+			return d
+		}
+		d = u.Unwrap()
+	}
+}
@@ -0,0 +1,157 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestBatcher(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:batcher?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	t.Run("Store", func(t *testing.T) {
+		runStoreTests(t, NewStore(NewSqlite(pool), WithBatching(BatchOptions{})))
+	})
+
+	ctx := context.Background()
+	var calls atomic.Int64
+	counted := db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+		if call.Operation == "Mutate" {
+			calls.Add(1)
+		}
+		return next(ctx, call)
+	})(NewSqlite(pool))
+	store := NewStore(NewBatcher(counted, BatchOptions{MaxDelay: 50 * time.Millisecond, MaxOps: 1000}))
+	defer store.DeletePrefix(ctx, "batcher/", 0, -1)
+
+	// parallel runs the functions at the same time, and returns their errors.
+	parallel := func(fns ...func() error) []error {
+		errs := make([]error, len(fns))
+		var wg sync.WaitGroup
+		for i, fn := range fns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = fn()
+			}()
+		}
+		wg.Wait()
+		return errs
+	}
+
+	t.Run("Concurrent writes are written in one transaction", func(t *testing.T) {
+		calls.Store(0)
+		var fns []func() error
+		for i := range 50 {
+			fns = append(fns, func() error {
+				return store.Put(ctx, fmt.Sprintf("batcher/%d", i), -1, Person{Name: "Alice"})
+			})
+		}
+		if err := errors.Join(parallel(fns...)...); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := calls.Load(); n >= 50 {
+			t.Errorf("expected writes to be batched, got %d calls", n)
+		}
+		if n, err := store.CountPrefix(ctx, "batcher/"); err != nil || n != 50 {
+			t.Errorf("expected 50 records, got %d, %v", n, err)
+		}
+	})
+	t.Run("Each write gets its own version mismatch", func(t *testing.T) {
+		errs := parallel(
+			func() error { return store.Put(ctx, "batcher/0", 99, Person{Name: "Bob"}) },
+			func() error { return store.Patch(ctx, "batcher/1", -1, map[string]any{"name": "Bob"}) },
+		)
+		if !errors.Is(errs[0], db.ErrVersionMismatch) {
+			t.Errorf("expected version mismatch, got %v", errs[0])
+		}
+		if errs[1] != nil {
+			t.Errorf("unexpected error: %v", errs[1])
+		}
+	})
+	t.Run("Failed statements only fail their own write", func(t *testing.T) {
+		calls.Store(0)
+		// The batch is written when both writes have joined it.
+		s := NewStore(NewBatcher(counted, BatchOptions{MaxDelay: time.Hour, MaxOps: 2}))
+		invalid := db.PutPatches(db.PutInput("batcher/invalid", -1, Person{Name: "Invalid"}))
+		invalid.SQL = "insert into missing_table values (1);"
+		errs := parallel(
+			func() error { _, err := s.MutateAll(ctx, invalid); return err },
+			func() error { return s.Put(ctx, "batcher/2", -1, Person{Name: "Carol"}) },
+		)
+		if errs[0] == nil || errors.Is(errs[0], db.ErrVersionMismatch) {
+			t.Errorf("expected the statement's error, got %v", errs[0])
+		}
+		if errs[1] != nil {
+			t.Errorf("unexpected error: %v", errs[1])
+		}
+		var p Person
+		if _, _, err := store.Get(ctx, "batcher/2", &p); err != nil || p.Name != "Carol" {
+			t.Errorf("expected the valid write to be made, got %v, %v", p, err)
+		}
+		if n := calls.Load(); n != 3 {
+			t.Errorf("expected the batch to be retried as separate transactions, got %d calls", n)
+		}
+	})
+	t.Run("Cancelled writes return without waiting for the batch", func(t *testing.T) {
+		b := NewBatcher(counted, BatchOptions{MaxDelay: time.Hour, MaxOps: 3})
+		s := NewStore(b)
+		// joined waits until the batch has n writes.
+		joined := func(n int) {
+			for {
+				b.mutex.Lock()
+				count := 0
+				if b.pending != nil {
+					count = len(b.pending.calls)
+				}
+				b.mutex.Unlock()
+				if count >= n {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		leader := make(chan error, 1)
+		go func() { leader <- s.Put(ctx, "batcher/cancel/a", -1, Person{Name: "A"}) }()
+		joined(1)
+		cancelCtx, cancel := context.WithCancel(ctx)
+		cancelled := make(chan error, 1)
+		go func() { cancelled <- s.Put(cancelCtx, "batcher/cancel/b", -1, Person{Name: "B"}) }()
+		joined(2)
+		cancel()
+		if err := <-cancelled; !errors.Is(err, ErrWriteMayHaveBeenApplied) || !errors.Is(err, context.Canceled) {
+			t.Errorf("expected ErrWriteMayHaveBeenApplied wrapping context.Canceled, got %v", err)
+		}
+		// The third write fills the batch, which includes the cancelled write.
+		if err := s.Put(ctx, "batcher/cancel/c", -1, Person{Name: "C"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if err := <-leader; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if n, err := store.CountPrefix(ctx, "batcher/cancel/"); err != nil || n != 3 {
+			t.Errorf("expected 3 records, got %d, %v", n, err)
+		}
+	})
+	t.Run("Batches are written once they're full", func(t *testing.T) {
+		s := NewStore(NewBatcher(counted, BatchOptions{MaxDelay: time.Hour, MaxOps: 2}))
+		errs := parallel(
+			func() error { return s.Put(ctx, "batcher/full/a", -1, Person{Name: "A"}) },
+			func() error { return s.Put(ctx, "batcher/full/b", -1, Person{Name: "B"}) },
+		)
+		if err := errors.Join(errs...); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package sqlitekv
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// DefaultBlobChunkSize is the default size of the chunks that blobs are split into.
+// Each chunk is written in a separate request, to stay within rqlite's request size limits.
+const DefaultBlobChunkSize = 256 * 1024
+
+// WithBlobChunkSize sets the size of the chunks that blobs are split into by PutBlob.
+func WithBlobChunkSize(size int) StoreOption {
+	return func(s *Store) {
+		s.blobChunkSize = size
+	}
+}
+
+// BlobInfo is the metadata of a blob, which is stored as the value of the blob's key.
+type BlobInfo struct {
+	// ID identifies the chunks of the blob.
+	ID string `json:"id"`
+	// Size is the size of the blob in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 checksum of the blob.
+	SHA256 string `json:"sha256"`
+	// Chunks is the number of chunks that the blob is split into.
+	Chunks int `json:"chunks"`
+}
+
+// ErrBlobChecksumMismatch is returned by GetBlob if the blob doesn't match its checksum.
+var ErrBlobChecksumMismatch = errors.New("blob checksum mismatch")
+
+// ErrBlobChanged is returned when a blob is replaced or deleted by another writer while it's being read or written.
+var ErrBlobChanged = errors.New("blob changed by another writer")
+
+// ErrBlobEncryptionUnsupported is returned by PutBlob if the store encrypts values, because blob chunks are stored unencrypted.
+var ErrBlobEncryptionUnsupported = errors.New("blobs can't be stored by a store that encrypts values")
+
+// PutBlob stores the bytes read from r as a blob. The bytes are stored in chunks in a companion
+// table, and the value of the key is set to the blob's metadata. The version check is the same as Put.
+//
+// Deleting the key, including with DeletePrefix and DeleteRange, deletes the blob.
+//
+// Blobs are not encrypted, so if the store has a key provider, ErrBlobEncryptionUnsupported is returned.
+func (s *Store) PutBlob(ctx context.Context, key string, version int64, r io.Reader) (info BlobInfo, err error) {
+	if s.keys != nil {
+		return info, fmt.Errorf("putblob: %w", ErrBlobEncryptionUnsupported)
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return info, fmt.Errorf("putblob: %w", err)
+	}
+	info.ID = hex.EncodeToString(id)
+
+	// Remove the chunks written so far if the blob can't be stored. Only this blob's chunks are
+	// removed, because other writers may be writing blobs to the same key.
+	defer func() {
+		if err != nil {
+			s.db.Mutate(context.WithoutCancel(ctx), db.DeleteBlobChunks(key, info.ID))
+		}
+	}()
+
+	hash := sha256.New()
+	buf := make([]byte, s.blobChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			if _, err = s.db.Mutate(ctx, db.PutBlobChunk(info.ID, key, info.Chunks, buf[:n])); err != nil {
+				return info, fmt.Errorf("putblob: chunk %d: %w", info.Chunks, err)
+			}
+			info.Chunks++
+			info.Size += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return info, fmt.Errorf("putblob: %w", readErr)
+		}
+	}
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	metadata, err := json.Marshal(info)
+	if err != nil {
+		return info, fmt.Errorf("putblob: %w", err)
+	}
+	if _, err = s.db.Mutate(ctx, db.PutBlob(key, version, info.ID, info.Chunks, metadata)); err != nil {
+		return info, fmt.Errorf("putblob: %w", err)
+	}
+	return info, nil
+}
+
+// GetBlob writes the blob stored at the key to w. If the key does not exist, it returns ok=false.
+//
+// The blob is written to w as it's read, so if an error is returned, w may contain part of the blob.
+// If the blob doesn't match its checksum, ErrBlobChecksumMismatch is returned.
+func (s *Store) GetBlob(ctx context.Context, key string, w io.Writer) (info BlobInfo, ok bool, err error) {
+	outputs, err := s.db.Query(ctx, db.Get(key))
+	if err != nil {
+		return info, false, fmt.Errorf("getblob: %w", err)
+	}
+	if len(outputs[0]) == 0 {
+		return info, false, nil
+	}
+	r := outputs[0][0]
+	if r.Encoding != "" && r.Encoding != db.EncodingJSONB || r.UnmarshalValue(&info) != nil || info.ID == "" {
+		return info, false, fmt.Errorf("getblob: %q is not a blob", key)
+	}
+
+	hash := sha256.New()
+	w = io.MultiWriter(w, hash)
+	for chunk := range info.Chunks {
+		outputs, err := s.db.QueryRows(ctx, db.GetBlobChunk(info.ID, chunk))
+		if err != nil {
+			return info, true, fmt.Errorf("getblob: chunk %d: %w", chunk, err)
+		}
+		if len(outputs[0].Values) == 0 {
+			return info, true, fmt.Errorf("getblob: chunk %d: %w", chunk, ErrBlobChanged)
+		}
+		data, ok := outputs[0].Values[0][0].([]byte)
+		if !ok {
+			return info, true, fmt.Errorf("getblob: chunk %d: expected blob data, got %T", chunk, outputs[0].Values[0][0])
+		}
+		if _, err = w.Write(data); err != nil {
+			return info, true, fmt.Errorf("getblob: %w", err)
+		}
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != info.SHA256 {
+		return info, true, fmt.Errorf("getblob: %w", ErrBlobChecksumMismatch)
+	}
+	return info, true, nil
+}
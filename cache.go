@@ -0,0 +1,258 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// DefaultCacheMaxEntries is the default maximum number of records held by the cache enabled by WithCache.
+const DefaultCacheMaxEntries = 10000
+
+// CacheOptions configures the cache enabled by WithCache.
+type CacheOptions struct {
+	// MaxEntries is the maximum number of records in the cache. The default is DefaultCacheMaxEntries.
+	MaxEntries int
+	// MaxBytes is the maximum total size of the keys and values in the cache. Zero means no limit.
+	MaxBytes int
+	// TTL is how long a record is cached for. Zero means records are cached until they're evicted or
+	// invalidated.
+	TTL time.Duration
+	// Revalidate is how long a cached record is used for before its version is checked against the
+	// database, so that writes made by other processes are seen. Checking the version costs a query,
+	// but doesn't read the value. Zero means versions are not checked, so writes made by other
+	// processes are only seen when the record expires.
+	Revalidate time.Duration
+}
+
+// WithCache caches the records read by Get in memory, evicting the least recently used records once
+// the cache is full.
+//
+// Writes made through the store invalidate the records they change. Writes that can't be attributed
+// to keys, e.g. DeletePrefix, or mutations passed to MutateAll, clear the cache. Writes made by other
+// processes are seen once records expire or are revalidated, see CacheOptions.
+//
+// Records are cached after they're decrypted and decompressed.
+func WithCache(opts CacheOptions) StoreOption {
+	return func(s *Store) {
+		s.cache = newCache(opts)
+	}
+}
+
+// CacheStats are the statistics of the cache enabled by WithCache.
+type CacheStats struct {
+	// Hits is the number of calls to Get that were served from the cache.
+	Hits int64 `json:"hits"`
+	// Misses is the number of calls to Get that read the record from the database.
+	Misses int64 `json:"misses"`
+	// Revalidations is the number of times the version of a cached record was checked.
+	Revalidations int64 `json:"revalidations"`
+	// Invalidations is the number of records removed because they were changed.
+	Invalidations int64 `json:"invalidations"`
+	// Evictions is the number of records removed because the cache was full.
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int   `json:"bytes"`
+}
+
+// CacheStats returns the statistics of the cache. If the store has no cache, ok is false.
+func (s *Store) CacheStats() (stats CacheStats, ok bool) {
+	if s.cache == nil {
+		return stats, false
+	}
+	s.cache.mutex.Lock()
+	defer s.cache.mutex.Unlock()
+	stats = s.cache.stats
+	stats.Entries = s.cache.lru.Len()
+	stats.Bytes = s.cache.bytes
+	return stats, true
+}
+
+// getCached gets the record from the cache, checking its version if it needs to be revalidated.
+func (s *Store) getCached(ctx context.Context, key string) (r db.Record, ok bool, err error) {
+	r, ok, stale := s.cache.get(key)
+	if !ok || !stale {
+		return r, ok, nil
+	}
+	epoch := s.cache.currentEpoch()
+	q := db.GetVersion(key)
+	version, err := s.db.QueryScalarInt64(ctx, q.SQL, q.Args)
+	if err != nil {
+		return r, false, err
+	}
+	if !s.cache.revalidate(key, version, epoch) {
+		return r, false, nil
+	}
+	return r, true, nil
+}
+
+// cache is a least recently used cache of records.
+type cache struct {
+	opts CacheOptions
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+	// epoch is incremented each time records are invalidated, so that records read before the
+	// invalidation aren't added to the cache after it.
+	epoch uint64
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	record  db.Record
+	added   time.Time
+	checked time.Time
+}
+
+func newCache(opts CacheOptions) *cache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultCacheMaxEntries
+	}
+	return &cache{
+		opts:    opts,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.record.Key) + len(e.record.Value)
+}
+
+// get returns a copy of the cached record. If the record needs to be revalidated, stale is true.
+func (c *cache) get(key string) (r db.Record, ok, stale bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return r, false, false
+	}
+	e := el.Value.(*cacheEntry)
+	now := c.now()
+	if c.opts.TTL > 0 && now.Sub(e.added) >= c.opts.TTL {
+		c.removeElement(el)
+		c.stats.Misses++
+		return r, false, false
+	}
+	stale = c.opts.Revalidate > 0 && now.Sub(e.checked) >= c.opts.Revalidate
+	if !stale {
+		c.stats.Hits++
+		c.lru.MoveToFront(el)
+	}
+	r = e.record
+	r.Value = bytes.Clone(r.Value)
+	return r, true, stale
+}
+
+// revalidate records that the version of the key was checked. If the cached record has a different
+// version, it's removed, and false is returned.
+func (c *cache) revalidate(key string, version int64, epoch uint64) (ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Revalidations++
+	el, ok := c.entries[key]
+	if !ok || epoch != c.epoch || el.Value.(*cacheEntry).record.Version != version {
+		if ok {
+			c.removeElement(el)
+			c.stats.Invalidations++
+		}
+		c.stats.Misses++
+		return false
+	}
+	el.Value.(*cacheEntry).checked = c.now()
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return true
+}
+
+func (c *cache) currentEpoch() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.epoch
+}
+
+// add adds the record to the cache, unless records have been invalidated since the epoch.
+func (c *cache) add(r db.Record, epoch uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if el, ok := c.entries[r.Key]; ok {
+		c.removeElement(el)
+	}
+	now := c.now()
+	e := &cacheEntry{
+		record:  r,
+		added:   now,
+		checked: now,
+	}
+	e.record.Value = bytes.Clone(r.Value)
+	if c.opts.MaxBytes > 0 && e.size() > c.opts.MaxBytes {
+		return
+	}
+	c.entries[r.Key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	for c.lru.Len() > c.opts.MaxEntries || (c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes) {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// deleteSQL is the SQL of db.Delete, which changes a single key.
+var deleteSQL = db.Delete("").SQL
+
+// invalidate removes the records changed by the mutations, or clears the cache if the keys that the
+// mutations change aren't known.
+func (c *cache) invalidate(mutations []db.Mutation) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.epoch++
+	for _, m := range mutations {
+		keys := make([]string, len(m.Writes))
+		for i, w := range m.Writes {
+			keys[i] = w.Key
+		}
+		if key, ok := m.Args[":key"].(string); ok && m.SQL == deleteSQL {
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			c.stats.Invalidations += int64(c.lru.Len())
+			c.entries = make(map[string]*list.Element)
+			c.lru.Init()
+			c.bytes = 0
+			return
+		}
+		for _, key := range keys {
+			if el, ok := c.entries[key]; ok {
+				c.removeElement(el)
+				c.stats.Invalidations++
+			}
+		}
+	}
+}
+
+func (c *cache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.record.Key)
+	c.bytes -= e.size()
+}
+
+// middleware returns a middleware that invalidates the records changed by mutations.
+func (c *cache) middleware() db.Middleware {
+	return db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+		if call.Operation == "Mutate" {
+			defer c.invalidate(call.Mutations)
+		}
+		return next(ctx, call)
+	})
+}
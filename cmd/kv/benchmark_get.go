@@ -6,16 +6,32 @@ import (
 	"math/rand/v2"
 	"sync"
 	"time"
+
+	"github.com/a-h/sqlitekv"
 )
 
 type BenchmarkGetCommand struct {
 	X int `arg:"-x,--number" help:"Number of items to put" default:"100"`
 	N int `arg:"-n,--number" help:"Number of items to get from the set" default:"10000"`
 	W int `arg:"-w,--workers" help:"Number of workers to use" default:"100"`
+
+	Cache           bool          `help:"Cache records in memory."`
+	CacheSize       int           `help:"Maximum number of records in the cache." default:"10000"`
+	CacheTTL        time.Duration `help:"How long records are cached for. Zero means no limit." default:"0s"`
+	CacheRevalidate time.Duration `help:"How long cached records are used before their version is checked. Zero means versions are not checked." default:"0s"`
+	VersionOnly     bool          `help:"Only read the key and version of each record, without unmarshaling its value."`
 }
 
 func (c *BenchmarkGetCommand) Run(ctx context.Context, g GlobalFlags) error {
-	store, err := g.Store()
+	var opts []sqlitekv.StoreOption
+	if c.Cache {
+		opts = append(opts, sqlitekv.WithCache(sqlitekv.CacheOptions{
+			MaxEntries: c.CacheSize,
+			TTL:        c.CacheTTL,
+			Revalidate: c.CacheRevalidate,
+		}))
+	}
+	store, err := g.Store(opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
@@ -59,8 +75,12 @@ func (c *BenchmarkGetCommand) Run(ctx context.Context, g GlobalFlags) error {
 		go func() {
 			defer wg.Done()
 			var p map[string]any
+			v := any(&p)
+			if c.VersionOnly {
+				v = nil
+			}
 			for key := range gets {
-				_, _, err := store.Get(ctx, key, &p)
+				_, _, err := store.Get(ctx, key, v)
 				if err != nil {
 					fmt.Printf("error: %v\n", err)
 					return
@@ -74,6 +94,9 @@ func (c *BenchmarkGetCommand) Run(ctx context.Context, g GlobalFlags) error {
 	timeTaken := end.Sub(start)
 	opsPerSecond := float64(c.N) / timeTaken.Seconds()
 	fmt.Printf("Complete, in %v, %v ops per second\n", end.Sub(start), opsPerSecond)
+	if stats, ok := store.CacheStats(); ok {
+		fmt.Printf("Cache: %d hits, %d misses, %d revalidations, %d evictions\n", stats.Hits, stats.Misses, stats.Revalidations, stats.Evictions)
+	}
 
 	return nil
 }
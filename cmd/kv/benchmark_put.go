@@ -5,15 +5,28 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/a-h/sqlitekv"
 )
 
 type BenchmarkPutCommand struct {
 	N int `arg:"-n,--number" help:"Number of items to put" default:"30000"`
 	W int `arg:"-w,--workers" help:"Number of workers to use" default:"100"`
+
+	Batch      bool          `help:"Coalesce concurrent puts into a single transaction."`
+	BatchDelay time.Duration `help:"The longest time a put waits for others to join its batch. If zero, the default for the store type is used." default:"0s"`
+	BatchSize  int           `help:"The number of puts that causes a batch to be written. If zero, the default for the store type is used." default:"0"`
 }
 
 func (c *BenchmarkPutCommand) Run(ctx context.Context, g GlobalFlags) error {
-	store, err := g.Store()
+	var opts []sqlitekv.StoreOption
+	if c.Batch {
+		opts = append(opts, sqlitekv.WithBatching(sqlitekv.BatchOptions{
+			MaxDelay: c.BatchDelay,
+			MaxOps:   c.BatchSize,
+		}))
+	}
+	store, err := g.Store(opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
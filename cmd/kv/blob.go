@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type PutBlobCommand struct {
+	Key     string `arg:"" help:"The key to store the blob at. The blob is read from stdin." required:""`
+	Version int64  `help:"The version of the key to overwrite, or -1 if no version check is required." default:"-1"`
+}
+
+func (c *PutBlobCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	info, err := store.PutBlob(ctx, c.Key, c.Version, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+type GetBlobCommand struct {
+	Key string `arg:"" help:"The key of the blob to write to stdout." required:""`
+}
+
+func (c *GetBlobCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	_, ok, err := store.GetBlob(ctx, c.Key, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%q not found", c.Key)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/kong"
+)
+
+// Config is the config file, which contains named profiles of flag values, e.g.
+//
+//	profile = "local"
+//
+//	[profiles.local]
+//	connection = "file:local.db?mode=rwc"
+//
+//	[profiles.prod]
+//	type = "rqlite"
+//	connection = "http://node1:4001,http://node2:4001"
+//	user = "admin"
+//	password-file = "~/.config/kv/prod-password"
+type Config struct {
+	// Profile is the profile that's used if --profile isn't set.
+	Profile string `toml:"profile"`
+	// Profiles are flag values, keyed by the name of the flag.
+	Profiles map[string]map[string]any `toml:"profiles"`
+}
+
+// defaultConfigPath returns the path of the config file that's used if --config isn't set.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kv", "config.toml")
+}
+
+// loadConfig reads the config file. If the file is the default, and it doesn't exist, an empty config is returned.
+func loadConfig(path string) (config Config, err error) {
+	explicit := path != ""
+	if !explicit {
+		if path = defaultConfigPath(); path == "" {
+			return config, nil
+		}
+	}
+	if _, err = toml.DecodeFile(path, &config); err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return config, nil
+}
+
+// BeforeResolve adds a resolver that sets flags from the profile selected by --config and --profile.
+func (c *CLI) BeforeResolve(kctx *kong.Context) error {
+	r, err := newConfigResolver(kctx)
+	if err != nil {
+		return err
+	}
+	kctx.AddResolver(r)
+	return nil
+}
+
+// configResolver sets flags that aren't set on the command line, or by their environment variables,
+// from the selected profile of the config file.
+type configResolver struct {
+	profile map[string]any
+}
+
+// resolverFlags are the flags that select the profile, so they can't be set by it.
+var resolverFlags = []string{"help", "config", "profile"}
+
+// newConfigResolver reads the profile selected by the --config and --profile flags.
+func newConfigResolver(kctx *kong.Context) (*configResolver, error) {
+	var path, name string
+	for _, flag := range kctx.Flags() {
+		switch flag.Name {
+		case "config":
+			path, _ = kctx.FlagValue(flag).(string)
+		case "profile":
+			name, _ = kctx.FlagValue(flag).(string)
+		}
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = config.Profile
+	}
+	if name == "" {
+		return &configResolver{}, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found in config file", name)
+	}
+	names := make(map[string]bool)
+	addFlagNames(names, kctx.Model.Node)
+	for key := range profile {
+		if !names[key] || slices.Contains(resolverFlags, key) {
+			return nil, fmt.Errorf("profile %q: unknown flag %q", name, key)
+		}
+	}
+	return &configResolver{profile: profile}, nil
+}
+
+func (r *configResolver) Validate(app *kong.Application) error { return nil }
+
+func (r *configResolver) Resolve(kctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+	if slices.Contains(resolverFlags, flag.Name) {
+		return nil, nil
+	}
+	for _, env := range flag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return nil, nil
+		}
+	}
+	if v, ok := r.profile[flag.Name]; ok {
+		return v, nil
+	}
+	if v, ok := r.profile[strings.ReplaceAll(flag.Name, "-", "_")]; ok {
+		return v, nil
+	}
+	return nil, nil
+}
+
+// addFlagNames adds the names of the flags of the node and its subcommands to names.
+func addFlagNames(names map[string]bool, node *kong.Node) {
+	for _, flag := range node.Flags {
+		names[flag.Name] = true
+		names[strings.ReplaceAll(flag.Name, "-", "_")] = true
+	}
+	for _, child := range node.Children {
+		addFlagNames(names, child)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+const testConfig = `profile = "local"
+
+[profiles.local]
+connection = "file:local.db"
+
+[profiles.prod]
+type = "rqlite"
+connection = "http://prod:4001"
+busy_timeout = "1s"
+password-file = "{dir}/password"
+
+[profiles.unknown-flag]
+colour = "red"
+`
+
+const testOtherConfig = `[profiles.other]
+connection = "file:other.db"
+`
+
+func TestConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		noConfig bool
+		env      map[string]string
+		args     []string
+		// Expected values.
+		typ         string
+		connection  string
+		busyTimeout time.Duration
+		password    string
+		keys        []string
+		// noDiscoverNodes is set if rqlite nodes aren't discovered.
+		noDiscoverNodes bool
+		warning         bool
+		err             bool
+	}{
+		{
+			name:       "Flags have their defaults without a config file",
+			noConfig:   true,
+			connection: "file:data.db?mode=rwc",
+		},
+		{
+			name:       "The config file's profile is used by default",
+			connection: "file:local.db",
+		},
+		{
+			name:        "--profile selects the profile",
+			args:        []string{"--profile", "prod"},
+			typ:         "rqlite",
+			connection:  "http://prod:4001",
+			busyTimeout: time.Second,
+			password:    "secret",
+		},
+		{
+			name:        "KV_PROFILE selects the profile",
+			env:         map[string]string{"KV_PROFILE": "prod"},
+			typ:         "rqlite",
+			connection:  "http://prod:4001",
+			busyTimeout: time.Second,
+			password:    "secret",
+		},
+		{
+			name:       "--profile takes precedence over KV_PROFILE",
+			env:        map[string]string{"KV_PROFILE": "prod"},
+			args:       []string{"--profile", "local"},
+			connection: "file:local.db",
+		},
+		{
+			name:        "Environment variables take precedence over the profile",
+			env:         map[string]string{"KV_CONNECTION": "http://env:4001"},
+			args:        []string{"--profile", "prod"},
+			typ:         "rqlite",
+			connection:  "http://env:4001",
+			busyTimeout: time.Second,
+			password:    "secret",
+		},
+		{
+			name:        "Flags take precedence over environment variables and the profile",
+			env:         map[string]string{"KV_TYPE": "rqlite", "KV_CONNECTION": "http://env:4001"},
+			args:        []string{"--profile", "prod", "--type", "sqlite", "--connection", "file:flag.db"},
+			connection:  "file:flag.db",
+			busyTimeout: time.Second,
+			password:    "secret",
+		},
+		{
+			name:       "--config selects the config file",
+			args:       []string{"--config", "{dir}/other.toml", "--profile", "other"},
+			connection: "file:other.db",
+		},
+		{
+			name:       "KV_CONFIG selects the config file",
+			env:        map[string]string{"KV_CONFIG": "{dir}/other.toml", "KV_PROFILE": "other"},
+			connection: "file:other.db",
+		},
+		{
+			name: "A config file that's set must exist",
+			args: []string{"--config", "{dir}/missing.toml"},
+			err:  true,
+		},
+		{
+			name: "The profile must exist",
+			args: []string{"--profile", "missing"},
+			err:  true,
+		},
+		{
+			name: "Profiles can only set flags",
+			args: []string{"--profile", "unknown-flag"},
+			err:  true,
+		},
+		{
+			name:       "The password is read from --password-file",
+			args:       []string{"--password-file", "{dir}/password"},
+			connection: "file:local.db",
+			password:   "secret",
+		},
+		{
+			name:        "KV_PASSWORD takes precedence over the profile's password file",
+			env:         map[string]string{"KV_PASSWORD": "env"},
+			args:        []string{"--profile", "prod"},
+			typ:         "rqlite",
+			connection:  "http://prod:4001",
+			busyTimeout: time.Second,
+			password:    "env",
+		},
+		{
+			name:       "--password is deprecated",
+			args:       []string{"--password", "flag"},
+			connection: "file:local.db",
+			password:   "flag",
+			warning:    true,
+		},
+		{
+			name:       "The encryption keys are read from --encryption-keys-file",
+			args:       []string{"--encryption-keys-file", "{dir}/keys"},
+			connection: "file:local.db",
+			keys:       []string{"a:AQID", "b:BAUG"},
+		},
+		{
+			name:       "KV_ENCRYPTION_KEYS takes precedence over the encryption keys file",
+			env:        map[string]string{"KV_ENCRYPTION_KEYS": "c:BwgJ", "KV_ENCRYPTION_KEYS_FILE": "{dir}/keys"},
+			connection: "file:local.db",
+			keys:       []string{"c:BwgJ"},
+		},
+		{
+			name:       "--encryption-keys is deprecated",
+			args:       []string{"--encryption-keys", "c:BwgJ"},
+			connection: "file:local.db",
+			keys:       []string{"c:BwgJ"},
+			warning:    true,
+		},
+		{
+			name:            "--no-discover-nodes disables discovering rqlite nodes",
+			args:            []string{"--no-discover-nodes"},
+			connection:      "file:local.db",
+			noDiscoverNodes: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setConfigTestEnv(t)
+			if !tt.noConfig {
+				writeTestFile(t, filepath.Join(dir, "kv", "config.toml"), strings.ReplaceAll(testConfig, "{dir}", dir))
+			}
+			writeTestFile(t, filepath.Join(dir, "other.toml"), testOtherConfig)
+			writeTestFile(t, filepath.Join(dir, "password"), "secret\n")
+			writeTestFile(t, filepath.Join(dir, "keys"), "a:AQID\nb:BAUG\n")
+			for k, v := range tt.env {
+				t.Setenv(k, strings.ReplaceAll(v, "{dir}", dir))
+			}
+			args := []string{"count"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{dir}", dir))
+			}
+
+			var cli CLI
+			var stderr bytes.Buffer
+			parser, err := kong.New(&cli, kong.Writers(io.Discard, &stderr))
+			if err != nil {
+				t.Fatalf("unexpected error creating parser: %v", err)
+			}
+			_, err = parser.Parse(args)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.typ == "" {
+				tt.typ = "sqlite"
+			}
+			if tt.busyTimeout == 0 {
+				tt.busyTimeout = 5 * time.Second
+			}
+			if cli.Type != tt.typ {
+				t.Errorf("expected type %q, got %q", tt.typ, cli.Type)
+			}
+			if cli.Connection != tt.connection {
+				t.Errorf("expected connection %q, got %q", tt.connection, cli.Connection)
+			}
+			if cli.BusyTimeout != tt.busyTimeout {
+				t.Errorf("expected busy timeout %v, got %v", tt.busyTimeout, cli.BusyTimeout)
+			}
+			if cli.DiscoverNodes == tt.noDiscoverNodes {
+				t.Errorf("expected discover nodes %v, got %v", !tt.noDiscoverNodes, cli.DiscoverNodes)
+			}
+			password, err := cli.password()
+			if err != nil {
+				t.Fatalf("unexpected error reading password: %v", err)
+			}
+			if password != tt.password {
+				t.Errorf("expected password %q, got %q", tt.password, password)
+			}
+			keys, err := cli.encryptionKeys()
+			if err != nil {
+				t.Fatalf("unexpected error reading encryption keys: %v", err)
+			}
+			if !slices.Equal(keys, tt.keys) {
+				t.Errorf("expected encryption keys %v, got %v", tt.keys, keys)
+			}
+			if warned := strings.Contains(stderr.String(), "is deprecated"); warned != tt.warning {
+				t.Errorf("expected warning %v, got %q", tt.warning, stderr.String())
+			}
+		})
+	}
+}
+
+// setConfigTestEnv unsets the KV_ environment variables, and sets the user's config directory to a
+// temporary directory, which is returned.
+func setConfigTestEnv(t *testing.T) (dir string) {
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); strings.HasPrefix(k, "KV_") {
+			t.Setenv(k, "")
+			os.Unsetenv(k)
+		}
+	}
+	dir = t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	return dir
+}
+
+func writeTestFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
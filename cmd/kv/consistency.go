@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/a-h/sqlitekv"
+)
+
+// ConsistencyFlags are the flags shared by commands that read records, which set the read consistency of rqlite.
+type ConsistencyFlags struct {
+	Consistency string        `help:"The rqlite read consistency level: none, weak, strong, linearizable or auto. Defaults to strong."`
+	Freshness   time.Duration `help:"With --consistency none, fail if the rqlite node hasn't heard from the leader for longer than this."`
+}
+
+// Context returns a context that makes rqlite reads use the consistency flags.
+func (f ConsistencyFlags) Context(ctx context.Context) (context.Context, error) {
+	if f.Consistency == "" && f.Freshness == 0 {
+		return ctx, nil
+	}
+	opts := sqlitekv.RqliteReadOptions{
+		Freshness: f.Freshness,
+	}
+	if f.Consistency != "" {
+		level, err := sqlitekv.ParseReadConsistencyLevel(f.Consistency)
+		if err != nil {
+			return ctx, fmt.Errorf("invalid --consistency: %w", err)
+		}
+		opts.Level = level
+	}
+	return sqlitekv.WithRqliteReadOptions(ctx, opts), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/a-h/sqlitekv"
+)
+
+// encryptionKeys returns the id:base64 pairs of the encryption keys, from --encryption-keys, or the
+// lines of --encryption-keys-file.
+func (g GlobalFlags) encryptionKeys() (pairs []string, err error) {
+	if len(g.EncryptionKeys) > 0 || g.EncryptionKeysFile == "" {
+		return g.EncryptionKeys, nil
+	}
+	b, err := os.ReadFile(g.EncryptionKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption keys file: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			pairs = append(pairs, line)
+		}
+	}
+	return pairs, nil
+}
+
+// parseEncryptionKeys parses keys in the form id:base64. The first key is the current key.
+func parseEncryptionKeys(pairs []string) (*sqlitekv.StaticKeyProvider, error) {
+	keys := make(map[string][]byte, len(pairs))
+	var current string
+	for i, pair := range pairs {
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %d: expected id:base64", i)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		if i == 0 {
+			current = id
+		}
+		keys[id] = key
+	}
+	return sqlitekv.NewStaticKeyProvider(current, keys)
+}
+
+type RotateKeysCommand struct {
+	Prefix    string `arg:"" help:"The prefix of the keys to re-encrypt." default:""`
+	BatchSize int    `help:"The number of records to re-encrypt in each batch." default:"100"`
+}
+
+func (c *RotateKeysCommand) Run(ctx context.Context, g GlobalFlags) error {
+	pairs, err := g.encryptionKeys()
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("no encryption keys, set KV_ENCRYPTION_KEYS or --encryption-keys-file")
+	}
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	rotated, err := store.RotateKeys(ctx, c.Prefix, c.BatchSize)
+	fmt.Printf("Re-encrypted %d records\n", rotated)
+	return err
+}
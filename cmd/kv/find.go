@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/a-h/sqlitekv"
+)
+
+type FindCommand struct {
+	Prefix    string `arg:"" help:"The prefix to search within." required:""`
+	Filter    string `arg:"" help:"The filter expression, e.g. 'name == \"Alice\" && age > 30'." optional:""`
+	Offset    int    `arg:"-o,--offset" help:"Range offset." default:"0"`
+	Limit     int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	ScanFlags `embed:""`
+}
+
+func (c *FindCommand) Run(ctx context.Context, g GlobalFlags) error {
+	opts, err := c.ScanFlags.Options()
+	if err != nil {
+		return err
+	}
+
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	data, err := store.Find(ctx, c.Prefix, c.Filter, "", c.Offset, c.Limit, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to find data: %w", err)
+	}
+
+	records, err := sqlitekv.RecordsOf[map[string]any](data)
+	if err != nil {
+		return fmt.Errorf("failed to convert records: %w", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
@@ -5,24 +5,42 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 type GetCommand struct {
-	Key          string `arg:"" help:"The key to get." required:""`
-	PrintVersion bool   `help:"Print the version of the key."`
+	Key              string `arg:"" help:"The key to get." required:""`
+	Path             string `help:"JSON path of the field to get, e.g. $.name."`
+	PrintVersion     bool   `help:"Print the version of the key."`
+	ConsistencyFlags `embed:""`
 }
 
 func (c *GetCommand) Run(ctx context.Context, g GlobalFlags) error {
+	ctx, err := c.ConsistencyFlags.Context(ctx)
+	if err != nil {
+		return err
+	}
+
 	store, err := g.Store()
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
 
-	var data map[string]any
-	r, ok, err := store.Get(ctx, c.Key, &data)
+	var data any
+	var r db.Record
+	var ok bool
+	if c.Path != "" {
+		r, ok, err = store.GetPath(ctx, c.Key, c.Path, &data)
+	} else {
+		r, ok, err = store.Get(ctx, c.Key, &data)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get data: %w", err)
 	}
+	if !ok && r.Key != "" {
+		return fmt.Errorf("%q not found in %q", c.Path, c.Key)
+	}
 	if !ok {
 		return fmt.Errorf("%q not found", c.Key)
 	}
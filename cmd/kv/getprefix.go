@@ -10,18 +10,24 @@ import (
 )
 
 type GetPrefixCommand struct {
-	Prefix string `arg:"" help:"The prefix to search for." required:""`
-	Offset int    `arg:"-o,--offset" help:"Range offset." default:"0"`
-	Limit  int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	Prefix    string `arg:"" help:"The prefix to search for." required:""`
+	Offset    int    `arg:"-o,--offset" help:"Range offset." default:"0"`
+	Limit     int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	ScanFlags `embed:""`
 }
 
 func (c *GetPrefixCommand) Run(ctx context.Context, g GlobalFlags) error {
+	opts, err := c.ScanFlags.Options()
+	if err != nil {
+		return err
+	}
+
 	store, err := g.Store()
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
 
-	data, err := store.GetPrefix(ctx, c.Prefix, c.Offset, c.Limit)
+	data, err := store.GetPrefix(ctx, c.Prefix, c.Offset, c.Limit, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to get data: %w", err)
 	}
@@ -10,19 +10,25 @@ import (
 )
 
 type GetRangeCommand struct {
-	From   string `arg:"" help:"Start of the range." required:""`
-	To     string `arg:"" help:"End of the range (exclusive)." required:""`
-	Offset int    `arg:"-o,--offset" help:"Range offset." default:"0"`
-	Limit  int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	From      string `arg:"" help:"Start of the range." required:""`
+	To        string `arg:"" help:"End of the range (exclusive)." required:""`
+	Offset    int    `arg:"-o,--offset" help:"Range offset." default:"0"`
+	Limit     int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	ScanFlags `embed:""`
 }
 
 func (c *GetRangeCommand) Run(ctx context.Context, g GlobalFlags) error {
+	opts, err := c.ScanFlags.Options()
+	if err != nil {
+		return err
+	}
+
 	store, err := g.Store()
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
 
-	data, err := store.GetRange(ctx, c.From, c.To, c.Offset, c.Limit)
+	data, err := store.GetRange(ctx, c.From, c.To, c.Offset, c.Limit, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to get data: %w", err)
 	}
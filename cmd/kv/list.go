@@ -10,17 +10,28 @@ import (
 )
 
 type ListCommand struct {
-	Offset int `arg:"-o,--offset" help:"Range offset." default:"0"`
-	Limit  int `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	Offset           int `arg:"-o,--offset" help:"Range offset." default:"0"`
+	Limit            int `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"1000"`
+	ScanFlags        `embed:""`
+	ConsistencyFlags `embed:""`
 }
 
 func (c *ListCommand) Run(ctx context.Context, g GlobalFlags) error {
+	opts, err := c.ScanFlags.Options()
+	if err != nil {
+		return err
+	}
+	ctx, err = c.ConsistencyFlags.Context(ctx)
+	if err != nil {
+		return err
+	}
+
 	store, err := g.Store()
 	if err != nil {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
 
-	data, err := store.List(ctx, c.Offset, c.Limit)
+	data, err := store.List(ctx, c.Offset, c.Limit, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to list data: %w", err)
 	}
@@ -5,65 +5,128 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/a-h/sqlitekv"
 	"github.com/a-h/sqlitekv/db"
 	"github.com/alecthomas/kong"
-	rqlitehttp "github.com/rqlite/rqlite-go-http"
-	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 type GlobalFlags struct {
-	Type       string `help:"The type of KV store to use." enum:"sqlite,rqlite" default:"sqlite"`
-	Connection string `help:"The connection string to use." default:"file:data.db?mode=rwc"`
+	Config             string        `help:"The config file of named profiles of flag values. Defaults to kv/config.toml in the user's config directory, e.g. ~/.config/kv/config.toml." type:"path" env:"KV_CONFIG"`
+	Profile            string        `help:"The profile of the config file to use. Defaults to the config file's profile." env:"KV_PROFILE"`
+	Type               string        `help:"The type of KV store to use." enum:"sqlite,rqlite" default:"sqlite" env:"KV_TYPE"`
+	Connection         string        `help:"The connection string to use. For rqlite, a comma-separated list of the addresses of the nodes of the cluster." default:"file:data.db?mode=rwc" env:"KV_CONNECTION"`
+	User               string        `help:"The rqlite user." env:"KV_USER"`
+	Password           string        `help:"The rqlite password. Deprecated on the command line, where it's saved in shell history, use KV_PASSWORD or --password-file instead." env:"KV_PASSWORD"`
+	PasswordFile       string        `help:"A file that contains the rqlite password." type:"path" env:"KV_PASSWORD_FILE"`
+	DiscoverNodes      bool          `help:"Discover the other members of the rqlite cluster, and its leader, from the nodes of the connection string. Disable it to only use those nodes, e.g. when they're behind a load balancer." default:"true" negatable:"" env:"KV_DISCOVER_NODES"`
+	Compression        string        `help:"The algorithm used to compress values." enum:"none,zstd,gzip" default:"none" env:"KV_COMPRESSION"`
+	CompressMinSize    int           `help:"The minimum size, in bytes, of values that are compressed." default:"1024" env:"KV_COMPRESS_MIN_SIZE"`
+	EncryptionKeys     []string      `help:"Keys used to encrypt values, as id:base64 pairs. The first key is used to encrypt new values. Deprecated on the command line, where they're saved in shell history, use KV_ENCRYPTION_KEYS or --encryption-keys-file instead." env:"KV_ENCRYPTION_KEYS"`
+	EncryptionKeysFile string        `help:"A file that contains the keys used to encrypt values, as id:base64 pairs, one per line. The first key is used to encrypt new values." type:"path" env:"KV_ENCRYPTION_KEYS_FILE"`
+	PlaintextFields    []string      `help:"JSON paths of fields of encrypted values that are stored unencrypted, so that they can be queried." env:"KV_PLAINTEXT_FIELDS"`
+	BusyTimeout        time.Duration `help:"How long sqlite statements wait for locks held by other connections." default:"5s" env:"KV_BUSY_TIMEOUT"`
+	PoolSize           int           `help:"The number of sqlite connections used for queries. If zero, a default is used." default:"0" env:"KV_POOL_SIZE"`
+	SingleWriter       bool          `help:"Use a separate sqlite connection for writes, so that writes are serialized, and reads run in parallel." env:"KV_SINGLE_WRITER"`
+	RawJSONB           bool          `help:"Read sqlite values as JSONB, and convert them to JSON in Go rather than in SQL." env:"KV_RAW_JSONB"`
 }
 
-func (g GlobalFlags) Store() (*sqlitekv.Store, error) {
+func (g GlobalFlags) Store(opts ...sqlitekv.StoreOption) (*sqlitekv.Store, error) {
 	db, err := g.DB()
 	if err != nil {
 		return nil, err
 	}
-	return sqlitekv.NewStore(db), nil
+	switch g.Compression {
+	case "zstd":
+		opts = append(opts, sqlitekv.WithCompression("", sqlitekv.ZstdCompressor{}, g.CompressMinSize))
+	case "gzip":
+		opts = append(opts, sqlitekv.WithCompression("", sqlitekv.GzipCompressor{}, g.CompressMinSize))
+	}
+	pairs, err := g.encryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) > 0 {
+		keys, err := parseEncryptionKeys(pairs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sqlitekv.WithEncryption(keys, g.PlaintextFields...))
+	}
+	return sqlitekv.NewStore(db, opts...), nil
 }
 
 func (g GlobalFlags) DB() (db.DB, error) {
 	switch g.Type {
 	case "sqlite":
-		pool, err := sqlitex.NewPool(g.Connection, sqlitex.PoolOptions{})
+		s, err := sqlitekv.NewSqliteFromPath(g.Connection, sqlitekv.SqliteOptions{
+			PoolSize:     g.PoolSize,
+			SingleWriter: g.SingleWriter,
+		})
 		if err != nil {
 			return nil, err
 		}
-		return sqlitekv.NewSqlite(pool), nil
+		s.BusyTimeout = g.BusyTimeout
+		s.RawJSONB = g.RawJSONB
+		return s, nil
 	case "rqlite":
-		u, err := url.Parse(g.Connection)
-		if err != nil {
-			return nil, err
+		// The connection string is a comma-separated list of the nodes of the cluster.
+		var addresses []string
+		var opts sqlitekv.RqliteOptions
+		for _, address := range strings.Split(g.Connection, ",") {
+			u, err := url.Parse(strings.TrimSpace(address))
+			if err != nil {
+				return nil, err
+			}
+			if user, password := u.Query().Get("user"), u.Query().Get("password"); user != "" && password != "" {
+				opts.User, opts.Password = user, password
+			}
+			// Remove user and password from the connection string.
+			u.RawQuery = ""
+			addresses = append(addresses, u.String())
+		}
+		if g.User != "" {
+			opts.User = g.User
 		}
-		user := u.Query().Get("user")
-		password := u.Query().Get("password")
-		// Remove user and password from the connection string.
-		u.RawQuery = ""
-		client, err := rqlitehttp.NewClient(u.String(), nil)
+		password, err := g.password()
 		if err != nil {
 			return nil, err
 		}
-		if user != "" && password != "" {
-			client.SetBasicAuth(user, password)
+		if password != "" {
+			opts.Password = password
 		}
-		return sqlitekv.NewRqlite(client), nil
+		opts.DiscoverNodes = g.DiscoverNodes
+		return sqlitekv.NewRqliteFromAddresses(addresses, opts)
 	default:
 		return nil, fmt.Errorf("unknown store type %q", g.Type)
 	}
 }
 
+// password returns the rqlite password, from --password, or the contents of --password-file.
+func (g GlobalFlags) password() (string, error) {
+	if g.Password != "" || g.PasswordFile == "" {
+		return g.Password, nil
+	}
+	b, err := os.ReadFile(g.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
 type CLI struct {
 	GlobalFlags
 
 	Init         InitCommand         `cmd:"init" help:"Initialize the store."`
+	Migrate      MigrateCommand      `cmd:"migrate" help:"Apply pending migrations to the store's tables."`
 	Get          GetCommand          `cmd:"get" help:"Get a key."`
 	GetPrefix    GetPrefixCommand    `cmd:"get-prefix" help:"Get all keys with a given prefix."`
 	GetRange     GetRangeCommand     `cmd:"get-range" help:"Get a range of keys."`
 	List         ListCommand         `cmd:"list" help:"List all keys."`
+	Find         FindCommand         `cmd:"find" help:"Find keys with a given prefix that match a filter."`
+	Search       SearchCommand       `cmd:"search" help:"Search the values of keys with a given prefix using a full-text search index."`
 	Put          PutCommand          `cmd:"put" help:"Put a key."`
 	Delete       DeleteCommand       `cmd:"delete" help:"Delete a key."`
 	DeletePrefix DeletePrefixCommand `cmd:"delete-prefix" help:"Delete all keys with a given prefix."`
@@ -71,13 +134,44 @@ type CLI struct {
 	Count        CountCommand        `cmd:"count" help:"Count the number of keys."`
 	CountPrefix  CountPrefixCommand  `cmd:"count-prefix" help:"Count the number of keys with a given prefix."`
 	CountRange   CountRangeCommand   `cmd:"count-range" help:"Count the number of keys in a range."`
+	Stats        StatsCommand        `cmd:"stats" help:"Show the number of keys, the size of their values, and the compression ratio."`
 	Patch        PatchCommand        `cmd:"patch" help:"Patch a key."`
+	PutBlob      PutBlobCommand      `cmd:"put-blob" help:"Put a blob, read from stdin."`
+	GetBlob      GetBlobCommand      `cmd:"get-blob" help:"Get a blob, written to stdout."`
+	RotateKeys   RotateKeysCommand   `cmd:"rotate-keys" help:"Re-encrypt values that are encrypted with a key other than the current key."`
+
+	CreateSearchIndex CreateSearchIndexCommand `cmd:"create-search-index" help:"Create a full-text search index over values of keys with a given prefix."`
+	DropSearchIndex   DropSearchIndexCommand   `cmd:"drop-search-index" help:"Drop a full-text search index."`
+	RegisterSchema    RegisterSchemaCommand    `cmd:"register-schema" help:"Register a JSON Schema that values of keys with a given prefix must match."`
+	ListSchemas       ListSchemasCommand       `cmd:"list-schemas" help:"List the registered JSON Schemas."`
+	DeleteSchema      DeleteSchemaCommand      `cmd:"delete-schema" help:"Delete a JSON Schema."`
+	TestSchema        TestSchemaCommand        `cmd:"test-schema" help:"Test whether a value would be valid for a key, without storing it."`
 
 	BenchmarkGet   BenchmarkGetCommand   `cmd:"benchmark-get" help:"Benchmark getting records."`
 	BenchmarkPut   BenchmarkPutCommand   `cmd:"benchmark-put" help:"Benchmark putting records."`
 	BenchmarkPatch BenchmarkPatchCommand `cmd:"benchmark-patch" help:"Benchmark patching records."`
 }
 
+// deprecatedFlags are the flags that shouldn't be set on the command line, where they're saved in shell
+// history, and the alternatives to use instead.
+var deprecatedFlags = map[string]string{
+	"password":        "KV_PASSWORD or --password-file",
+	"encryption-keys": "KV_ENCRYPTION_KEYS or --encryption-keys-file",
+}
+
+// AfterApply warns when deprecated flags are set on the command line, rather than by environment variables or a profile.
+func (c *CLI) AfterApply(kctx *kong.Context) error {
+	for _, p := range kctx.Path {
+		if p.Flag == nil || p.Resolved {
+			continue
+		}
+		if instead, ok := deprecatedFlags[p.Flag.Name]; ok {
+			fmt.Fprintf(kctx.Stderr, "warning: --%s is deprecated, use %s instead\n", p.Flag.Name, instead)
+		}
+	}
+	return nil
+}
+
 func main() {
 	var cli CLI
 	ctx := context.Background()
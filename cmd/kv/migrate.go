@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type MigrateCommand struct {
+	DryRun bool `help:"Show the migrations that would be applied, without applying them."`
+}
+
+func (c *MigrateCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	if c.DryRun {
+		pending, err := store.PendingMigrations(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get pending migrations: %w", err)
+		}
+		if len(pending) == 0 {
+			fmt.Println("No pending migrations")
+		}
+		for _, m := range pending {
+			fmt.Printf("-- %v\n%s\n\n", m, strings.Join(m.Statements, "\n\n"))
+		}
+		return nil
+	}
+
+	applied, err := store.Migrate(ctx)
+	for _, m := range applied {
+		fmt.Printf("Applied %v\n", m)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	if len(applied) == 0 {
+		fmt.Println("No pending migrations")
+	}
+	return nil
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 type PatchCommand struct {
 	Key     string `arg:"" help:"The key to patch in the KV store." required:""`
 	Version int64  `help:"The version of the key to patch, or -1 if no version check is required." default:"-1"`
+	Format  string `help:"The format of the patch, a JSON merge patch (RFC 7396) or a JSON patch (RFC 6902)." enum:"merge-patch,json-patch" default:"merge-patch"`
 }
 
 func (c *PatchCommand) Run(ctx context.Context, g GlobalFlags) error {
@@ -18,6 +21,14 @@ func (c *PatchCommand) Run(ctx context.Context, g GlobalFlags) error {
 		return fmt.Errorf("failed to create store: %w", err)
 	}
 
+	if c.Format == "json-patch" {
+		var ops []db.JSONPatchOperation
+		if err = json.NewDecoder(os.Stdin).Decode(&ops); err != nil {
+			return fmt.Errorf("failed to decode patch: %w", err)
+		}
+		return store.JSONPatch(ctx, c.Key, c.Version, ops)
+	}
+
 	var data map[string]any
 	err = json.NewDecoder(os.Stdin).Decode(&data)
 	if err != nil {
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/a-h/sqlitekv"
 )
 
 type PutCommand struct {
 	Key     string `arg:"" help:"Key name" required:""`
 	Version int64  `help:"The version of the key to overwrite, or -1 if no version check is required." default:"-1"`
+	Queued  bool   `help:"Add the write to the rqlite node's queue, and return before it's committed. The version isn't checked."`
 }
 
 func (c *PutCommand) Run(ctx context.Context, g GlobalFlags) error {
@@ -24,5 +27,8 @@ func (c *PutCommand) Run(ctx context.Context, g GlobalFlags) error {
 		return fmt.Errorf("failed to decode data: %w", err)
 	}
 
+	if c.Queued {
+		ctx = sqlitekv.WithRqliteWriteOptions(ctx, sqlitekv.RqliteWriteOptions{Queue: true})
+	}
 	return store.Put(ctx, c.Key, c.Version, data)
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// ScanFlags are the flags shared by commands that return multiple records.
+type ScanFlags struct {
+	Path    []string `help:"JSON paths of the fields to return, e.g. $.name. If not set, the whole value is returned."`
+	OrderBy string   `help:"Comma separated fields to order by, e.g. 'created desc', or '$.age desc, $.name'. Defaults to key." aliases:"sort"`
+	Reverse bool     `help:"Reverse the order of the results."`
+}
+
+func (f ScanFlags) Options() (opts []db.ScanOption, err error) {
+	if len(f.Path) > 0 {
+		opts = append(opts, db.WithFields(f.Path...))
+	}
+	if f.OrderBy != "" {
+		sort, err := db.ParseSort(f.OrderBy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --order-by: %w", err)
+		}
+		opts = append(opts, db.WithOrderBy(sort))
+	}
+	if f.Reverse {
+		opts = append(opts, db.WithReverse())
+	}
+	return opts, nil
+}
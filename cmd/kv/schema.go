@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/a-h/sqlitekv"
+)
+
+type RegisterSchemaCommand struct {
+	Prefix string `arg:"" help:"The prefix of the keys that the schema applies to. The schema is read from stdin." required:""`
+}
+
+func (c *RegisterSchemaCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	var schema json.RawMessage
+	if err = json.NewDecoder(os.Stdin).Decode(&schema); err != nil {
+		return fmt.Errorf("failed to decode schema: %w", err)
+	}
+
+	return store.RegisterSchema(ctx, c.Prefix, schema)
+}
+
+type ListSchemasCommand struct {
+}
+
+func (c *ListSchemasCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	schemas, err := store.Schemas(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list schemas: %w", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schemas)
+}
+
+type DeleteSchemaCommand struct {
+	Prefix string `arg:"" help:"The prefix of the schema to delete." required:""`
+}
+
+func (c *DeleteSchemaCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	return store.DeleteSchema(ctx, c.Prefix)
+}
+
+type TestSchemaCommand struct {
+	Key string `arg:"" help:"The key to validate the value for. The value is read from stdin." required:""`
+}
+
+func (c *TestSchemaCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	var data any
+	if err = json.NewDecoder(os.Stdin).Decode(&data); err != nil {
+		return fmt.Errorf("failed to decode data: %w", err)
+	}
+
+	err = store.ValidateValue(ctx, c.Key, data)
+	var ve *sqlitekv.ValidationError
+	if errors.As(err, &ve) {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(ve); err != nil {
+			return err
+		}
+		return fmt.Errorf("value is invalid")
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/a-h/sqlitekv"
+	"github.com/a-h/sqlitekv/db"
+)
+
+type SearchCommand struct {
+	Prefix string `arg:"" help:"The prefix to search within." required:""`
+	Query  string `arg:"" help:"The full-text search query, e.g. 'sqlite AND (search OR index)'." required:""`
+	Offset int    `arg:"-o,--offset" help:"Range offset." default:"0"`
+	Limit  int    `arg:"-l,--limit" help:"The maximum number of records to return, or -1 for no limit." default:"100"`
+}
+
+type searchResult struct {
+	Record  sqlitekv.RecordOf[map[string]any] `json:"record"`
+	Snippet string                            `json:"snippet"`
+	Rank    float64                           `json:"rank"`
+}
+
+func (c *SearchCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	results, err := store.Search(ctx, c.Prefix, c.Query, c.Offset, c.Limit)
+	if err != nil {
+		return fmt.Errorf("failed to search: %w", err)
+	}
+
+	output := make([]searchResult, len(results))
+	for i, r := range results {
+		records, err := sqlitekv.RecordsOf[map[string]any]([]db.Record{r.Record})
+		if err != nil {
+			return fmt.Errorf("failed to convert records: %w", err)
+		}
+		output[i] = searchResult{Record: records[0], Snippet: r.Snippet, Rank: r.Rank}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(output)
+}
+
+type CreateSearchIndexCommand struct {
+	Prefix string   `arg:"" help:"The prefix of the keys to index." required:""`
+	Paths  []string `arg:"" help:"The JSON paths of the values to index, e.g. '$.title'." required:""`
+}
+
+func (c *CreateSearchIndexCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	return store.CreateSearchIndex(ctx, c.Prefix, c.Paths...)
+}
+
+type DropSearchIndexCommand struct {
+	Prefix string `arg:"" help:"The prefix of the search index to drop." required:""`
+}
+
+func (c *DropSearchIndexCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	return store.DropSearchIndex(ctx, c.Prefix)
+}
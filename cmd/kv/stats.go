@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type StatsCommand struct {
+	Prefix string `arg:"" help:"The prefix of the keys to show stats for." default:""`
+}
+
+func (c *StatsCommand) Run(ctx context.Context, g GlobalFlags) error {
+	store, err := g.Store()
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	stats, err := store.Stats(ctx, c.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get stats: %w", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
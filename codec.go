@@ -0,0 +1,196 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/a-h/sqlitekv/db"
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes values.
+//
+// Values encoded by codecs with the JSON encoding are stored as jsonb, so they can be queried
+// with the SQLite JSON functions, filtered with Find, and patched. Values encoded by codecs with
+// other encodings are stored as blobs.
+type Codec interface {
+	// Encoding is the name of the encoding, which is stored with each value that isn't JSON, e.g. "protobuf".
+	Encoding() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes values using encoding/json. It's the default codec.
+type JSONCodec struct{}
+
+func (JSONCodec) Encoding() string                   { return db.EncodingJSON }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// JSONIterCodec encodes values using jsoniter, which is faster than encoding/json, but compatible with it.
+type JSONIterCodec struct{}
+
+var jsonIter = jsoniter.ConfigCompatibleWithStandardLibrary
+
+func (JSONIterCodec) Encoding() string                   { return db.EncodingJSON }
+func (JSONIterCodec) Marshal(v any) ([]byte, error)      { return jsonIter.Marshal(v) }
+func (JSONIterCodec) Unmarshal(data []byte, v any) error { return jsonIter.Unmarshal(data, v) }
+
+// ProtoJSONCodec encodes protobuf messages as JSON using protojson, so that they can be queried.
+// Values must implement proto.Message.
+type ProtoJSONCodec struct {
+	MarshalOptions   protojson.MarshalOptions
+	UnmarshalOptions protojson.UnmarshalOptions
+}
+
+func (ProtoJSONCodec) Encoding() string { return db.EncodingJSON }
+
+func (c ProtoJSONCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protojson: expected proto.Message, got %T", v)
+	}
+	return c.MarshalOptions.Marshal(m)
+}
+
+func (c ProtoJSONCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protojson: expected proto.Message, got %T", v)
+	}
+	return c.UnmarshalOptions.Unmarshal(data, m)
+}
+
+// ProtobufCodec encodes protobuf messages using the binary wire format. The values are stored as
+// blobs, so they can't be queried or patched. Values must implement proto.Message.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Encoding() string { return "protobuf" }
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: expected proto.Message, got %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: expected proto.Message, got %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// encode encodes the value using the codec.
+func encode(codec Codec, v any) (e db.Encoded, err error) {
+	e.Encoding = codec.Encoding()
+	e.Data, err = codec.Marshal(v)
+	return e, err
+}
+
+// decode decodes the value of the record into v, using the first codec with the same encoding as
+// the record. JSON values can always be decoded, using encoding/json if no JSON codec is provided.
+// If v is nil, the value isn't decoded.
+func decode(r db.Record, v any, codecs ...Codec) (err error) {
+	if v == nil {
+		return nil
+	}
+	if r.Encoding == db.EncodingJSONB {
+		if r.Value, err = r.JSON(); err != nil {
+			return err
+		}
+		r.Encoding = db.EncodingJSON
+	}
+	encoding := r.Encoding
+	if encoding == "" {
+		encoding = db.EncodingJSON
+	}
+	for _, c := range codecs {
+		if c != nil && c.Encoding() == encoding {
+			return c.Unmarshal(r.Value, v)
+		}
+	}
+	if encoding == db.EncodingJSON {
+		return json.Unmarshal(r.Value, v)
+	}
+	return fmt.Errorf("no codec for %q encoding of %q", encoding, r.Key)
+}
+
+// encodesValue returns true if the values of the key are compressed or encrypted before they're written.
+func (s *Store) encodesValue(key string) bool {
+	_, compressed := s.compressionFor(key)
+	return compressed || s.keys != nil
+}
+
+// encodeValue compresses and encrypts the value of the key, if the store is configured to.
+// Values that aren't already encoded are encoded as JSON.
+func (s *Store) encodeValue(ctx context.Context, key string, value any) (e db.Encoded, err error) {
+	e, ok := value.(db.Encoded)
+	if !ok {
+		if e.Data, err = json.Marshal(value); err != nil {
+			return e, err
+		}
+	}
+	if e.Encoding == "" {
+		e.Encoding = db.EncodingJSON
+	}
+	var fields []byte
+	if s.keys != nil && e.IsJSON() && len(s.plaintextFields) > 0 {
+		if fields, err = selectFields(e.Data, s.plaintextFields); err != nil {
+			return e, err
+		}
+	}
+	if rule, ok := s.compressionFor(key); ok && len(e.Data) >= rule.minSize {
+		if e.Data, err = rule.compressor.Compress(e.Data); err != nil {
+			return e, err
+		}
+		e.Encoding += "+" + rule.compressor.Name()
+	}
+	if s.keys != nil {
+		if e, err = s.encrypt(ctx, key, e); err != nil {
+			return e, err
+		}
+	}
+	e.Fields = fields
+	return e, nil
+}
+
+// decodeRecord decrypts and decompresses the value of the record, if required, and converts values
+// read as JSONB to JSON.
+func (s *Store) decodeRecord(ctx context.Context, r db.Record) (db.Record, error) {
+	r, err := s.decrypt(ctx, r)
+	if err != nil {
+		return r, err
+	}
+	if r.Encoding == db.EncodingJSONB {
+		if r.Value, err = r.JSON(); err != nil {
+			return r, fmt.Errorf("%q: %w", r.Key, err)
+		}
+		r.Encoding = db.EncodingJSON
+	}
+	if c, encoding, ok := s.compressorOf(r.Encoding); ok {
+		if r.Value, err = c.Decompress(r.Value); err != nil {
+			return r, fmt.Errorf("%q: %w", r.Key, err)
+		}
+		r.Encoding = encoding
+	}
+	if r.Encoding == db.EncodingJSON {
+		r.Encoding = ""
+	}
+	return r, nil
+}
+
+// decodeRecords decrypts and decompresses the values of the records in place.
+func (s *Store) decodeRecords(ctx context.Context, records []db.Record) (err error) {
+	for i := range records {
+		if records[i], err = s.decodeRecord(ctx, records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
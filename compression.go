@@ -0,0 +1,141 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses values before they're stored.
+//
+// Compressed values are stored as blobs, so they can't be queried with the SQLite JSON functions,
+// filtered with Find, aggregated, or indexed for search, unless they're also encrypted with
+// plaintext fields. Patches are applied to the decompressed value.
+type Compressor interface {
+	// Name is the name of the compression algorithm, which is added to the encoding of compressed values, e.g. "zstd".
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// ZstdCompressor compresses values with Zstandard.
+type ZstdCompressor struct{}
+
+// The zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll, so they're
+// shared. They start goroutines, so they're only created when they're first used.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) { return zstd.NewReader(nil) })
+)
+
+func (ZstdCompressor) Name() string { return "zstd" }
+
+func (ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	enc, err := zstdEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return enc.EncodeAll(data, nil), nil
+}
+
+func (ZstdCompressor) Decompress(data []byte) ([]byte, error) {
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return dec.DecodeAll(data, nil)
+}
+
+// GzipCompressor compresses values with gzip.
+type GzipCompressor struct {
+	// Level is the compression level, e.g. gzip.BestCompression. The default is gzip.DefaultCompression.
+	Level int
+}
+
+func (GzipCompressor) Name() string { return "gzip" }
+
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WithCompression compresses values of keys with the prefix that are at least minSize bytes long
+// once encoded. Use an empty prefix to compress the values of all keys. If prefixes overlap, the
+// longest prefix is used.
+//
+// Values are compressed before they're encrypted. JSON paths of compressed values can't be queried,
+// see Compressor.
+func WithCompression(prefix string, compressor Compressor, minSize int) StoreOption {
+	return func(s *Store) {
+		s.compression = append(s.compression, compressionRule{
+			prefix:     prefix,
+			compressor: compressor,
+			minSize:    minSize,
+		})
+	}
+}
+
+type compressionRule struct {
+	prefix     string
+	compressor Compressor
+	minSize    int
+}
+
+// compressionFor returns the compression rule with the longest prefix that matches the key.
+func (s *Store) compressionFor(key string) (rule compressionRule, ok bool) {
+	for _, r := range s.compression {
+		if strings.HasPrefix(key, r.prefix) && (!ok || len(r.prefix) > len(rule.prefix)) {
+			rule, ok = r, true
+		}
+	}
+	return rule, ok
+}
+
+// compressors returns the compressors that can decompress values: the built-in compressors, and
+// any compressors the store is configured with.
+func (s *Store) compressors() []Compressor {
+	compressors := []Compressor{ZstdCompressor{}, GzipCompressor{}}
+	for _, r := range s.compression {
+		compressors = append(compressors, r.compressor)
+	}
+	return compressors
+}
+
+// compressorOf returns the compressor used to compress values with the encoding, e.g. "json+zstd".
+func (s *Store) compressorOf(encoding string) (c Compressor, uncompressedEncoding string, ok bool) {
+	encoding = strings.TrimSuffix(encoding, encryptedEncodingSuffix)
+	for _, c := range s.compressors() {
+		if uncompressedEncoding, ok = strings.CutSuffix(encoding, "+"+c.Name()); ok {
+			return c, uncompressedEncoding, true
+		}
+	}
+	return nil, encoding, false
+}
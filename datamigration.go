@@ -0,0 +1,300 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// DefaultDataMigrationBatchSize is the default number of records that are migrated at a time by MigrateData.
+const DefaultDataMigrationBatchSize = 100
+
+// DataMigration changes the values of records with a prefix, e.g. to rename or split fields.
+type DataMigration struct {
+	// Name identifies the migration. The progress of the migration is checkpointed under its name,
+	// so if it's interrupted, running it again resumes where it stopped. Once it has completed,
+	// running it again does nothing.
+	Name string
+	// Prefix is the prefix of the keys of the records to migrate.
+	Prefix string
+	// BatchSize is the number of records that are migrated at a time. The default is DefaultDataMigrationBatchSize.
+	BatchSize int
+	// Migrate returns the new value of the record, which is encoded with the store's codec, or
+	// ok=false to leave the record unchanged. If an error is returned, the migration stops.
+	//
+	// If the record is changed by another writer before the new value is written, Migrate is called
+	// again with the changed record.
+	Migrate func(r db.Record) (value any, ok bool, err error)
+}
+
+// DataMigrationResult is the number of records processed by a data migration, including the records
+// processed by earlier runs of the migration with the same name.
+type DataMigrationResult struct {
+	Migrated int `json:"migrated"`
+	Skipped  int `json:"skipped"`
+	// Conflicted is the number of records that weren't migrated, because they were changed by another
+	// writer each time they were migrated.
+	Conflicted int `json:"conflicted"`
+	// ConflictedKeys are the keys of the conflicted records. They're migrated again by the next run of
+	// the migration, even if it has completed.
+	ConflictedKeys []string `json:"conflictedKeys,omitempty"`
+	Completed      bool     `json:"completed"`
+}
+
+// MigrateData applies the migration to each record with the prefix, in key order, a batch at a time.
+//
+// Each new value is written with PutPatches, pinned to the version that was read, so changes made by
+// other writers aren't overwritten. The values are validated against JSON Schemas, and compressed
+// and encrypted, in the same way as Put.
+//
+// Progress is checkpointed in the same call to Mutate as the writes of each batch, so if the migration
+// is interrupted, running it again resumes after the last batch that was written, and records aren't
+// counted twice. Records that were changed by another writer each time they were migrated are
+// migrated again by the next run.
+func (s *Store) MigrateData(ctx context.Context, m DataMigration) (result DataMigrationResult, err error) {
+	if m.Name == "" {
+		return result, errors.New("migratedata: name is required")
+	}
+	if m.Migrate == nil {
+		return result, errors.New("migratedata: migrate function is required")
+	}
+	batchSize := m.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultDataMigrationBatchSize
+	}
+	checkpoint, ok, err := s.dataMigrationCheckpoint(ctx, m.Name)
+	if err != nil {
+		return result, fmt.Errorf("migratedata: %w", err)
+	}
+	if ok && checkpoint.Prefix != m.Prefix {
+		return result, fmt.Errorf("migratedata: %q was started with prefix %q", m.Name, checkpoint.Prefix)
+	}
+	checkpoint.Name, checkpoint.Prefix = m.Name, m.Prefix
+
+	// Migrate the records that conflicted in earlier runs.
+	if len(checkpoint.ConflictedKeys) > 0 {
+		records, err := s.getDataMigrationRecords(ctx, checkpoint.ConflictedKeys)
+		if err != nil {
+			return newDataMigrationResult(checkpoint), fmt.Errorf("migratedata: %w", err)
+		}
+		if err = s.migrateBatch(ctx, m, checkpoint.ConflictedKeys, records, &checkpoint); err != nil {
+			return newDataMigrationResult(checkpoint), fmt.Errorf("migratedata: %w", err)
+		}
+	}
+	for !checkpoint.Completed {
+		outputs, err := s.db.Query(ctx, db.GetPrefixAfter(m.Prefix, checkpoint.LastKey, batchSize))
+		if err != nil {
+			return newDataMigrationResult(checkpoint), fmt.Errorf("migratedata: %w", err)
+		}
+		records := outputs[0]
+		if len(records) == 0 {
+			checkpoint.Completed = true
+			if _, err = s.db.Mutate(ctx, db.PutDataMigrationCheckpoint(checkpoint)); err != nil {
+				return newDataMigrationResult(checkpoint), fmt.Errorf("migratedata: %w", err)
+			}
+			break
+		}
+		keys := make([]string, len(records))
+		for i, r := range records {
+			keys[i] = r.Key
+		}
+		if err = s.migrateBatch(ctx, m, keys, records, &checkpoint); err != nil {
+			return newDataMigrationResult(checkpoint), fmt.Errorf("migratedata: %w", err)
+		}
+	}
+	return newDataMigrationResult(checkpoint), nil
+}
+
+// migrateBatch migrates the records with the keys, which are the records that exist, and updates the
+// checkpoint. Records that are changed by another writer are read again, and migrated again, up to
+// maxResolvedWriteAttempts times, and are then left in the checkpoint's conflicted keys.
+//
+// The checkpoint is written in the same call to Mutate as the new values. The keys that are written
+// are added to the conflicted keys, and each write that changes its record removes its key, and
+// counts it as migrated, so the checkpoint matches the writes that were made.
+func (s *Store) migrateBatch(ctx context.Context, m DataMigration, keys []string, records []db.Record, checkpoint *db.DataMigrationCheckpoint) (err error) {
+	next := *checkpoint
+	if last := keys[len(keys)-1]; last > next.LastKey {
+		next.LastKey = last
+	}
+	conflicted := slices.Clone(next.ConflictedKeys)
+	// Records that have been deleted are skipped.
+	found := make(map[string]bool, len(records))
+	for _, r := range records {
+		found[r.Key] = true
+	}
+	for _, key := range keys {
+		if !found[key] {
+			next.Skipped++
+			conflicted = slices.DeleteFunc(conflicted, func(k string) bool { return k == key })
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		var written []string
+		mutations := []db.Mutation{{}}
+		for _, r := range records {
+			if r, err = s.decodeRecord(ctx, r); err != nil {
+				return err
+			}
+			value, ok, err := m.Migrate(r)
+			if err != nil {
+				return fmt.Errorf("%q: %w", r.Key, err)
+			}
+			if !ok {
+				next.Skipped++
+				conflicted = slices.DeleteFunc(conflicted, func(k string) bool { return k == r.Key })
+				continue
+			}
+			encoded, err := encode(s.codec, value)
+			if err != nil {
+				return fmt.Errorf("%q: %w", r.Key, err)
+			}
+			written = append(written, r.Key)
+			if !slices.Contains(conflicted, r.Key) {
+				conflicted = append(conflicted, r.Key)
+			}
+			mutations = append(mutations,
+				db.PutPatches(db.PutInput(r.Key, r.Version, encoded)),
+				db.CountDataMigrationWrite(m.Name, r.Key),
+			)
+		}
+		next.ConflictedKeys = conflicted
+		mutations[0] = db.PutDataMigrationCheckpoint(next)
+		var conflicts []string
+		if _, err = s.mutate(ctx, mutations...); err != nil {
+			var be *BatchError
+			if !errors.As(err, &be) {
+				return err
+			}
+			for i, err := range be.Errors {
+				if err == nil {
+					continue
+				}
+				// The mutations are the checkpoint, followed by each write and its count.
+				if i%2 == 0 || !errors.Is(err, db.ErrVersionMismatch) {
+					return err
+				}
+				conflicts = append(conflicts, written[(i-1)/2])
+			}
+		}
+		next.Migrated += len(written) - len(conflicts)
+		conflicted = slices.DeleteFunc(conflicted, func(k string) bool {
+			return slices.Contains(written, k) && !slices.Contains(conflicts, k)
+		})
+		next.ConflictedKeys = conflicted
+		*checkpoint = next
+		if len(conflicts) == 0 || attempt == maxResolvedWriteAttempts {
+			return nil
+		}
+		// Read the records again, and skip the records that have been deleted.
+		if records, err = s.getDataMigrationRecords(ctx, conflicts); err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(records))
+		for _, r := range records {
+			found[r.Key] = true
+		}
+		for _, key := range conflicts {
+			if !found[key] {
+				next.Skipped++
+				conflicted = slices.DeleteFunc(conflicted, func(k string) bool { return k == key })
+			}
+		}
+	}
+}
+
+func (s *Store) getDataMigrationRecords(ctx context.Context, keys []string) (records []db.Record, err error) {
+	q, err := db.GetKeys(keys...)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := s.db.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return outputs[0], nil
+}
+
+func (s *Store) dataMigrationCheckpoint(ctx context.Context, name string) (c db.DataMigrationCheckpoint, ok bool, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.GetDataMigrationCheckpoint(name))
+	if err != nil {
+		return c, false, err
+	}
+	type row struct {
+		Name           string `json:"name"`
+		Prefix         string `json:"prefix"`
+		LastKey        string `json:"last_key"`
+		Migrated       int    `json:"migrated"`
+		Skipped        int    `json:"skipped"`
+		Conflicted     int    `json:"conflicted"`
+		ConflictedKeys string `json:"conflicted_keys"`
+		Completed      int    `json:"completed"`
+	}
+	rows, err := RowsOf[row](outputs[0])
+	if err != nil || len(rows) == 0 {
+		return c, false, err
+	}
+	r := rows[0]
+	var conflictedKeys []string
+	if err = json.Unmarshal([]byte(r.ConflictedKeys), &conflictedKeys); err != nil {
+		return c, false, fmt.Errorf("invalid conflicted keys: %w", err)
+	}
+	return db.DataMigrationCheckpoint{
+		Name:           r.Name,
+		Prefix:         r.Prefix,
+		LastKey:        r.LastKey,
+		Migrated:       r.Migrated,
+		Skipped:        r.Skipped,
+		Conflicted:     r.Conflicted,
+		ConflictedKeys: conflictedKeys,
+		Completed:      r.Completed != 0,
+	}, true, nil
+}
+
+func newDataMigrationResult(c db.DataMigrationCheckpoint) DataMigrationResult {
+	if len(c.ConflictedKeys) == 0 {
+		c.ConflictedKeys = nil
+	}
+	return DataMigrationResult{
+		Migrated:       c.Migrated,
+		Skipped:        c.Skipped,
+		Conflicted:     len(c.ConflictedKeys),
+		ConflictedKeys: c.ConflictedKeys,
+		Completed:      c.Completed,
+	}
+}
+
+// ResetDataMigration deletes the progress of the data migration with the given name, so that the
+// next time it's run, it starts from the first record.
+func (s *Store) ResetDataMigration(ctx context.Context, name string) (err error) {
+	if _, err = s.db.Mutate(ctx, db.DeleteDataMigrationCheckpoint(name)); err != nil {
+		return fmt.Errorf("resetdatamigration: %w", err)
+	}
+	return nil
+}
+
+// MigrateValues migrates the values of records with the prefix from type T to type U, using the
+// store's codec. The function returns ok=false to leave a value unchanged, e.g. if it has already
+// been migrated. See Store.MigrateData for how the migration is run.
+//
+//	result, err := sqlitekv.MigrateValues(ctx, store, "split-name", "person/", func(key string, p PersonV1) (PersonV2, bool, error) {
+//		first, last, _ := strings.Cut(p.Name, " ")
+//		return PersonV2{FirstName: first, LastName: last}, p.Name != "", nil
+//	})
+func MigrateValues[T, U any](ctx context.Context, s *Store, name, prefix string, f func(key string, from T) (to U, ok bool, err error)) (DataMigrationResult, error) {
+	return s.MigrateData(ctx, DataMigration{
+		Name:   name,
+		Prefix: prefix,
+		Migrate: func(r db.Record) (value any, ok bool, err error) {
+			var from T
+			if err = decode(r, &from, s.codec); err != nil {
+				return nil, false, err
+			}
+			return f(r.Key, from)
+		},
+	})
+}
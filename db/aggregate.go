@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AggregateFunc is a function used to aggregate values.
+type AggregateFunc string
+
+const (
+	AggregateCount AggregateFunc = "count"
+	AggregateSum   AggregateFunc = "sum"
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateAvg   AggregateFunc = "avg"
+)
+
+// Aggregation is an aggregate function applied to the values at a JSON path.
+type Aggregation struct {
+	Func AggregateFunc
+	// Path is the JSON path of the field to aggregate, e.g. "$.age".
+	// If the Func is AggregateCount and the path is empty, all records are counted.
+	Path string
+}
+
+// Aggregate aggregates the values of records with a given prefix, optionally grouped by the value at a JSON path.
+//
+// The first column is the JSON value of the group (or null if groupByPath is empty), and the following
+// columns are the results of each aggregation, in order.
+func Aggregate(prefix, groupByPath string, aggregations ...Aggregation) (q Query, err error) {
+	args := map[string]any{
+		":prefix": prefix + "%",
+	}
+	var sb strings.Builder
+	sb.WriteString("select ")
+	if groupByPath != "" {
+		args[":group"] = jsonPath(groupByPath)
+		sb.WriteString("value -> :group")
+	} else {
+		sb.WriteString("null")
+	}
+	sb.WriteString(" as grp")
+	for i, a := range aggregations {
+		name := fmt.Sprintf(":aggregate_%d", i)
+		var expr string
+		switch a.Func {
+		case AggregateCount:
+			if a.Path == "" {
+				expr = "count(*)"
+				break
+			}
+			expr = "count(value ->> " + name + ")"
+		case AggregateSum:
+			// total is used instead of sum, because it always returns a float, and returns 0.0 instead of null if there are no values.
+			expr = "total(value ->> " + name + ")"
+		case AggregateMin, AggregateMax, AggregateAvg:
+			expr = string(a.Func) + "(value ->> " + name + ")"
+		default:
+			return q, fmt.Errorf("aggregate: unknown function %q", a.Func)
+		}
+		if a.Func != AggregateCount && a.Path == "" {
+			return q, fmt.Errorf("aggregate: %s requires a path", a.Func)
+		}
+		if a.Path != "" {
+			args[name] = jsonPath(a.Path)
+		}
+		fmt.Fprintf(&sb, ", %s as %s", expr, strings.TrimPrefix(name, ":"))
+	}
+	sb.WriteString(" from kv where key like :prefix")
+	if groupByPath != "" {
+		// Order by the SQL value rather than the JSON text, so that numbers are ordered numerically.
+		sb.WriteString(" group by grp order by min(value ->> :group)")
+	}
+	sb.WriteString(";")
+	return Query{SQL: sb.String(), Args: args}, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+// PutBlobChunk stores a chunk of a blob. The chunks are not visible until PutBlob is used to
+// store the metadata of the blob.
+func PutBlobChunk(id, key string, chunk int, data []byte) Mutation {
+	return Mutation{
+		SQL: `insert into kv_blob (id, key, chunk, data) values (:id, :key, :chunk, :data);`,
+		Args: map[string]any{
+			":id":    id,
+			":key":   key,
+			":chunk": chunk,
+			":data":  data,
+		},
+	}
+}
+
+// PutBlob stores the metadata of a blob as the value of the key, if all of the blob's chunks
+// have been stored. The version check is the same as Put.
+//
+// The metadata must be a JSON object that contains the id of the blob's chunks in its id field.
+func PutBlob(key string, version int64, id string, chunks int, metadata []byte) Mutation {
+	return Mutation{
+		SQL: `insert into kv (key, version, value, data, encoding, created)
+select :key, 1, jsonb(:value), null, null, :now
+where (select count(*) from kv_blob where id = :id and key = :key) = :chunks
+on conflict(key) do update
+set version = kv.version + 1,
+    value = excluded.value,
+    data = null,
+    encoding = null,
+    key_id = null
+where (:version = -1 or kv.version = :version) and (:version <> 0);`,
+		Args: map[string]any{
+			":key":     key,
+			":version": version,
+			":id":      id,
+			":chunks":  chunks,
+			":value":   string(metadata),
+			":now":     now(),
+		},
+		MustAffectRows: true,
+	}
+}
+
+// DeleteBlobChunks deletes the chunks of a blob, unless the blob is the current value of the key,
+// e.g. the chunks of a blob that failed to be stored. Chunks of other blobs written to the same key
+// are kept.
+func DeleteBlobChunks(key, id string) Mutation {
+	return Mutation{
+		SQL: `delete from kv_blob where id = :id and key = :key and :id is not (select value ->> '$.id' from kv where key = :key);`,
+		Args: map[string]any{
+			":key": key,
+			":id":  id,
+		},
+	}
+}
+
+// GetBlobChunk gets a chunk of a blob. The data column is a blob.
+func GetBlobChunk(id string, chunk int) Query {
+	return Query{
+		SQL: `select data from kv_blob where id = :id and chunk = :chunk;`,
+		Args: map[string]any{
+			":id":    id,
+			":chunk": chunk,
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import "encoding/json"
+
+// GetPrefixAfter gets up to limit records with the prefix that have keys after the given key, in
+// key order. Pass an empty key to start from the first record.
+func GetPrefixAfter(prefix, after string, limit int) Query {
+	return Query{
+		SQL: `select key, version, coalesce(data, json(value)) as value, encoding, created from kv where key like :prefix and key > :after order by key limit :limit;`,
+		Args: map[string]any{
+			":prefix": prefix + "%",
+			":after":  after,
+			":limit":  limit,
+		},
+	}
+}
+
+// DataMigrationCheckpoint is the progress of a data migration.
+type DataMigrationCheckpoint struct {
+	Name       string
+	Prefix     string
+	LastKey    string
+	Migrated   int
+	Skipped    int
+	Conflicted int
+	// ConflictedKeys are the keys of the records that weren't migrated, because they were changed by
+	// another writer, and are migrated again by the next run.
+	ConflictedKeys []string
+	Completed      bool
+}
+
+// GetDataMigrationCheckpoint gets the checkpoint of the data migration with the given name.
+// The completed column is 1 if the migration has completed, and 0 if it hasn't.
+func GetDataMigrationCheckpoint(name string) Query {
+	return Query{
+		SQL: `select name, prefix, last_key, migrated, skipped, conflicted, conflicted_keys, completed from kv_data_migration where name = :name;`,
+		Args: map[string]any{
+			":name": name,
+		},
+	}
+}
+
+// PutDataMigrationCheckpoint creates, or replaces, the checkpoint of a data migration. The conflicted
+// count is set to the number of conflicted keys.
+func PutDataMigrationCheckpoint(c DataMigrationCheckpoint) Mutation {
+	var completed int
+	if c.Completed {
+		completed = 1
+	}
+	conflictedKeys, err := json.Marshal(append([]string{}, c.ConflictedKeys...))
+	if err != nil {
+		return Mutation{
+			ArgsError: err,
+		}
+	}
+	return Mutation{
+		SQL: `insert into kv_data_migration (name, prefix, last_key, migrated, skipped, conflicted, conflicted_keys, completed, updated)
+values (:name, :prefix, :last_key, :migrated, :skipped, :conflicted, :conflicted_keys, :completed, :now)
+on conflict(name) do update
+set prefix = excluded.prefix,
+    last_key = excluded.last_key,
+    migrated = excluded.migrated,
+    skipped = excluded.skipped,
+    conflicted = excluded.conflicted,
+    conflicted_keys = excluded.conflicted_keys,
+    completed = excluded.completed,
+    updated = excluded.updated;`,
+		Args: map[string]any{
+			":name":            c.Name,
+			":prefix":          c.Prefix,
+			":last_key":        c.LastKey,
+			":migrated":        c.Migrated,
+			":skipped":         c.Skipped,
+			":conflicted":      len(c.ConflictedKeys),
+			":conflicted_keys": string(conflictedKeys),
+			":completed":       completed,
+			":now":             now(),
+		},
+	}
+}
+
+// CountDataMigrationWrite counts the write of the migrated value of the key in the checkpoint of the
+// data migration, if the write changed the record. It must directly follow the write in the same
+// call to Mutate, because it uses the number of rows changed by the previous statement.
+//
+// The key is expected to be in the checkpoint's conflicted keys until it's written, so that if the
+// write conflicts with another writer, the key is migrated again.
+func CountDataMigrationWrite(name, key string) Mutation {
+	return Mutation{
+		SQL: `update kv_data_migration
+set migrated = migrated + 1,
+    conflicted = conflicted - 1,
+    conflicted_keys = (select json_group_array(value) from json_each(kv_data_migration.conflicted_keys) where value <> :key)
+where name = :name and changes() > 0;`,
+		Args: map[string]any{
+			":name": name,
+			":key":  key,
+		},
+	}
+}
+
+// DeleteDataMigrationCheckpoint deletes the checkpoint of a data migration, so that it runs from the start next time.
+func DeleteDataMigrationCheckpoint(name string) Mutation {
+	return Mutation{
+		SQL: `delete from kv_data_migration where name = :name;`,
+		Args: map[string]any{
+			":name": name,
+		},
+	}
+}
@@ -2,22 +2,83 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 )
 
 // Record is the record stored in the store prior to being unmarshaled.
 type Record struct {
-	Key     string    `json:"key"`
-	Version int64     `json:"version"`
-	Value   []byte    `json:"value"`
-	Created time.Time `json:"created"`
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+	Value   []byte `json:"value"`
+	// Encoding is the encoding of the value, or empty if the value is JSON.
+	Encoding string    `json:"encoding,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// EncodingJSON is the encoding of JSON values.
+const EncodingJSON = "json"
+
+// JSON returns the value of the record as JSON, converting it if it was read as JSONB.
+// It returns an error if the value isn't JSON, e.g. if it's compressed or encrypted.
+func (r Record) JSON() ([]byte, error) {
+	switch r.Encoding {
+	case "", EncodingJSON:
+		return r.Value, nil
+	case EncodingJSONB:
+		return JSONBToJSON(r.Value)
+	}
+	return nil, fmt.Errorf("%q: value has the %q encoding, not JSON", r.Key, r.Encoding)
+}
+
+// UnmarshalValue unmarshals the JSON value of the record into v. Records returned by queries aren't
+// unmarshaled until it's called, so records that are only used for their keys and versions aren't
+// unmarshaled at all.
+func (r Record) UnmarshalValue(v any) error {
+	data, err := r.JSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Encoded is a value that has already been encoded, e.g. by a codec.
+//
+// Values with the JSON encoding are stored as jsonb, so that they can be queried with the
+// SQLite JSON functions. Values with other encodings are stored as blobs.
+type Encoded struct {
+	Encoding string
+	Data     []byte
+	// KeyID is the ID of the key used to encrypt the data, if it's encrypted.
+	KeyID string
+	// Fields is an optional JSON object stored as jsonb alongside values that aren't JSON, so that
+	// selected fields of encrypted values can still be queried, filtered and sorted.
+	Fields []byte
+}
+
+// IsJSON returns true if the value is JSON.
+func (e Encoded) IsJSON() bool {
+	return e.Encoding == "" || e.Encoding == EncodingJSON
+}
+
+// Rows are the results of a query that can return any columns.
+type Rows struct {
+	Columns []string
+	Values  [][]any
 }
 
 type DB interface {
 	// Query runs queries against the store. The query should return rows, and the rows are returned as-is.
 	Query(ctx context.Context, queries ...Query) (output [][]Record, err error)
-	// Mutate runs mutations against the store.
+	// QueryRows runs queries against the store. Unlike Query, the queries can return any columns.
+	//
+	// Values are returned as int64, float64, string, []byte or nil. Implementations that can't
+	// distinguish between integers and floats in computed columns return whole numbers as int64.
+	QueryRows(ctx context.Context, queries ...Query) (output []Rows, err error)
+	// Mutate runs mutations against the store, in a transaction. If a mutation fails, the transaction
+	// is rolled back, so every mutation affects no rows and has an error.
 	Mutate(ctx context.Context, mutations ...Mutation) (rowsAffected []int64, err error)
 	QueryScalarInt64(ctx context.Context, query string, args map[string]any) (n int64, err error)
 }
@@ -25,6 +86,8 @@ type DB interface {
 type Query struct {
 	SQL  string
 	Args map[string]any
+	// If the arguments are invalid, e.g. the field paths of WithFields, the ArgsError is set.
+	ArgsError error
 }
 
 type Mutation struct {
@@ -33,6 +96,28 @@ type Mutation struct {
 	// If the value can't be marshalled, the ArgsError is set.
 	ArgsError      error
 	MustAffectRows bool
+	// Writes are the puts and patches made by the mutation, so that they can be validated before
+	// the mutation is run. It's populated by Put, Patch and PutPatches.
+	Writes []PutPatchInput
 }
 
 var ErrVersionMismatch = errors.New("version mismatch")
+
+// Errors returned by databases, classified from the underlying database's error codes.
+// Use errors.Is to check for them.
+var (
+	// ErrBusy is returned when the database is locked by another connection.
+	ErrBusy = errors.New("database is busy")
+	// ErrLocked is returned when a table is locked by another statement or connection.
+	ErrLocked = errors.New("database table is locked")
+	// ErrConstraint is returned when a statement violates a constraint, e.g. a unique index.
+	ErrConstraint = errors.New("constraint failed")
+	// ErrReadOnly is returned when a write is made to a read-only database.
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrFull is returned when the disk or database is full.
+	ErrFull = errors.New("database is full")
+	// ErrCorrupt is returned when the database file is malformed, or isn't a database.
+	ErrCorrupt = errors.New("database is corrupt")
+	// ErrInterrupted is returned when a statement is interrupted, e.g. because its context was cancelled.
+	ErrInterrupted = errors.New("interrupted")
+)
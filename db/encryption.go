@@ -0,0 +1,14 @@
+package db
+
+// GetPrefixEncryptedWithOtherKeys gets up to limit records with the given prefix whose values are
+// encrypted with a key other than keyID, in key order. It's used to find records whose keys need rotating.
+func GetPrefixEncryptedWithOtherKeys(prefix, keyID string, limit int) Query {
+	return Query{
+		SQL: `select key, version, coalesce(data, json(value)) as value, encoding, created from kv where key like :prefix and key_id is not null and key_id <> :key_id order by key limit :limit;`,
+		Args: map[string]any{
+			":prefix": prefix + "%",
+			":key_id": keyID,
+			":limit":  limit,
+		},
+	}
+}
@@ -0,0 +1,555 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a parsed filter expression, see ParseFilter.
+// The zero value matches all records.
+type Filter struct {
+	root filterNode
+}
+
+// ParseFilter parses a filter expression, e.g. `name == "Alice" && age > 30 && tags contains "x"`.
+//
+// Fields are JSON paths within the value, e.g. `name`, `address.city`, `phone_numbers[0]` or `$.name`,
+// except for `key`, `version` and `created`, which refer to the record itself. Use `$.key` to refer
+// to a field called "key" within the value.
+//
+// Comparisons use the ==, !=, <, <=, > and >= operators against string, number, true, false and null
+// literals. The contains operator checks whether an array contains a value, or whether a string
+// contains a substring. Comparisons can be combined with &&, || and !, and grouped with parentheses.
+//
+// An empty expression matches all records.
+func ParseFilter(expr string) (f Filter, err error) {
+	p, err := newParser(expr)
+	if err != nil {
+		return f, fmt.Errorf("filter: %w", err)
+	}
+	if p.peek().kind == tokenEOF {
+		return f, nil
+	}
+	f.root, err = p.parseOr()
+	if err != nil {
+		return f, fmt.Errorf("filter: %w", err)
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return f, fmt.Errorf("filter: unexpected %q at position %d", t.text, t.pos)
+	}
+	return f, nil
+}
+
+// Sort is the order in which records are returned.
+// Records are always sorted by key after the given fields, so that the order is stable.
+type Sort []SortField
+
+// SortField is a field to sort records by.
+type SortField struct {
+	// Field is "key", "version", "created", or a JSON path within the value, e.g. "$.name".
+	Field string
+	// Desc sorts in descending order.
+	Desc bool
+}
+
+// ParseSort parses a comma separated list of fields to sort by, each optionally followed by asc or desc,
+// e.g. `created desc, name`. Fields use the same syntax as ParseFilter.
+//
+// An empty expression sorts by key.
+func ParseSort(expr string) (s Sort, err error) {
+	p, err := newParser(expr)
+	if err != nil {
+		return nil, fmt.Errorf("sort: %w", err)
+	}
+	if p.peek().kind == tokenEOF {
+		return nil, nil
+	}
+	for {
+		f, err := p.parseField()
+		if err != nil {
+			return nil, fmt.Errorf("sort: %w", err)
+		}
+		sf := SortField{Field: f.String()}
+		if t := p.peek(); t.kind == tokenIdent && (t.text == "asc" || t.text == "desc") {
+			p.next()
+			sf.Desc = t.text == "desc"
+		}
+		s = append(s, sf)
+		t := p.next()
+		if t.kind == tokenEOF {
+			return s, nil
+		}
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("sort: unexpected %q at position %d", t.text, t.pos)
+		}
+	}
+}
+
+func (s Sort) hasKey() bool {
+	for _, sf := range s {
+		if newField(sf.Field).column == "key" {
+			return true
+		}
+	}
+	return false
+}
+
+// sql returns the order by clause for the sort, and adds any required arguments to args.
+func (s Sort) sql(args map[string]any) string {
+	var sb strings.Builder
+	for i, sf := range s {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(newField(sf.Field).sql(args, fmt.Sprintf(":sort_%d", i)))
+		if sf.Desc {
+			sb.WriteString(" desc")
+		}
+	}
+	if !s.hasKey() {
+		if len(s) > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("key")
+	}
+	return sb.String()
+}
+
+// Find finds records with a given prefix that match the filter, in the order given by sort.
+func Find(prefix string, filter Filter, sort Sort, offset, limit int, opts ...ScanOption) Query {
+	o := newScanOptions(append([]ScanOption{WithOrderBy(sort)}, opts...))
+	args := map[string]any{
+		":prefix": prefix + "%",
+		":limit":  limit,
+		":offset": offset,
+	}
+	where := "true"
+	if filter.root != nil {
+		c := &filterCompiler{args: args}
+		where = filter.root.sql(c)
+	}
+	return Query{
+		SQL:       `select key, version, ` + o.valueColumns(args) + `, created from kv where key like :prefix and (` + where + `) order by ` + o.orderBy(args) + ` limit :limit offset :offset;`,
+		Args:      args,
+		ArgsError: o.fieldsError(),
+	}
+}
+
+// field is either a column of the kv table, or a JSON path within the value.
+type field struct {
+	column string
+	path   string
+}
+
+var columns = map[string]bool{
+	"key":     true,
+	"version": true,
+	"created": true,
+}
+
+func newField(s string) field {
+	if columns[s] {
+		return field{column: s}
+	}
+	return field{path: jsonPath(s)}
+}
+
+func (f field) String() string {
+	if f.column != "" {
+		return f.column
+	}
+	return f.path
+}
+
+// sql returns the SQL expression for the field, using the named argument for the JSON path.
+func (f field) sql(args map[string]any, name string) string {
+	if f.column != "" {
+		return f.column
+	}
+	args[name] = f.path
+	return "value ->> " + name
+}
+
+type filterCompiler struct {
+	args map[string]any
+	n    int
+}
+
+func (c *filterCompiler) arg(v any) (name string) {
+	name = fmt.Sprintf(":filter_%d", c.n)
+	c.n++
+	c.args[name] = v
+	return name
+}
+
+func (c *filterCompiler) field(f field) string {
+	if f.column != "" {
+		return f.column
+	}
+	return "value ->> " + c.arg(f.path)
+}
+
+type filterNode interface {
+	sql(c *filterCompiler) string
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n andNode) sql(c *filterCompiler) string {
+	return "(" + n.left.sql(c) + " and " + n.right.sql(c) + ")"
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n orNode) sql(c *filterCompiler) string {
+	return "(" + n.left.sql(c) + " or " + n.right.sql(c) + ")"
+}
+
+type notNode struct {
+	expr filterNode
+}
+
+func (n notNode) sql(c *filterCompiler) string {
+	return "not " + n.expr.sql(c)
+}
+
+type comparisonNode struct {
+	field field
+	op    string
+	value any
+}
+
+func (n comparisonNode) sql(c *filterCompiler) string {
+	if n.op == "contains" {
+		return n.containsSQL(c)
+	}
+	if n.value == nil {
+		if n.op == "==" {
+			return "(" + c.field(n.field) + " is null)"
+		}
+		return "(" + c.field(n.field) + " is not null)"
+	}
+	if b, isBool := n.value.(bool); isBool {
+		if n.field.column != "" {
+			return "(" + n.field.column + " " + sqlOperators[n.op] + " " + c.arg(boolToInt(b)) + ")"
+		}
+		// The ->> operator returns JSON true and false as 1 and 0, so compare the JSON text instead.
+		return "(value -> " + c.arg(n.field.path) + " " + sqlOperators[n.op] + " " + c.arg(strconv.FormatBool(b)) + ")"
+	}
+	return "(" + c.field(n.field) + " " + sqlOperators[n.op] + " " + c.arg(n.value) + ")"
+}
+
+// containsSQL checks whether an array contains the value, or whether a string contains the value as a substring.
+func (n comparisonNode) containsSQL(c *filterCompiler) string {
+	v := n.value
+	if b, isBool := v.(bool); isBool {
+		v = boolToInt(b)
+	}
+	if n.field.column != "" {
+		return "(instr(" + n.field.column + ", " + c.arg(v) + ") > 0)"
+	}
+	path := c.arg(n.field.path)
+	match := "json_each.type = 'null'"
+	if v != nil {
+		match = "json_each.value = " + c.arg(v)
+	}
+	substring := "false"
+	if s, isString := v.(string); isString {
+		substring = "coalesce(instr(value ->> " + path + ", " + c.arg(s) + ") > 0, false)"
+	}
+	return "(case when json_type(value, " + path + ") = 'array' then exists (select 1 from json_each(kv.value, " + path + ") where " + match + ") else " + substring + " end)"
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var sqlOperators = map[string]string{
+	"==": "=",
+	"!=": "<>",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenDot
+	tokenDollar
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func newParser(expr string) (p *parser, err error) {
+	p = &parser{}
+	p.tokens, err = tokenize(expr)
+	return p, err
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (n filterNode, err error) {
+	if n, err = p.parseAnd(); err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokenOperator && t.text == "||"; t = p.peek() {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n = orNode{left: n, right: right}
+	}
+	return n, nil
+}
+
+func (p *parser) parseAnd() (n filterNode, err error) {
+	if n, err = p.parseNot(); err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokenOperator && t.text == "&&"; t = p.peek() {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		n = andNode{left: n, right: right}
+	}
+	return n, nil
+}
+
+func (p *parser) parseNot() (n filterNode, err error) {
+	if t := p.peek(); t.kind == tokenOperator && t.text == "!" {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (n filterNode, err error) {
+	if t := p.peek(); t.kind == tokenLParen {
+		p.next()
+		if n, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %q", t.pos, t.text)
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (n filterNode, err error) {
+	f, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	isComparison := op.kind == tokenOperator && sqlOperators[op.text] != ""
+	isContains := op.kind == tokenIdent && op.text == "contains"
+	if !isComparison && !isContains {
+		return nil, fmt.Errorf("expected operator at position %d, got %q", op.pos, op.text)
+	}
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	_, isBool := value.(bool)
+	if (isBool || value == nil) && op.text != "==" && op.text != "!=" && !isContains {
+		return nil, fmt.Errorf("operator %q at position %d can only be used with strings and numbers", op.text, op.pos)
+	}
+	return comparisonNode{field: f, op: op.text, value: value}, nil
+}
+
+func (p *parser) parseField() (f field, err error) {
+	t := p.next()
+	var sb strings.Builder
+	switch t.kind {
+	case tokenDollar:
+		sb.WriteString("$")
+	case tokenIdent:
+		if columns[t.text] {
+			return field{column: t.text}, nil
+		}
+		sb.WriteString("$.")
+		sb.WriteString(t.text)
+	default:
+		return f, fmt.Errorf("expected field at position %d, got %q", t.pos, t.text)
+	}
+	for {
+		switch p.peek().kind {
+		case tokenDot:
+			p.next()
+			name := p.next()
+			if name.kind != tokenIdent {
+				return f, fmt.Errorf("expected field name at position %d, got %q", name.pos, name.text)
+			}
+			sb.WriteString(".")
+			sb.WriteString(name.text)
+		case tokenLBracket:
+			p.next()
+			index := p.next()
+			if index.kind != tokenNumber {
+				return f, fmt.Errorf("expected array index at position %d, got %q", index.pos, index.text)
+			}
+			if _, err := strconv.ParseUint(index.text, 10, 64); err != nil {
+				return f, fmt.Errorf("invalid array index %q at position %d", index.text, index.pos)
+			}
+			if t := p.next(); t.kind != tokenRBracket {
+				return f, fmt.Errorf("expected ] at position %d, got %q", t.pos, t.text)
+			}
+			sb.WriteString("[")
+			sb.WriteString(index.text)
+			sb.WriteString("]")
+		default:
+			if sb.String() == "$" {
+				return f, fmt.Errorf("expected field name after $ at position %d", t.pos)
+			}
+			return field{path: sb.String()}, nil
+		}
+	}
+}
+
+func (p *parser) parseLiteral() (v any, err error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s at position %d", t.text, t.pos)
+		}
+		return s, nil
+	case tokenNumber:
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return f, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected string, number, true, false or null at position %d, got %q", t.pos, t.text)
+}
+
+func tokenize(expr string) (tokens []token, err error) {
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '"':
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: string(runes[start:i]), pos: start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			i++
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+		default:
+			kind, text := tokenOperator, string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					text = two
+				}
+			}
+			switch text {
+			case "(":
+				kind = tokenLParen
+			case ")":
+				kind = tokenRParen
+			case "[":
+				kind = tokenLBracket
+			case "]":
+				kind = tokenRBracket
+			case ".":
+				kind = tokenDot
+			case "$":
+				kind = tokenDollar
+			case ",":
+				kind = tokenComma
+			case "==", "!=", "<=", ">=", "&&", "||", "<", ">", "!":
+			default:
+				return nil, fmt.Errorf("unexpected %q at position %d", text, start)
+			}
+			i += len([]rune(text))
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(runes)}), nil
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// EncodingJSONB is the encoding of JSON values that are read in SQLite's binary JSONB format,
+// rather than converted to JSON text, see RawJSONB. Use JSONBToJSON, or Record.JSON, to convert them.
+const EncodingJSONB = "jsonb"
+
+// ErrInvalidJSONB is returned when a value isn't valid JSONB.
+var ErrInvalidJSONB = errors.New("invalid jsonb")
+
+// valueColumn is the column selected by the queries that return records. Values that aren't JSON
+// are stored in the data column, and JSON values are converted from JSONB to JSON text.
+const valueColumn = `coalesce(data, json(value)) as value`
+
+// RawJSONB returns the SQL of a query with the value column of the records selected as the JSONB
+// stored in the kv table, rather than converted to JSON text by SQLite. It only changes queries that
+// select the value as `coalesce(data, json(value)) as value`, as the queries of this package do.
+func RawJSONB(sql string) string {
+	return strings.ReplaceAll(sql, valueColumn, `coalesce(data, value) as value`)
+}
+
+// The element types of JSONB, see https://sqlite.org/jsonb.html.
+const (
+	jsonbNull = iota
+	jsonbTrue
+	jsonbFalse
+	jsonbInt
+	jsonbInt5
+	jsonbFloat
+	jsonbFloat5
+	jsonbText
+	jsonbTextJ
+	jsonbText5
+	jsonbTextRaw
+	jsonbArray
+	jsonbObject
+)
+
+// JSONBToJSON converts a value in SQLite's JSONB format to JSON text, in the same form as SQLite's
+// json function.
+func JSONBToJSON(jsonb []byte) ([]byte, error) {
+	out, n, err := appendJSONB(make([]byte, 0, len(jsonb)+len(jsonb)/4), jsonb)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(jsonb) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidJSONB, len(jsonb)-n)
+	}
+	return out, nil
+}
+
+// jsonbHeader returns the type of the element at the start of b, and the sizes of its header and payload.
+func jsonbHeader(b []byte) (typ byte, header, size int, err error) {
+	if len(b) == 0 {
+		return 0, 0, 0, fmt.Errorf("%w: unexpected end of value", ErrInvalidJSONB)
+	}
+	typ, header, size = b[0]&0x0f, 1, int(b[0]>>4)
+	if size > 11 {
+		// Sizes 12 to 15 mean the size is in the following 1, 2, 4 or 8 bytes, big-endian.
+		n := 1 << (size - 12)
+		if len(b) < 1+n {
+			return 0, 0, 0, fmt.Errorf("%w: unexpected end of header", ErrInvalidJSONB)
+		}
+		var s uint64
+		for _, c := range b[1 : 1+n] {
+			s = s<<8 | uint64(c)
+		}
+		header += n
+		if s > uint64(len(b)-header) {
+			return 0, 0, 0, fmt.Errorf("%w: unexpected end of value", ErrInvalidJSONB)
+		}
+		size = int(s)
+	}
+	if size > len(b)-header {
+		return 0, 0, 0, fmt.Errorf("%w: unexpected end of value", ErrInvalidJSONB)
+	}
+	return typ, header, size, nil
+}
+
+// appendJSONB appends the JSON text of the element at the start of b to out, and returns the number
+// of bytes of b that the element used.
+func appendJSONB(out, b []byte) ([]byte, int, error) {
+	typ, header, size, err := jsonbHeader(b)
+	if err != nil {
+		return out, 0, err
+	}
+	payload := b[header : header+size]
+	switch typ {
+	case jsonbNull:
+		out = append(out, "null"...)
+	case jsonbTrue:
+		out = append(out, "true"...)
+	case jsonbFalse:
+		out = append(out, "false"...)
+	case jsonbInt, jsonbFloat:
+		out = append(out, payload...)
+	case jsonbInt5:
+		n, ok := new(big.Int).SetString(string(payload), 0)
+		if !ok {
+			return out, 0, fmt.Errorf("%w: invalid integer %q", ErrInvalidJSONB, payload)
+		}
+		out = n.Append(out, 10)
+	case jsonbFloat5:
+		out = appendFloat5(out, string(payload))
+	case jsonbText, jsonbTextJ:
+		out = append(out, '"')
+		out = append(out, payload...)
+		out = append(out, '"')
+	case jsonbText5:
+		out = appendText5(out, payload)
+	case jsonbTextRaw:
+		out = appendQuoted(out, payload)
+	case jsonbArray, jsonbObject:
+		open, close := byte('['), byte(']')
+		if typ == jsonbObject {
+			open, close = '{', '}'
+		}
+		out = append(out, open)
+		var elements int
+		for i := 0; i < len(payload); elements++ {
+			if elements > 0 {
+				sep := byte(',')
+				if typ == jsonbObject && elements%2 == 1 {
+					sep = ':'
+				}
+				out = append(out, sep)
+			}
+			var n int
+			if out, n, err = appendJSONB(out, payload[i:]); err != nil {
+				return out, 0, err
+			}
+			i += n
+		}
+		if typ == jsonbObject && elements%2 == 1 {
+			return out, 0, fmt.Errorf("%w: object label without a value", ErrInvalidJSONB)
+		}
+		out = append(out, close)
+	default:
+		return out, 0, fmt.Errorf("%w: unknown element type %d", ErrInvalidJSONB, typ)
+	}
+	return out, header + size, nil
+}
+
+// appendFloat5 appends a JSON5 floating point number, e.g. ".5", "+1." or "Infinity", as JSON.
+func appendFloat5(out []byte, s string) []byte {
+	s = strings.TrimPrefix(s, "+")
+	if strings.HasPrefix(s, "-") {
+		out = append(out, '-')
+		s = s[1:]
+	}
+	switch {
+	case strings.EqualFold(s, "infinity") || strings.EqualFold(s, "inf"):
+		return append(out, "9.0e+999"...)
+	case strings.EqualFold(s, "nan"):
+		return append(out, "null"...)
+	case strings.HasPrefix(s, "."):
+		out = append(out, '0')
+	}
+	for i := range len(s) {
+		out = append(out, s[i])
+		if s[i] == '.' && (i+1 == len(s) || s[i+1] < '0' || s[i+1] > '9') {
+			out = append(out, '0')
+		}
+	}
+	return out
+}
+
+// appendText5 appends a string that contains JSON5 escapes as a JSON string.
+func appendText5(out, s []byte) []byte {
+	out = append(out, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			out = appendEscaped(out, c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'x':
+			if i+2 < len(s) {
+				out = append(out, `\u00`...)
+				out = append(out, s[i+1:i+3]...)
+				i += 2
+			}
+		case '\'':
+			out = append(out, '\'')
+		case 'v':
+			out = append(out, `\u000b`...)
+		case '0':
+			out = append(out, `\u0000`...)
+		case '\r':
+			// An escaped line terminator continues the string on the next line.
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+		default:
+			if r, size := utf8.DecodeRune(s[i:]); r == '\u2028' || r == '\u2029' {
+				i += size - 1
+				continue
+			}
+			out = append(out, '\\', c)
+		}
+	}
+	return append(out, '"')
+}
+
+// appendQuoted appends a string that isn't escaped as a JSON string.
+func appendQuoted(out, s []byte) []byte {
+	out = append(out, '"')
+	for _, c := range s {
+		out = appendEscaped(out, c)
+	}
+	return append(out, '"')
+}
+
+// appendEscaped appends a byte of a JSON string, escaping it if it's a quote, backslash or control character.
+func appendEscaped(out []byte, c byte) []byte {
+	const hex = "0123456789abcdef"
+	switch c {
+	case '"', '\\':
+		return append(out, '\\', c)
+	case '\b':
+		return append(out, `\b`...)
+	case '\f':
+		return append(out, `\f`...)
+	case '\n':
+		return append(out, `\n`...)
+	case '\r':
+		return append(out, `\r`...)
+	case '\t':
+		return append(out, `\t`...)
+	}
+	if c < 0x20 {
+		return append(out, '\\', 'u', '0', '0', hex[c>>4], hex[c&0x0f])
+	}
+	return append(out, c)
+}
@@ -0,0 +1,18 @@
+package db
+
+import "errors"
+
+// JSONPatchOperation is an operation of a JSON Patch (RFC 6902).
+type JSONPatchOperation struct {
+	// Op is one of add, remove, replace, move, copy or test.
+	Op string `json:"op"`
+	// Path is a JSON Pointer (RFC 6901) to the target location, e.g. "/phone_numbers/0".
+	Path string `json:"path"`
+	// From is the source location of move and copy operations.
+	From string `json:"from,omitempty"`
+	// Value is the value to add, replace or test.
+	Value any `json:"value,omitempty"`
+}
+
+// ErrJSONPatchTestFailed is returned when a test operation of a JSON Patch doesn't match.
+var ErrJSONPatchTestFailed = errors.New("json patch test failed")
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a DB, e.g. to log, authorize or rewrite queries and mutations.
+type Middleware func(DB) DB
+
+// Chain returns a middleware that applies the middlewares in order. The first middleware is the
+// outermost, so it sees each call first.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(d DB) DB {
+		for _, m := range slices.Backward(middlewares) {
+			d = m(d)
+		}
+		return d
+	}
+}
+
+// Call is a call to a DB method.
+type Call struct {
+	// Operation is the name of the method, e.g. "Query" or "Mutate".
+	Operation string
+	// Queries are the queries of Query, QueryRows and QueryScalarInt64 calls.
+	Queries []Query
+	// Mutations are the mutations of Mutate calls.
+	Mutations []Mutation
+}
+
+// SQL returns the SQL of each query or mutation of the call.
+func (c Call) SQL() (sql []string) {
+	for _, q := range c.Queries {
+		sql = append(sql, q.SQL)
+	}
+	for _, m := range c.Mutations {
+		sql = append(sql, m.SQL)
+	}
+	return sql
+}
+
+// Handler runs a call, and returns the number of rows returned or affected.
+type Handler func(ctx context.Context, call Call) (rows int, err error)
+
+// Intercept returns a middleware that passes each call to f, along with a handler that runs the call
+// against the wrapped DB. f can change the call before running it, e.g. to rewrite keys, or return an
+// error without running it, e.g. to inject faults.
+func Intercept(f func(ctx context.Context, call Call, next Handler) (rows int, err error)) Middleware {
+	return func(d DB) DB {
+		return &interceptor{next: d, f: f}
+	}
+}
+
+type interceptor struct {
+	next DB
+	f    func(ctx context.Context, call Call, next Handler) (rows int, err error)
+}
+
+func (i *interceptor) Query(ctx context.Context, queries ...Query) (outputs [][]Record, err error) {
+	_, err = i.f(ctx, Call{Operation: "Query", Queries: queries}, func(ctx context.Context, call Call) (rows int, err error) {
+		outputs, err = i.next.Query(ctx, call.Queries...)
+		for _, records := range outputs {
+			rows += len(records)
+		}
+		return rows, err
+	})
+	return outputs, err
+}
+
+func (i *interceptor) QueryRows(ctx context.Context, queries ...Query) (outputs []Rows, err error) {
+	_, err = i.f(ctx, Call{Operation: "QueryRows", Queries: queries}, func(ctx context.Context, call Call) (rows int, err error) {
+		outputs, err = i.next.QueryRows(ctx, call.Queries...)
+		for _, r := range outputs {
+			rows += len(r.Values)
+		}
+		return rows, err
+	})
+	return outputs, err
+}
+
+func (i *interceptor) Mutate(ctx context.Context, mutations ...Mutation) (rowsAffected []int64, err error) {
+	_, err = i.f(ctx, Call{Operation: "Mutate", Mutations: mutations}, func(ctx context.Context, call Call) (rows int, err error) {
+		rowsAffected, err = i.next.Mutate(ctx, call.Mutations...)
+		for _, n := range rowsAffected {
+			rows += int(n)
+		}
+		return rows, err
+	})
+	return rowsAffected, err
+}
+
+func (i *interceptor) QueryScalarInt64(ctx context.Context, sql string, args map[string]any) (n int64, err error) {
+	call := Call{Operation: "QueryScalarInt64", Queries: []Query{{SQL: sql, Args: args}}}
+	_, err = i.f(ctx, call, func(ctx context.Context, call Call) (rows int, err error) {
+		if len(call.Queries) != 1 {
+			return 0, fmt.Errorf("expected 1 query, got %d", len(call.Queries))
+		}
+		n, err = i.next.QueryScalarInt64(ctx, call.Queries[0].SQL, call.Queries[0].Args)
+		return 1, err
+	})
+	return n, err
+}
+
+// DefaultRedactedArgs are the arguments that contain the values of records, or data derived from
+// them, e.g. blob chunks, search queries and JSON Schemas, and are redacted by Logging by default.
+var DefaultRedactedArgs = []string{":value", ":data", ":input_data", ":query", ":schema"}
+
+// DefaultRedactedArgPrefixes are the prefixes of arguments that are redacted by Logging by default,
+// e.g. the literals of Find filters, which are named :filter_0, :filter_1 and so on.
+var DefaultRedactedArgPrefixes = []string{":filter_"}
+
+// LoggingOptions configures the Logging middleware.
+type LoggingOptions struct {
+	// Level is the level that calls are logged at. The default is slog.LevelDebug. Calls that fail
+	// are logged at slog.LevelError.
+	Level slog.Leveler
+	// Redact returns the value to log for the named argument. The default replaces the values of
+	// DefaultRedactedArgs, and of arguments with DefaultRedactedArgPrefixes, with "[REDACTED]".
+	Redact func(name string, value any) any
+}
+
+// Logging returns a middleware that logs each call, with its statements and arguments, the number of
+// rows returned or affected, the duration, and any error.
+func Logging(log *slog.Logger, opts LoggingOptions) Middleware {
+	level := opts.Level
+	if level == nil {
+		level = slog.LevelDebug
+	}
+	redact := opts.Redact
+	if redact == nil {
+		redact = func(name string, value any) any {
+			if slices.Contains(DefaultRedactedArgs, name) || slices.ContainsFunc(DefaultRedactedArgPrefixes, func(prefix string) bool {
+				return strings.HasPrefix(name, prefix)
+			}) {
+				return "[REDACTED]"
+			}
+			return value
+		}
+	}
+	redactArgs := func(args map[string]any) map[string]any {
+		redacted := make(map[string]any, len(args))
+		for name, value := range args {
+			redacted[name] = redact(name, value)
+		}
+		return redacted
+	}
+	return Intercept(func(ctx context.Context, call Call, next Handler) (rows int, err error) {
+		started := time.Now()
+		rows, err = next(ctx, call)
+		l := level.Level()
+		if err != nil {
+			l = slog.LevelError
+		}
+		if !log.Enabled(ctx, l) {
+			return rows, err
+		}
+		statements := make([]map[string]any, 0, len(call.Queries)+len(call.Mutations))
+		for _, q := range call.Queries {
+			statements = append(statements, map[string]any{"sql": q.SQL, "args": redactArgs(q.Args)})
+		}
+		for _, m := range call.Mutations {
+			statements = append(statements, map[string]any{"sql": m.SQL, "args": redactArgs(m.Args)})
+		}
+		attrs := []slog.Attr{
+			slog.Any("statements", statements),
+			slog.Int("rows", rows),
+			slog.Duration("duration", time.Since(started)),
+		}
+		if err != nil {
+			attrs = append(attrs, slog.Any("error", err))
+		}
+		log.LogAttrs(ctx, l, call.Operation, attrs...)
+		return rows, err
+	})
+}
+
+// SlowQuery is a call that took longer than the threshold given to SlowQueries.
+type SlowQuery struct {
+	Operation string
+	SQL       []string
+	Duration  time.Duration
+	Err       error
+}
+
+// SlowQueries returns a middleware that passes calls that take longer than the threshold to report.
+func SlowQueries(threshold time.Duration, report func(ctx context.Context, q SlowQuery)) Middleware {
+	return Intercept(func(ctx context.Context, call Call, next Handler) (rows int, err error) {
+		started := time.Now()
+		rows, err = next(ctx, call)
+		if d := time.Since(started); d > threshold {
+			report(ctx, SlowQuery{Operation: call.Operation, SQL: call.SQL(), Duration: d, Err: err})
+		}
+		return rows, err
+	})
+}
+
+// ErrTimeout is returned when a call takes longer than the timeout given to Timeout.
+var ErrTimeout = errors.New("timeout")
+
+// Timeout returns a middleware that cancels calls that take longer than the timeouts. The read
+// timeout applies to Query, QueryRows and QueryScalarInt64 calls, and the write timeout applies to
+// Mutate calls. A timeout of zero means no timeout.
+func Timeout(read, write time.Duration) Middleware {
+	return Intercept(func(ctx context.Context, call Call, next Handler) (rows int, err error) {
+		timeout := read
+		if call.Operation == "Mutate" {
+			timeout = write
+		}
+		if timeout <= 0 {
+			return next(ctx, call)
+		}
+		ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w: %s exceeded %v", ErrTimeout, call.Operation, timeout))
+		defer cancel()
+		rows, err = next(ctx, call)
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", context.Cause(ctx), err)
+		}
+		return rows, err
+	})
+}
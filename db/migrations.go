@@ -0,0 +1,130 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned change to the tables used by the store.
+type Migration struct {
+	Version int
+	Name    string
+	// Statements are the SQL statements of the migration.
+	Statements []string
+}
+
+// Migrations returns the migrations in the migrations directory, in version order.
+//
+// Each migration is a file named <version>_<name>.sql, e.g. 0002_add_expires.sql. Statements end
+// with a semicolon at the end of a line, except for triggers, which end with a line that only
+// contains "end;". Migrations must not be changed once they've been released.
+func Migrations() (migrations []Migration, err error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		versionText, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q: expected a name like 0001_name.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(versionText)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q: invalid version: %w", entry.Name(), err)
+		}
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       name,
+			Statements: splitStatements(string(sql)),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// String returns the file name of the migration, without the extension, e.g. 0001_init.
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Mutations returns the mutations that apply the migration.
+//
+// The version is recorded before the statements are run, so that if another runner has already
+// applied the migration, the mutations fail before any changes are made. The mutations must be
+// run in a single transaction.
+func (m Migration) Mutations() (mutations []Mutation) {
+	mutations = append(mutations, Mutation{
+		SQL: `insert into schema_version (version, name, applied) values (:version, :name, :now);`,
+		Args: map[string]any{
+			":version": m.Version,
+			":name":    m.Name,
+			":now":     now(),
+		},
+	})
+	for _, stmt := range m.Statements {
+		mutations = append(mutations, Mutation{SQL: stmt})
+	}
+	return mutations
+}
+
+// splitStatements splits SQL into statements, removing comments that aren't part of a statement.
+func splitStatements(sql string) (statements []string) {
+	var sb strings.Builder
+	var inTrigger bool
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.ToLower(strings.TrimSpace(line))
+		if sb.Len() == 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+				continue
+			}
+			inTrigger = strings.HasPrefix(trimmed, "create trigger")
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+		if (inTrigger && trimmed == "end;") || (!inTrigger && strings.HasSuffix(trimmed, ";")) {
+			statements = append(statements, strings.TrimSpace(sb.String()))
+			sb.Reset()
+		}
+	}
+	if strings.TrimSpace(sb.String()) != "" {
+		statements = append(statements, strings.TrimSpace(sb.String()))
+	}
+	return statements
+}
+
+// CreateSchemaVersionTable creates the table that records the migrations that have been applied.
+func CreateSchemaVersionTable() Mutation {
+	return Mutation{
+		SQL: `create table if not exists schema_version (version integer primary key, name text not null, applied text not null);`,
+	}
+}
+
+// CountSchemaVersionTable returns 1 if the schema_version table exists, and 0 if it doesn't.
+func CountSchemaVersionTable() Query {
+	return Query{
+		SQL: `select count(*) from sqlite_master where type = 'table' and name = 'schema_version';`,
+	}
+}
+
+// GetSchemaVersion gets the version of the latest migration that has been applied, or 0 if none have been applied.
+func GetSchemaVersion() Query {
+	return Query{
+		SQL: `select coalesce(max(version), 0) from schema_version;`,
+	}
+}
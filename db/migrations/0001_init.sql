@@ -0,0 +1,52 @@
+-- The kv table, and the tables and triggers used by search indexes, JSON Schemas and blobs.
+--
+-- Databases created before migrations were added already have some, or all, of these tables, so
+-- they're created if they don't exist, and Store.Migrate adds any columns that are missing from kv.
+
+create table if not exists kv (key text primary key, version integer, value jsonb, data blob, encoding text, key_id text, created text) without rowid;
+
+create index if not exists kv_key on kv(key);
+
+create index if not exists kv_created on kv(created);
+
+-- Full-text search. kv is a without rowid table, so kv_search_key maps each indexed key to the rowid
+-- of the kv_search table. The triggers keep kv_search in sync with writes to kv for keys that are
+-- covered by a search index.
+create table if not exists kv_search_index (prefix text primary key, paths text not null) without rowid;
+
+create table if not exists kv_search_key (id integer primary key, key text not null unique);
+
+create virtual table if not exists kv_search using fts5(content);
+
+create trigger if not exists kv_search_insert after insert on kv begin
+  insert into kv_search_key (key) select new.key where (select i.paths from kv_search_index i where substr(new.key, 1, length(i.prefix)) = i.prefix order by length(i.prefix) desc limit 1) is not null;
+  insert into kv_search (rowid, content) select k.id, (select group_concat(new.value ->> p.value, ' ') from json_each((select i.paths from kv_search_index i where substr(new.key, 1, length(i.prefix)) = i.prefix order by length(i.prefix) desc limit 1)) as p) from kv_search_key k where k.key = new.key;
+end;
+
+create trigger if not exists kv_search_update after update of value on kv begin
+  delete from kv_search where rowid = (select id from kv_search_key where key = old.key);
+  insert into kv_search (rowid, content) select k.id, (select group_concat(new.value ->> p.value, ' ') from json_each((select i.paths from kv_search_index i where substr(new.key, 1, length(i.prefix)) = i.prefix order by length(i.prefix) desc limit 1)) as p) from kv_search_key k where k.key = new.key;
+end;
+
+create trigger if not exists kv_search_delete after delete on kv begin
+  delete from kv_search where rowid = (select id from kv_search_key where key = old.key);
+  delete from kv_search_key where key = old.key;
+end;
+
+-- The JSON Schemas that values are validated against.
+create table if not exists kv_schema (prefix text primary key, schema jsonb not null) without rowid;
+
+-- The chunks of blobs. The value of the record of a blob is its metadata, which contains the id of
+-- the blob's chunks. The triggers remove the chunks when the record is deleted, or replaced with a
+-- value that refers to different chunks.
+create table if not exists kv_blob (id text not null, key text not null, chunk integer not null, data blob not null, primary key (id, chunk)) without rowid;
+
+create index if not exists kv_blob_key on kv_blob(key);
+
+create trigger if not exists kv_blob_update after update of value on kv begin
+  delete from kv_blob where key = new.key and id is not (new.value ->> '$.id');
+end;
+
+create trigger if not exists kv_blob_delete after delete on kv begin
+  delete from kv_blob where key = old.key;
+end;
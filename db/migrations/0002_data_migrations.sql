@@ -0,0 +1,2 @@
+-- The progress of data migrations, so that interrupted data migrations can be resumed.
+create table kv_data_migration (name text primary key, prefix text not null, last_key text not null, migrated integer not null, skipped integer not null, conflicted integer not null, completed integer not null, updated text not null) without rowid;
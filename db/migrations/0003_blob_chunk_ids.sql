@@ -0,0 +1,13 @@
+-- Chunks are deleted by the id of the blob that's replaced or deleted, rather than by key, so that
+-- the chunks of a blob that's still being written to the same key by another writer are kept.
+drop trigger if exists kv_blob_update;
+
+create trigger kv_blob_update after update of value on kv when (old.value ->> '$.id') is not (new.value ->> '$.id') begin
+  delete from kv_blob where key = old.key and id = (old.value ->> '$.id');
+end;
+
+drop trigger if exists kv_blob_delete;
+
+create trigger kv_blob_delete after delete on kv begin
+  delete from kv_blob where key = old.key and id = (old.value ->> '$.id');
+end;
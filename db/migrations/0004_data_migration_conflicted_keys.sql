@@ -0,0 +1,3 @@
+-- The keys of records that weren't migrated because they were changed by other writers, so that
+-- they're migrated again by the next run of the data migration.
+alter table kv_data_migration add column conflicted_keys text not null default '[]';
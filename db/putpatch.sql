@@ -3,6 +3,9 @@ with input_data as (
     json_extract(value, '$.key') as key,
     json_extract(value, '$.version') as version,
     json_extract(value, '$.value') as value,
+    unhex(json_extract(value, '$.data')) as data,
+    json_extract(value, '$.encoding') as encoding,
+    json_extract(value, '$.key_id') as key_id,
     json_extract(value, '$.operation') as operation
   from json_each(:input_data)
 ),
@@ -14,19 +17,26 @@ updated_data as (
         when input_data.operation = 'patch' then jsonb_patch(coalesce(existing_data.value, '{}'), input_data.value)
         else jsonb(input_data.value)
       end as value,
+      input_data.data as data,
+      input_data.encoding as encoding,
+      input_data.key_id as key_id,
       coalesce(existing_data.created, :now) as created
   from 
     input_data
   left join kv as existing_data on
     input_data.key = existing_data.key
   where
-    (input_data.version = -1 or existing_data.version = input_data.version) or (input_data.version == 0 and existing_data.version is null)
+    ((input_data.version = -1 or existing_data.version = input_data.version) or (input_data.version == 0 and existing_data.version is null))
+    and (input_data.operation <> 'patch' or existing_data.data is null)
 )
-insert into kv (key, version, value, created)
+insert into kv (key, version, value, data, encoding, key_id, created)
 select
   key,
   version,
   value,
+  data,
+  encoding,
+  key_id,
   created
 from updated_data
 where
@@ -34,4 +44,7 @@ where
 on conflict(key) do update
 set
   version = excluded.version,
-  value = excluded.value
+  value = excluded.value,
+  data = excluded.data,
+  encoding = excluded.encoding,
+  key_id = excluded.key_id
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScanOption configures the records returned by the GetPrefix, GetRange and List queries.
+type ScanOption func(o *scanOptions)
+
+type scanOptions struct {
+	fields  []string
+	sort    Sort
+	reverse bool
+}
+
+func newScanOptions(opts []ScanOption) (o scanOptions) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithFields limits the value of each record to the given JSON paths, e.g. "$.name" or "address.city".
+//
+// The value of each record is returned as a JSON object containing only the selected fields,
+// so it can be unmarshaled into the same type as the full value. Fields that are not present
+// in the value are returned as null. Array indices, e.g. "$.phone_numbers[1]", are not supported,
+// because the selected elements can't be placed at the same index, and the query's ArgsError is set.
+func WithFields(paths ...string) ScanOption {
+	return func(o *scanOptions) {
+		o.fields = append(o.fields, paths...)
+	}
+}
+
+// WithOrderBy sorts records by the given fields instead of by key, e.g. db.Sort{{Field: "created", Desc: true}}.
+// Use ParseSort to parse a sort expression such as "created desc, $.name".
+func WithOrderBy(sort Sort) ScanOption {
+	return func(o *scanOptions) {
+		o.sort = sort
+	}
+}
+
+// WithReverse reverses the order in which records are returned, e.g. to get the last N keys.
+func WithReverse() ScanOption {
+	return func(o *scanOptions) {
+		o.reverse = true
+	}
+}
+
+// orderBy returns the order by clause, and adds any required arguments to args.
+func (o scanOptions) orderBy(args map[string]any) string {
+	sort := o.sort
+	if o.reverse {
+		sort = make(Sort, len(o.sort))
+		for i, sf := range o.sort {
+			sort[i] = SortField{Field: sf.Field, Desc: !sf.Desc}
+		}
+		if !sort.hasKey() {
+			sort = append(sort, SortField{Field: "key", Desc: true})
+		}
+	}
+	return sort.sql(args)
+}
+
+// fieldsError returns an error if any of the field paths select array elements.
+func (o scanOptions) fieldsError() error {
+	for _, field := range o.fields {
+		if hasArrayIndex(field) {
+			return fmt.Errorf("withfields: array indices are not supported, got %q", field)
+		}
+	}
+	return nil
+}
+
+// hasArrayIndex returns true if the path contains an array index, e.g. "$.phone_numbers[1]".
+// Brackets within quoted keys, e.g. `$."a[1]"`, are not array indices.
+func hasArrayIndex(path string) bool {
+	var quoted bool
+	for _, c := range path {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '[' && !quoted:
+			return true
+		}
+	}
+	return false
+}
+
+// valueColumns returns the SQL expressions used to select the value and encoding columns, and adds any required arguments to args.
+//
+// JSON values are stored in the value column as jsonb, while values with other encodings are stored in the data column,
+// with any queryable fields in the value column.
+func (o scanOptions) valueColumns(args map[string]any) string {
+	if len(o.fields) == 0 {
+		return "coalesce(data, json(value)) as value, encoding"
+	}
+	var sb strings.Builder
+	sb.WriteString("json_set('{}'")
+	for i, field := range o.fields {
+		name := fmt.Sprintf(":field_%d", i)
+		args[name] = jsonPath(field)
+		sb.WriteString(", ")
+		sb.WriteString(name)
+		sb.WriteString(", value -> ")
+		sb.WriteString(name)
+	}
+	sb.WriteString(") as value, null as encoding")
+	return sb.String()
+}
+
+// jsonPath converts a field path such as "address.city" to a JSON path such as "$.address.city".
+// Paths that already start with "$" are returned unchanged.
+func jsonPath(path string) string {
+	if strings.HasPrefix(path, "$") {
+		return path
+	}
+	if strings.HasPrefix(path, "[") {
+		return "$" + path
+	}
+	return "$." + path
+}
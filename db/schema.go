@@ -0,0 +1,29 @@
+package db
+
+// PutSchema creates, or replaces, the JSON Schema for values of keys with the given prefix.
+func PutSchema(prefix string, schema []byte) Mutation {
+	return Mutation{
+		SQL: `insert into kv_schema (prefix, schema) values (:prefix, jsonb(:schema)) on conflict(prefix) do update set schema = excluded.schema;`,
+		Args: map[string]any{
+			":prefix": prefix,
+			":schema": string(schema),
+		},
+	}
+}
+
+// DeleteSchema deletes the JSON Schema for the given prefix.
+func DeleteSchema(prefix string) Mutation {
+	return Mutation{
+		SQL: `delete from kv_schema where prefix = :prefix;`,
+		Args: map[string]any{
+			":prefix": prefix,
+		},
+	}
+}
+
+// GetSchemas returns the prefix and schema columns of each JSON Schema, ordered by prefix.
+func GetSchemas() Query {
+	return Query{
+		SQL: `select prefix, json(schema) as schema from kv_schema order by prefix;`,
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// searchIndexPaths selects the paths of the search index with the longest prefix that matches the key.
+func searchIndexPaths(key string) string {
+	return `(select i.paths from kv_search_index i where substr(` + key + `, 1, length(i.prefix)) = i.prefix order by length(i.prefix) desc limit 1)`
+}
+
+// searchContent concatenates the text at each of the indexed paths of the value.
+func searchContent(key, value string) string {
+	return `(select group_concat(` + value + ` ->> p.value, ' ') from json_each(` + searchIndexPaths(key) + `) as p)`
+}
+
+// CreateSearchIndex creates, or replaces, a full-text search index over the values at the JSON paths
+// of records with the given prefix, and indexes the existing records.
+//
+// If more than one index matches a key, the index with the longest prefix is used.
+func CreateSearchIndex(prefix string, paths []string) (mutations []Mutation, err error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("at least one path is required")
+	}
+	normalized := make([]string, len(paths))
+	for i, p := range paths {
+		normalized[i] = jsonPath(p)
+	}
+	pathsJSON, err := json.Marshal(normalized)
+	if err != nil {
+		return nil, err
+	}
+	mutations = append(mutations, Mutation{
+		SQL: `insert into kv_search_index (prefix, paths) values (:prefix, :paths) on conflict(prefix) do update set paths = excluded.paths;`,
+		Args: map[string]any{
+			":prefix": prefix,
+			":paths":  string(pathsJSON),
+		},
+	})
+	return append(mutations, reindexSearch(prefix)...), nil
+}
+
+// DropSearchIndex removes a full-text search index. Records with the prefix that are covered by
+// an index with a shorter prefix are indexed using that index instead.
+func DropSearchIndex(prefix string) (mutations []Mutation) {
+	mutations = append(mutations, Mutation{
+		SQL: `delete from kv_search_index where prefix = :prefix;`,
+		Args: map[string]any{
+			":prefix": prefix,
+		},
+	})
+	return append(mutations, reindexSearch(prefix)...)
+}
+
+func reindexSearch(prefix string) []Mutation {
+	args := map[string]any{
+		":prefix": prefix + "%",
+	}
+	return []Mutation{
+		{
+			SQL:  `delete from kv_search where rowid in (select id from kv_search_key where key like :prefix);`,
+			Args: args,
+		},
+		{
+			SQL:  `delete from kv_search_key where key like :prefix;`,
+			Args: args,
+		},
+		{
+			SQL:  `insert into kv_search_key (key) select key from kv where key like :prefix and ` + searchIndexPaths("kv.key") + ` is not null;`,
+			Args: args,
+		},
+		{
+			SQL:  `insert into kv_search (rowid, content) select k.id, ` + searchContent("kv.key", "kv.value") + ` from kv_search_key k inner join kv on kv.key = k.key where k.key like :prefix;`,
+			Args: args,
+		},
+	}
+}
+
+// Search returns records with the given prefix that match the FTS5 query, best match first.
+//
+// The query uses the FTS5 query syntax, e.g. `sqlite AND (search OR index)`.
+// Each row contains the record columns, a snippet of the matching text with the matches
+// highlighted with <mark> and </mark>, and the bm25 rank, where lower is better.
+func Search(prefix, query string, offset, limit int) Query {
+	return Query{
+		SQL: `select kv.key, kv.version, coalesce(kv.data, json(kv.value)) as value, kv.encoding, kv.created, snippet(kv_search, 0, '<mark>', '</mark>', '…', 16) as snippet, bm25(kv_search) as rank
+from kv_search
+inner join kv_search_key k on k.id = kv_search.rowid
+inner join kv on kv.key = k.key
+where kv_search match :query and k.key like :prefix
+order by rank, kv.key
+limit :limit offset :offset;`,
+		Args: map[string]any{
+			":query":  query,
+			":prefix": prefix + "%",
+			":offset": offset,
+			":limit":  limit,
+		},
+	}
+}
@@ -2,8 +2,10 @@ package db
 
 import (
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"time"
 )
 
@@ -16,86 +18,188 @@ func now() string {
 	return time.Now().UTC().Format(time.RFC3339Nano)
 }
 
-func Init() []Mutation {
-	return []Mutation{
-		{
-			SQL: `create table if not exists kv (key text primary key, version integer, value jsonb, created text) without rowid;`,
-		},
-		{
-			SQL: `create index if not exists kv_key on kv(key);`,
-		},
-		{
-			SQL: `create index if not exists kv_created on kv(created);`,
-		},
+// addedColumns are the columns that have been added to the kv table since it was first created,
+// in the order they were added.
+var addedColumns = []struct {
+	name, definition string
+}{
+	{name: "data", definition: "data blob"},
+	{name: "encoding", definition: "encoding text"},
+	{name: "key_id", definition: "key_id text"},
+}
+
+// GetColumns gets the names of the columns of the kv table.
+func GetColumns() Query {
+	return Query{
+		SQL: `select name from pragma_table_info('kv');`,
+	}
+}
+
+// AddColumns adds the columns that are missing from a kv table created by an earlier version,
+// given the names of its existing columns.
+func AddColumns(existing []string) (mutations []Mutation) {
+	for _, c := range addedColumns {
+		if !slices.Contains(existing, c.name) {
+			mutations = append(mutations, Mutation{SQL: `alter table kv add column ` + c.definition + `;`})
+		}
 	}
+	return mutations
 }
 
 func Get(key string) Query {
 	return Query{
-		SQL: `select key, version, json(value) as value, created from kv where key = :key;`,
+		SQL: `select key, version, coalesce(data, json(value)) as value, encoding, created from kv where key = :key;`,
 		Args: map[string]any{
 			":key": key,
 		},
 	}
 }
 
-func GetPrefix(prefix string, offset, limit int) Query {
+// GetVersion gets the version of a key, or 0 if the key doesn't exist.
+func GetVersion(key string) Query {
 	return Query{
-		SQL: `select key, version, json(value) as value, created from kv where key like :prefix order by key limit :limit offset :offset;`,
+		SQL: `select coalesce(max(version), 0) from kv where key = :key;`,
 		Args: map[string]any{
-			":prefix": prefix + "%",
-			":limit":  limit,
-			":offset": offset,
+			":key": key,
 		},
 	}
 }
 
-func GetRange(from, to string, offset, limit int) Query {
+// GetKeys gets the records with the given keys. Keys that don't exist are not returned.
+func GetKeys(keys ...string) (q Query, err error) {
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		return q, err
+	}
 	return Query{
-		SQL: `select key, version, json(value) as value, created from kv where key >= :from and key < :to order by key limit :limit offset :offset;`,
+		SQL: `select key, version, coalesce(data, json(value)) as value, encoding, created from kv where key in (select value from json_each(:keys)) order by key;`,
 		Args: map[string]any{
-			":from":   from,
-			":to":     to,
-			":limit":  limit,
-			":offset": offset,
+			":keys": string(keysJSON),
 		},
-	}
+	}, nil
 }
 
-func List(offset, limit int) Query {
+// GetPath gets the value at the JSON path within the value of a key, e.g. "$.name".
+// If the path is not present in the value, the value of the returned record is null. The encoding
+// of the record is the encoding of the whole value, so that values that aren't stored as JSON,
+// and only have their plaintext fields in the value column, can be detected.
+func GetPath(key, path string) Query {
 	return Query{
-		SQL: `select key, version, json(value) as value, created from kv order by key limit :limit offset :offset;`,
+		SQL: `select key, version, value -> :path as value, encoding, created from kv where key = :key;`,
 		Args: map[string]any{
-			":offset": offset,
-			":limit":  limit,
+			":key":  key,
+			":path": jsonPath(path),
 		},
 	}
 }
 
+func GetPrefix(prefix string, offset, limit int, opts ...ScanOption) Query {
+	o := newScanOptions(opts)
+	args := map[string]any{
+		":prefix": prefix + "%",
+		":limit":  limit,
+		":offset": offset,
+	}
+	return Query{
+		SQL:       `select key, version, ` + o.valueColumns(args) + `, created from kv where key like :prefix order by ` + o.orderBy(args) + ` limit :limit offset :offset;`,
+		Args:      args,
+		ArgsError: o.fieldsError(),
+	}
+}
+
+func GetRange(from, to string, offset, limit int, opts ...ScanOption) Query {
+	o := newScanOptions(opts)
+	args := map[string]any{
+		":from":   from,
+		":to":     to,
+		":limit":  limit,
+		":offset": offset,
+	}
+	return Query{
+		SQL:       `select key, version, ` + o.valueColumns(args) + `, created from kv where key >= :from and key < :to order by ` + o.orderBy(args) + ` limit :limit offset :offset;`,
+		Args:      args,
+		ArgsError: o.fieldsError(),
+	}
+}
+
+func List(offset, limit int, opts ...ScanOption) Query {
+	o := newScanOptions(opts)
+	args := map[string]any{
+		":offset": offset,
+		":limit":  limit,
+	}
+	return Query{
+		SQL:       `select key, version, ` + o.valueColumns(args) + `, created from kv order by ` + o.orderBy(args) + ` limit :limit offset :offset;`,
+		Args:      args,
+		ArgsError: o.fieldsError(),
+	}
+}
+
 func Put(key string, version int64, value any) (m Mutation) {
-	jsonValue, err := json.Marshal(value)
+	arg, err := encodeValue(value)
 	if err != nil {
 		return Mutation{
 			ArgsError: err,
 		}
 	}
 	return Mutation{
-		SQL: `insert into kv (key, version, value, created)
-values (:key, 1, jsonb(:value), :now)
+		SQL: `insert into kv (key, version, value, data, encoding, key_id, created)
+values (:key, 1, jsonb(:value), unhex(:data), :encoding, :key_id, :now)
 on conflict(key) do update 
 set version = excluded.version + 1, 
-    value = jsonb(excluded.value)
+    value = jsonb(excluded.value),
+    data = excluded.data,
+    encoding = excluded.encoding,
+    key_id = excluded.key_id
 where (:version = -1 or version = :version) and (:version <> 0);`,
 		Args: map[string]any{
-			":key":     key,
-			":version": version,
-			":value":   string(jsonValue),
-			":now":     now(),
+			":key":      key,
+			":version":  version,
+			":value":    arg.Value,
+			":data":     arg.Data,
+			":encoding": arg.Encoding,
+			":key_id":   arg.KeyID,
+			":now":      now(),
 		},
 		MustAffectRows: true,
+		Writes:         []PutPatchInput{PutInput(key, version, value)},
 	}
 }
 
+// valueArg is the arguments used to store a value. JSON values are stored as JSON text, while
+// values with other encodings are stored as hex encoded data, with the name of the encoding, and
+// the ID of the key used to encrypt them, if any.
+type valueArg struct {
+	Value    any `json:"value"`
+	Data     any `json:"data"`
+	Encoding any `json:"encoding"`
+	KeyID    any `json:"key_id"`
+}
+
+func encodeValue(value any) (arg valueArg, err error) {
+	if e, ok := value.(Encoded); ok {
+		if e.IsJSON() {
+			arg.Value = string(e.Data)
+			return arg, nil
+		}
+		if len(e.Fields) > 0 {
+			arg.Value = string(e.Fields)
+		}
+		arg.Data = hex.EncodeToString(e.Data)
+		arg.Encoding = e.Encoding
+		if e.KeyID != "" {
+			arg.KeyID = e.KeyID
+		}
+		return arg, nil
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return arg, err
+	}
+	arg.Value = string(v)
+	return arg, nil
+}
+
 type PutPatchInput struct {
 	Key       string    `json:"key"`
 	Version   int64     `json:"version"`
@@ -108,6 +212,10 @@ type Operation string
 var OperationPut Operation = "put"
 var OperationPatch Operation = "patch"
 
+// OperationJSONPatch applies a JSON Patch (RFC 6902) to the value. JSON patches can't be applied
+// in SQL, so they're resolved into puts of the patched value by the Store before the mutation is run.
+var OperationJSONPatch Operation = "json-patch"
+
 func PutInput(key string, version int64, value any) PutPatchInput {
 	return PutPatchInput{
 		Key:       key,
@@ -126,18 +234,56 @@ func PatchInput(key string, version int64, patch any) PutPatchInput {
 	}
 }
 
+// JSONPatchInput creates an input that applies a JSON Patch (RFC 6902) to a key.
+func JSONPatchInput(key string, version int64, ops []JSONPatchOperation) PutPatchInput {
+	return PutPatchInput{
+		Key:       key,
+		Version:   version,
+		Value:     ops,
+		Operation: OperationJSONPatch,
+	}
+}
+
+// putPatchInputArg is the JSON representation of a PutPatchInput used by putpatch.sql.
+type putPatchInputArg struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+	valueArg
+	Operation Operation `json:"operation"`
+}
+
 //go:embed putpatch.sql
 var putPatchSQL string
 
 func PutPatches(operations ...PutPatchInput) (m Mutation) {
 	for _, op := range operations {
+		if op.Operation == OperationJSONPatch {
+			return Mutation{
+				ArgsError: fmt.Errorf("putpatchinput: %v operations must be run with Store.MutateAll", op.Operation),
+				Writes:    operations,
+			}
+		}
 		if !(op.Operation == OperationPut || op.Operation == OperationPatch) {
 			return Mutation{
 				ArgsError: fmt.Errorf("putpatchinput: invalid operation type: %v", op.Operation),
 			}
 		}
 	}
-	putsAndPatchesJSON, err := json.Marshal(operations)
+	inputs := make([]putPatchInputArg, len(operations))
+	for i, op := range operations {
+		inputs[i] = putPatchInputArg{
+			Key:       op.Key,
+			Version:   op.Version,
+			Operation: op.Operation,
+		}
+		var err error
+		if inputs[i].valueArg, err = encodeValue(op.Value); err != nil {
+			return Mutation{
+				ArgsError: err,
+			}
+		}
+	}
+	putsAndPatchesJSON, err := json.Marshal(inputs)
 	if err != nil {
 		return Mutation{
 			ArgsError: err,
@@ -150,6 +296,7 @@ func PutPatches(operations ...PutPatchInput) (m Mutation) {
 			":now":        now(),
 		},
 		MustAffectRows: true,
+		Writes:         operations,
 	}
 }
 
@@ -232,6 +379,9 @@ func CountRange(from, to string) Query {
 	}
 }
 
+// Patch applies a JSON merge patch (RFC 7396) to the value of a key, creating the key if it doesn't exist.
+// Values that are stored in the data column, because they're compressed, encrypted or not JSON encoded,
+// can't be patched in SQL, so patching them affects no rows.
 func Patch(key string, version int64, patch any) (m Mutation) {
 	jsonPatch, err := json.Marshal(patch)
 	if err != nil {
@@ -245,12 +395,14 @@ values (:key, 1, jsonb(:value), :now)
 on conflict(key) do update 
 set version = excluded.version + 1, 
     value = jsonb_patch(kv.value, excluded.value)
-where (:version = -1 or version = :version);`,
+where (:version = -1 or version = :version) and kv.data is null;`,
 		Args: map[string]any{
 			":key":     key,
 			":version": version,
 			":value":   string(jsonPatch),
 			":now":     now(),
 		},
+		MustAffectRows: true,
+		Writes:         []PutPatchInput{PatchInput(key, version, json.RawMessage(jsonPatch))},
 	}
 }
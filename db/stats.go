@@ -0,0 +1,30 @@
+package db
+
+// Stats gets the number of records with the prefix, and the size of their stored values in bytes,
+// grouped by encoding. The encoding of JSON values is "json".
+func Stats(prefix string) Query {
+	return Query{
+		SQL: `select coalesce(encoding, 'json') as encoding, count(*) as records, sum(coalesce(length(data), 0) + coalesce(length(value), 0)) as stored_bytes
+from kv
+where key like :prefix
+group by 1
+order by 1;`,
+		Args: map[string]any{
+			":prefix": prefix + "%",
+		},
+	}
+}
+
+// GetPrefixWithEncoding gets up to limit records with the prefix and encoding that have keys after
+// the given key, in key order. Pass an empty key to start from the first record.
+func GetPrefixWithEncoding(prefix, encoding, after string, limit int) Query {
+	return Query{
+		SQL: `select key, version, coalesce(data, json(value)) as value, encoding, created from kv where key like :prefix and encoding = :encoding and key > :after order by key limit :limit;`,
+		Args: map[string]any{
+			":prefix":   prefix + "%",
+			":encoding": encoding,
+			":after":    after,
+			":limit":    limit,
+		},
+	}
+}
@@ -0,0 +1,301 @@
+package sqlitekv
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// KeyProvider provides the key encryption keys used to encrypt values.
+//
+// Each value is encrypted with its own data encryption key, which is wrapped (encrypted) by a key
+// encryption key and stored with the value, so key encryption keys can be held by an external key
+// management service that wraps and unwraps data encryption keys without revealing the key.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key used to encrypt new values.
+	CurrentKeyID(ctx context.Context) (string, error)
+	// WrapKey encrypts the data encryption key with the key encryption key with the given ID.
+	WrapKey(ctx context.Context, keyID string, dek []byte) (wrapped []byte, err error)
+	// UnwrapKey decrypts a data encryption key that was wrapped with the key encryption key with the given ID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) (dek []byte, err error)
+}
+
+// NewStaticKeyProvider creates a key provider from a set of AES keys, which must be 16, 24 or 32 bytes
+// long. New values are encrypted with the key with the current ID.
+//
+// To rotate keys, add a new key, make it current, and run Store.RotateKeys. The old key can be
+// removed once no values are encrypted with it.
+func NewStaticKeyProvider(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not found", current)
+	}
+	kp := &StaticKeyProvider{
+		current: current,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key ID %q must be between 1 and 255 bytes long", id)
+		}
+		aead, err := newAESGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		kp.keys[id] = aead
+	}
+	return kp, nil
+}
+
+// StaticKeyProvider is a KeyProvider that wraps data encryption keys with AES-GCM using keys held in memory.
+type StaticKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func (kp *StaticKeyProvider) CurrentKeyID(ctx context.Context) (string, error) {
+	return kp.current, nil
+}
+
+func (kp *StaticKeyProvider) WrapKey(ctx context.Context, keyID string, dek []byte) (wrapped []byte, err error) {
+	aead, ok := kp.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+	return seal(aead, dek, nil)
+}
+
+func (kp *StaticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) (dek []byte, err error) {
+	aead, ok := kp.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+	return open(aead, wrapped, nil)
+}
+
+// ErrKeyNotFound is returned when a value is encrypted with a key that the key provider doesn't have.
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+// WithEncryption encrypts values with AES-GCM before they're stored, using keys from the key provider.
+//
+// Keys are not encrypted, so they can still be queried. The values at the given JSON paths, e.g.
+// "$.name" or "address.city", are also stored unencrypted, so that they can be used by Find,
+// Aggregate, GetPath, WithFields, WithOrderBy and search indexes. Array indices are not supported.
+//
+// Encrypted values can't be patched in SQL, so patches are applied to the decrypted value, and the
+// result is encrypted and written, pinned to the version that was read. Blobs are not encrypted, so
+// PutBlob returns ErrBlobEncryptionUnsupported.
+func WithEncryption(keys KeyProvider, plaintextFields ...string) StoreOption {
+	return func(s *Store) {
+		s.keys = keys
+		s.plaintextFields = plaintextFields
+	}
+}
+
+// encryptedEncodingSuffix is added to the encoding of encrypted values, e.g. "json+aes-gcm".
+const encryptedEncodingSuffix = "+aes-gcm"
+
+// envelopeVersion is the version of the format of encrypted values.
+const envelopeVersion = 1
+
+// encrypt encrypts the value using a new data encryption key, wrapped by the current key.
+// The key of the record is used as additional data, so the encrypted value can't be copied to another key.
+//
+// The encrypted value is stored as the envelope version, the length of the key ID and the key ID,
+// the length of the wrapped data encryption key and the wrapped key, and the nonce and ciphertext.
+func (s *Store) encrypt(ctx context.Context, key string, plaintext db.Encoded) (e db.Encoded, err error) {
+	if e.KeyID, err = s.keys.CurrentKeyID(ctx); err != nil {
+		return e, err
+	}
+	if len(e.KeyID) == 0 || len(e.KeyID) > 255 {
+		return e, fmt.Errorf("key ID %q must be between 1 and 255 bytes long", e.KeyID)
+	}
+	dek := make([]byte, 32)
+	if _, err = rand.Read(dek); err != nil {
+		return e, err
+	}
+	wrapped, err := s.keys.WrapKey(ctx, e.KeyID, dek)
+	if err != nil {
+		return e, err
+	}
+	if len(wrapped) > 0xffff {
+		return e, fmt.Errorf("wrapped key is too long: %d bytes", len(wrapped))
+	}
+	aead, err := newAESGCM(dek)
+	if err != nil {
+		return e, err
+	}
+	e.Data = append(e.Data, envelopeVersion, byte(len(e.KeyID)))
+	e.Data = append(e.Data, e.KeyID...)
+	e.Data = binary.BigEndian.AppendUint16(e.Data, uint16(len(wrapped)))
+	e.Data = append(e.Data, wrapped...)
+	ciphertext, err := seal(aead, plaintext.Data, []byte(key))
+	if err != nil {
+		return e, err
+	}
+	e.Data = append(e.Data, ciphertext...)
+	e.Encoding = plaintext.Encoding + encryptedEncodingSuffix
+	return e, nil
+}
+
+// decrypt decrypts the value of the record, if it's encrypted, and sets the encoding to the encoding of the decrypted value.
+// Use decodeRecord to decrypt and decompress records.
+func (s *Store) decrypt(ctx context.Context, r db.Record) (db.Record, error) {
+	encoding, ok := strings.CutSuffix(r.Encoding, encryptedEncodingSuffix)
+	if !ok {
+		return r, nil
+	}
+	if s.keys == nil {
+		return r, fmt.Errorf("%q is encrypted, but the store has no key provider", r.Key)
+	}
+	keyID, wrapped, ciphertext, err := parseEnvelope(r.Value)
+	if err != nil {
+		return r, fmt.Errorf("%q: %w", r.Key, err)
+	}
+	dek, err := s.keys.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return r, fmt.Errorf("%q: %w", r.Key, err)
+	}
+	aead, err := newAESGCM(dek)
+	if err != nil {
+		return r, fmt.Errorf("%q: %w", r.Key, err)
+	}
+	if r.Value, err = open(aead, ciphertext, []byte(r.Key)); err != nil {
+		return r, fmt.Errorf("%q: %w", r.Key, err)
+	}
+	r.Encoding = encoding
+	return r, nil
+}
+
+func parseEnvelope(data []byte) (keyID string, wrapped, ciphertext []byte, err error) {
+	if len(data) < 2 || data[0] != envelopeVersion {
+		return "", nil, nil, errors.New("invalid encrypted value")
+	}
+	data = data[1:]
+	n := int(data[0])
+	if len(data) < 1+n+2 {
+		return "", nil, nil, errors.New("invalid encrypted value")
+	}
+	keyID, data = string(data[1:1+n]), data[1+n:]
+	n = int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, nil, errors.New("invalid encrypted value")
+	}
+	return keyID, data[2 : 2+n], data[2+n:], nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext, and returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts data created by seal.
+func open(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("invalid encrypted value")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
+
+// selectFields returns a JSON object that contains the values at the JSON paths within the value.
+func selectFields(value []byte, paths []string) ([]byte, error) {
+	var v any
+	if err := json.Unmarshal(value, &v); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]any)
+	for _, path := range paths {
+		segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), ".")
+		src, dst := v, selected
+		for i, segment := range segments {
+			m, ok := src.(map[string]any)
+			if !ok {
+				break
+			}
+			if src, ok = m[segment]; !ok {
+				break
+			}
+			if i == len(segments)-1 {
+				dst[segment] = src
+				break
+			}
+			next, ok := dst[segment].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				dst[segment] = next
+			}
+			dst = next
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// RotateKeys re-encrypts the values of keys with the given prefix that are encrypted with a key other
+// than the key provider's current key, batchSize records at a time, and returns the number of
+// records that were re-encrypted. Each batch is written atomically, and retried if any of its
+// records are changed by another writer.
+//
+// Values that aren't encrypted are not changed. They're encrypted the next time they're written.
+// Values are compressed and their plaintext fields are selected again, using the store's current options.
+func (s *Store) RotateKeys(ctx context.Context, prefix string, batchSize int) (rotated int, err error) {
+	if s.keys == nil {
+		return 0, errors.New("rotatekeys: the store has no key provider")
+	}
+	if batchSize <= 0 {
+		return 0, errors.New("rotatekeys: batch size must be greater than zero")
+	}
+	keyID, err := s.keys.CurrentKeyID(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("rotatekeys: %w", err)
+	}
+	var conflicts int
+	for {
+		outputs, err := s.db.Query(ctx, db.GetPrefixEncryptedWithOtherKeys(prefix, keyID, batchSize))
+		if err != nil {
+			return rotated, fmt.Errorf("rotatekeys: %w", err)
+		}
+		records := outputs[0]
+		if len(records) == 0 {
+			return rotated, nil
+		}
+		writes := make([]db.PutPatchInput, len(records))
+		for i, r := range records {
+			if r, err = s.decodeRecord(ctx, r); err != nil {
+				return rotated, fmt.Errorf("rotatekeys: %w", err)
+			}
+			e, err := s.encodeValue(ctx, r.Key, db.Encoded{Encoding: r.Encoding, Data: r.Value})
+			if err != nil {
+				return rotated, fmt.Errorf("rotatekeys: %q: %w", r.Key, err)
+			}
+			writes[i] = db.PutInput(r.Key, r.Version, e)
+		}
+		_, err = s.db.Mutate(ctx, db.PutPatches(writes...))
+		if errors.Is(err, db.ErrVersionMismatch) && conflicts < maxResolvedWriteAttempts {
+			conflicts++
+			continue
+		}
+		if err != nil {
+			return rotated, fmt.Errorf("rotatekeys: %w", err)
+		}
+		rotated += len(records)
+	}
+}
@@ -0,0 +1,255 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer and meter.
+const instrumentationName = "github.com/a-h/sqlitekv"
+
+// InstrumentationOption configures NewInstrumented.
+type InstrumentationOption func(*Instrumented)
+
+// WithTracerProvider sets the provider of the tracer used to create spans. The default is a no-op provider.
+func WithTracerProvider(tp trace.TracerProvider) InstrumentationOption {
+	return func(i *Instrumented) {
+		i.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider sets the provider of the meter used to record metrics. The default is a no-op provider.
+func WithMeterProvider(mp metric.MeterProvider) InstrumentationOption {
+	return func(i *Instrumented) {
+		i.meterProvider = mp
+	}
+}
+
+// NewInstrumented wraps a database, so that each call to it creates an OpenTelemetry span and records metrics.
+//
+// Spans are named after the method, e.g. "sqlitekv.Mutate", and have the kinds of statement, e.g.
+// "select" or "insert", the number of rows returned or affected, and any error. The metrics are:
+//
+//   - db.client.operation.duration: a histogram of the duration of each call, in seconds.
+//   - sqlitekv.version_conflicts: a count of the mutations that failed with db.ErrVersionMismatch.
+//   - sqlitekv.pool.wait_time: a histogram of the time spent waiting for a Sqlite connection, in seconds.
+//
+// Use WithTracerProvider and WithMeterProvider to export them, e.g. using the global providers:
+//
+//	d := sqlitekv.NewInstrumented(sqlitekv.NewSqlite(pool),
+//		sqlitekv.WithTracerProvider(otel.GetTracerProvider()),
+//		sqlitekv.WithMeterProvider(otel.GetMeterProvider()),
+//	)
+//	store := sqlitekv.NewStore(d)
+func NewInstrumented(d db.DB, opts ...InstrumentationOption) *Instrumented {
+	i := &Instrumented{
+		db:             d,
+		system:         systemOf(d),
+		tracerProvider: tracenoop.NewTracerProvider(),
+		meterProvider:  metricnoop.NewMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	version := strings.TrimSpace(Version)
+	i.tracer = i.tracerProvider.Tracer(instrumentationName, trace.WithInstrumentationVersion(version))
+	meter := i.meterProvider.Meter(instrumentationName, metric.WithInstrumentationVersion(version))
+
+	// Instruments are usable even if they can't be created, so errors are passed to the global handler.
+	var err error
+	i.duration, err = meter.Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of database client operations."),
+		metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	i.conflicts, err = meter.Int64Counter("sqlitekv.version_conflicts",
+		metric.WithDescription("Number of mutations that failed because the version of the record didn't match."),
+		metric.WithUnit("{conflict}"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	i.poolWait, err = meter.Float64Histogram("sqlitekv.pool.wait_time",
+		metric.WithDescription("Time spent waiting for a connection from the SQLite connection pool."),
+		metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+	return i
+}
+
+// Instrumented is a db.DB that creates OpenTelemetry spans and records metrics for each call. See NewInstrumented.
+type Instrumented struct {
+	db             db.DB
+	system         string
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+	tracer         trace.Tracer
+	duration       metric.Float64Histogram
+	conflicts      metric.Int64Counter
+	poolWait       metric.Float64Histogram
+}
+
+func (i *Instrumented) isDB() db.DB { return i }
+
+// Unwrap returns the wrapped database.
+func (i *Instrumented) Unwrap() db.DB { return i.db }
+
+func (i *Instrumented) Query(ctx context.Context, queries ...db.Query) (outputs [][]db.Record, err error) {
+	ctx, end := i.start(ctx, "Query", querySQL(queries))
+	defer func() {
+		var rows int
+		for _, records := range outputs {
+			rows += len(records)
+		}
+		end(err, attribute.Int("db.response.returned_rows", rows))
+	}()
+	return i.db.Query(ctx, queries...)
+}
+
+func (i *Instrumented) QueryRows(ctx context.Context, queries ...db.Query) (outputs []db.Rows, err error) {
+	ctx, end := i.start(ctx, "QueryRows", querySQL(queries))
+	defer func() {
+		var rows int
+		for _, r := range outputs {
+			rows += len(r.Values)
+		}
+		end(err, attribute.Int("db.response.returned_rows", rows))
+	}()
+	return i.db.QueryRows(ctx, queries...)
+}
+
+func (i *Instrumented) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
+	sql := make([]string, len(mutations))
+	for j, m := range mutations {
+		sql[j] = m.SQL
+	}
+	ctx, end := i.start(ctx, "Mutate", sql)
+	defer func() {
+		var rows int64
+		for _, n := range rowsAffected {
+			rows += n
+		}
+		var conflicts int
+		var be *BatchError
+		if errors.As(err, &be) {
+			for _, err := range be.Errors {
+				if errors.Is(err, db.ErrVersionMismatch) {
+					conflicts++
+				}
+			}
+		}
+		if conflicts > 0 {
+			i.conflicts.Add(ctx, int64(conflicts), metric.WithAttributes(attribute.String("db.system.name", i.system)))
+		}
+		end(err, attribute.Int64("sqlitekv.rows_affected", rows), attribute.Int("sqlitekv.version_conflicts", conflicts))
+	}()
+	return i.db.Mutate(ctx, mutations...)
+}
+
+func (i *Instrumented) QueryScalarInt64(ctx context.Context, sql string, args map[string]any) (n int64, err error) {
+	ctx, end := i.start(ctx, "QueryScalarInt64", []string{sql})
+	defer func() {
+		end(err)
+	}()
+	return i.db.QueryScalarInt64(ctx, sql, args)
+}
+
+// start starts a span for the operation, and returns a function that ends it and records its duration.
+func (i *Instrumented) start(ctx context.Context, operation string, sql []string) (context.Context, func(err error, attrs ...attribute.KeyValue)) {
+	started := time.Now()
+	common := []attribute.KeyValue{
+		attribute.String("db.system.name", i.system),
+		attribute.String("db.operation.name", operation),
+	}
+	attrs := append(slices.Clone(common), attribute.StringSlice("sqlitekv.statement.kinds", statementKinds(sql)))
+	if len(sql) == 1 {
+		attrs = append(attrs, attribute.String("db.query.text", sql[0]))
+	} else {
+		attrs = append(attrs, attribute.Int("db.operation.batch.size", len(sql)))
+	}
+	ctx, span := i.tracer.Start(ctx, "sqlitekv."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	if i.system == "sqlite" {
+		ctx = context.WithValue(ctx, poolWaitKey{}, func(wait time.Duration) {
+			i.poolWait.Record(ctx, wait.Seconds(), metric.WithAttributes(common...))
+			span.SetAttributes(attribute.Float64("sqlitekv.pool.wait_time", wait.Seconds()))
+		})
+	}
+	return ctx, func(err error, attrs ...attribute.KeyValue) {
+		span.SetAttributes(attrs...)
+		if err != nil {
+			common = append(common, attribute.String("error.type", errorType(err)))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		i.duration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(common...))
+		span.End()
+	}
+}
+
+// errorType returns the error.type attribute of the error.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, db.ErrVersionMismatch):
+		return "version_mismatch"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "_OTHER"
+}
+
+// poolWaitKey is the context key of a function that Sqlite calls with the time spent waiting for a connection.
+type poolWaitKey struct{}
+
+// recordPoolWait passes the time spent waiting for a connection to the instrumentation, if the context has any.
+func recordPoolWait(ctx context.Context, wait time.Duration) {
+	if record, ok := ctx.Value(poolWaitKey{}).(func(time.Duration)); ok {
+		record(wait)
+	}
+}
+
+func systemOf(d db.DB) string {
+	switch d.(type) {
+	case *Sqlite:
+		return "sqlite"
+	case *Rqlite:
+		return "rqlite"
+	}
+	return "other_sql"
+}
+
+func querySQL(queries []db.Query) []string {
+	sql := make([]string, len(queries))
+	for i, q := range queries {
+		sql[i] = q.SQL
+	}
+	return sql
+}
+
+// statementKinds returns the distinct first keywords of the SQL statements, e.g. "select" or "insert", in order.
+func statementKinds(sql []string) (kinds []string) {
+	for _, s := range sql {
+		var kind string
+		if fields := strings.Fields(s); len(fields) > 0 {
+			kind = strings.ToLower(strings.TrimRight(fields[0], ";("))
+		}
+		if !slices.Contains(kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
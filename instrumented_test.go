@@ -0,0 +1,122 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestInstrumented(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:instrumented?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	store := NewStore(NewInstrumented(NewSqlite(pool), WithTracerProvider(tp), WithMeterProvider(mp)))
+	t.Run("Store", func(t *testing.T) {
+		runStoreTests(t, store)
+	})
+
+	ctx := context.Background()
+	// Load the JSON Schemas, which are cached by the store.
+	if err = store.ValidateValue(ctx, "instrumented", Person{Name: "Alice"}); err != nil {
+		t.Fatalf("unexpected error validating data: %v", err)
+	}
+	exporter.Reset()
+	if err = store.Put(ctx, "instrumented", -1, Person{Name: "Alice"}); err != nil {
+		t.Fatalf("unexpected error putting data: %v", err)
+	}
+	if _, _, err = store.Get(ctx, "instrumented", &Person{}); err != nil {
+		t.Fatalf("unexpected error getting data: %v", err)
+	}
+	if err = store.Put(ctx, "instrumented", 5, Person{Name: "Bob"}); !errors.Is(err, db.ErrVersionMismatch) {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if _, err = store.Delete(ctx, "instrumented"); err != nil {
+		t.Fatalf("unexpected error deleting data: %v", err)
+	}
+
+	t.Run("A span is created for each call", func(t *testing.T) {
+		spans := exporter.GetSpans()
+		names := make([]string, len(spans))
+		for i, span := range spans {
+			names[i] = span.Name
+		}
+		expected := []string{"sqlitekv.Mutate", "sqlitekv.Query", "sqlitekv.Mutate", "sqlitekv.Mutate"}
+		if !slices.Equal(names, expected) {
+			t.Fatalf("expected spans %v, got %v", expected, names)
+		}
+		attrs := attribute.NewSet(spans[1].Attributes...)
+		if v, _ := attrs.Value("db.system.name"); v.AsString() != "sqlite" {
+			t.Errorf("expected sqlite system, got %q", v.AsString())
+		}
+		if v, _ := attrs.Value("sqlitekv.statement.kinds"); !slices.Equal(v.AsStringSlice(), []string{"select"}) {
+			t.Errorf("expected select statement, got %v", v.AsStringSlice())
+		}
+		if v, _ := attrs.Value("db.response.returned_rows"); v.AsInt64() != 1 {
+			t.Errorf("expected 1 row returned, got %d", v.AsInt64())
+		}
+		if !attrs.HasValue("sqlitekv.pool.wait_time") {
+			t.Error("expected pool wait time")
+		}
+		if spans[2].Status.Code != codes.Error || len(spans[2].Events) != 1 {
+			t.Errorf("expected the version mismatch to be recorded, got %v", spans[2].Status)
+		}
+		attrs = attribute.NewSet(spans[3].Attributes...)
+		if v, _ := attrs.Value("sqlitekv.rows_affected"); v.AsInt64() != 1 {
+			t.Errorf("expected 1 row affected, got %d", v.AsInt64())
+		}
+	})
+	t.Run("Metrics are recorded", func(t *testing.T) {
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(ctx, &rm); err != nil {
+			t.Fatalf("unexpected error collecting metrics: %v", err)
+		}
+		metrics := map[string]metricdata.Aggregation{}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m.Data
+			}
+		}
+		duration, ok := metrics["db.client.operation.duration"].(metricdata.Histogram[float64])
+		if !ok || len(duration.DataPoints) == 0 {
+			t.Errorf("expected operation durations, got %v", metrics["db.client.operation.duration"])
+		}
+		conflicts, ok := metrics["sqlitekv.version_conflicts"].(metricdata.Sum[int64])
+		if !ok || len(conflicts.DataPoints) != 1 || conflicts.DataPoints[0].Value == 0 {
+			t.Errorf("expected version conflicts, got %v", metrics["sqlitekv.version_conflicts"])
+		}
+		poolWait, ok := metrics["sqlitekv.pool.wait_time"].(metricdata.Histogram[float64])
+		if !ok || len(poolWait.DataPoints) == 0 {
+			t.Errorf("expected pool wait times, got %v", metrics["sqlitekv.pool.wait_time"])
+		}
+	})
+}
+
+func TestStatementKinds(t *testing.T) {
+	kinds := statementKinds([]string{
+		"select key from kv;",
+		"insert into kv (key) values (:key);",
+		"\n\tSELECT\ncount(*) from kv;",
+		"with x as (select 1) select * from x;",
+	})
+	if expected := []string{"select", "insert", "with"}; !slices.Equal(kinds, expected) {
+		t.Errorf("expected %v, got %v", expected, kinds)
+	}
+}
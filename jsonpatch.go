@@ -0,0 +1,258 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// decodeJSONPatch converts the value of a json-patch input into operations.
+func decodeJSONPatch(v any) (ops []db.JSONPatchOperation, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&ops); err != nil {
+		return nil, fmt.Errorf("invalid json patch: %w", err)
+	}
+	return ops, nil
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902) to a copy of the document.
+// If any operation fails, including a test operation, an error is returned.
+func applyJSONPatch(doc any, ops []db.JSONPatchOperation) (any, error) {
+	doc = copyJSON(doc)
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, op.Path, copyJSON(op.Value))
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, op.Path)
+		case "replace":
+			if doc, _, err = jsonPointerRemove(doc, op.Path); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, copyJSON(op.Value))
+			}
+		case "move":
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				err = fmt.Errorf("cannot move %q into one of its children", op.From)
+				break
+			}
+			var v any
+			if doc, v, err = jsonPointerRemove(doc, op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, v)
+			}
+		case "copy":
+			var v any
+			if v, err = jsonPointerGet(doc, op.From); err == nil {
+				doc, err = jsonPointerAdd(doc, op.Path, copyJSON(v))
+			}
+		case "test":
+			var v any
+			if v, err = jsonPointerGet(doc, op.Path); err == nil && !jsonEqual(v, op.Value) {
+				err = db.ErrJSONPatchTestFailed
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("json patch operation %d (%s %q): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// parseJSONPointer parses a JSON Pointer (RFC 6901) into its reference tokens.
+func parseJSONPointer(pointer string) (tokens []string, err error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", pointer)
+	}
+	tokens = strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func parseArrayIndex(token string, length int) (int, error) {
+	if token == "-" {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(doc any, pointer string) (v any, err error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	v = doc
+	for _, t := range tokens {
+		if v, err = jsonChild(v, t); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func jsonChild(node any, token string) (any, error) {
+	switch node := node.(type) {
+	case map[string]any:
+		v, ok := node[token]
+		if !ok {
+			return nil, fmt.Errorf("path not found: %q", token)
+		}
+		return v, nil
+	case []any:
+		i, err := parseArrayIndex(token, len(node))
+		if err != nil {
+			return nil, err
+		}
+		if i >= len(node) {
+			return nil, fmt.Errorf("array index %d out of range", i)
+		}
+		return node[i], nil
+	}
+	return nil, fmt.Errorf("path not found: %q", token)
+}
+
+// jsonPointerUpdate calls fn with the parent of the location referenced by the pointer and the
+// last reference token, and replaces the parent with the result.
+func jsonPointerUpdate(node any, tokens []string, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+	child, err := jsonChild(node, tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = jsonPointerUpdate(child, tokens[1:], fn); err != nil {
+		return nil, err
+	}
+	switch node := node.(type) {
+	case map[string]any:
+		node[tokens[0]] = child
+	case []any:
+		i, _ := parseArrayIndex(tokens[0], len(node))
+		node[i] = child
+	}
+	return node, nil
+}
+
+func jsonPointerAdd(doc any, pointer string, value any) (any, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, tokens, func(parent any, token string) (any, error) {
+		switch parent := parent.(type) {
+		case map[string]any:
+			parent[token] = value
+			return parent, nil
+		case []any:
+			i, err := parseArrayIndex(token, len(parent))
+			if err != nil {
+				return nil, err
+			}
+			if i > len(parent) {
+				return nil, fmt.Errorf("array index %d out of range", i)
+			}
+			return append(parent[:i], append([]any{value}, parent[i:]...)...), nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a value that is not an object or array", token)
+	})
+}
+
+func jsonPointerRemove(doc any, pointer string) (updated, removed any, err error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	updated, err = jsonPointerUpdate(doc, tokens, func(parent any, token string) (any, error) {
+		var err error
+		if removed, err = jsonChild(parent, token); err != nil {
+			return nil, err
+		}
+		switch parent := parent.(type) {
+		case map[string]any:
+			delete(parent, token)
+			return parent, nil
+		case []any:
+			i, _ := parseArrayIndex(token, len(parent))
+			return append(parent[:i], parent[i+1:]...), nil
+		}
+		return parent, nil
+	})
+	return updated, removed, err
+}
+
+// copyJSON returns a deep copy of a decoded JSON value, so that it can be modified in place.
+func copyJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, child := range v {
+			m[k] = copyJSON(child)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, child := range v {
+			s[i] = copyJSON(child)
+		}
+		return s
+	}
+	return v
+}
+
+// jsonEqual compares decoded JSON values, treating numbers as equal if they have the same value.
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(normalizeJSONNumbers(a), normalizeJSONNumbers(b))
+}
+
+func normalizeJSONNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v.String()
+		}
+		return f
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, child := range v {
+			m[k] = normalizeJSONNumbers(child)
+		}
+		return m
+	case []any:
+		s := make([]any, len(v))
+		for i, child := range v {
+			s[i] = normalizeJSONNumbers(child)
+		}
+		return s
+	}
+	return v
+}
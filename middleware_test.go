@@ -0,0 +1,159 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMiddleware(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:middleware?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var logs bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var slow []db.SlowQuery
+	store := NewStore(NewSqlite(pool), WithMiddleware(
+		db.Logging(log, db.LoggingOptions{}),
+		db.SlowQueries(0, func(ctx context.Context, q db.SlowQuery) { slow = append(slow, q) }),
+		db.Timeout(time.Second, time.Second),
+	))
+	t.Run("Store", func(t *testing.T) {
+		runStoreTests(t, store)
+	})
+
+	ctx := context.Background()
+	t.Run("Calls are logged with values redacted", func(t *testing.T) {
+		logs.Reset()
+		if err := store.Put(ctx, "middleware", -1, Person{Name: "Alice"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+		output := logs.String()
+		if !strings.Contains(output, `"msg":"Mutate"`) || !strings.Contains(output, `":key":"middleware"`) {
+			t.Errorf("expected the mutation to be logged, got %s", output)
+		}
+		if strings.Contains(output, "Alice") || !strings.Contains(output, `":value":"[REDACTED]"`) {
+			t.Errorf("expected the value to be redacted, got %s", output)
+		}
+		if _, err := store.Delete(ctx, "middleware"); err != nil {
+			t.Fatalf("unexpected error deleting data: %v", err)
+		}
+	})
+	t.Run("Blob chunks and filter literals are redacted", func(t *testing.T) {
+		logs.Reset()
+		if _, err := store.PutBlob(ctx, "middleware/blob", -1, strings.NewReader("secret blob")); err != nil {
+			t.Fatalf("unexpected error putting blob: %v", err)
+		}
+		if err := store.Put(ctx, "middleware/person", -1, Person{Name: "Alice"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+		if _, err := store.Find(ctx, "middleware/", `name == "Alice"`, "", 0, -1); err != nil {
+			t.Fatalf("unexpected error finding data: %v", err)
+		}
+		output := logs.String()
+		if strings.Contains(output, base64.StdEncoding.EncodeToString([]byte("secret blob"))) || !strings.Contains(output, `":data":"[REDACTED]"`) {
+			t.Errorf("expected the blob chunk to be redacted, got %s", output)
+		}
+		if strings.Contains(output, "Alice") || !strings.Contains(output, `":filter_`) {
+			t.Errorf("expected the filter literal to be redacted, got %s", output)
+		}
+		if !strings.Contains(output, `":chunk":0`) {
+			t.Errorf("expected the chunk index to be logged, got %s", output)
+		}
+		if _, err := store.DeletePrefix(ctx, "middleware/", 0, -1); err != nil {
+			t.Fatalf("unexpected error deleting data: %v", err)
+		}
+	})
+	t.Run("Slow queries are reported", func(t *testing.T) {
+		slow = nil
+		if _, err := store.Count(ctx); err != nil {
+			t.Fatalf("unexpected error counting: %v", err)
+		}
+		if len(slow) != 1 || slow[0].Operation != "QueryScalarInt64" || len(slow[0].SQL) != 1 {
+			t.Errorf("expected the count to be reported, got %+v", slow)
+		}
+	})
+	t.Run("Calls can be rewritten", func(t *testing.T) {
+		// Prefix every key with a tenant.
+		tenant := db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+			for i, m := range call.Mutations {
+				if key, ok := m.Args[":key"].(string); ok {
+					args := map[string]any{}
+					for k, v := range m.Args {
+						args[k] = v
+					}
+					args[":key"] = "tenant/" + key
+					call.Mutations[i].Args = args
+				}
+			}
+			return next(ctx, call)
+		})
+		s := NewStore(store.db, WithMiddleware(tenant))
+		if err := s.Put(ctx, "a", -1, Person{Name: "Alice"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+		if _, ok, err := store.Get(ctx, "tenant/a", &Person{}); err != nil || !ok {
+			t.Errorf("expected key to be rewritten, got ok=%v, err=%v", ok, err)
+		}
+		if _, err := store.DeletePrefix(ctx, "tenant/", 0, -1); err != nil {
+			t.Fatalf("unexpected error deleting data: %v", err)
+		}
+	})
+	t.Run("Faults can be injected", func(t *testing.T) {
+		errInjected := errors.New("injected")
+		fail := db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+			return 0, errInjected
+		})
+		logs.Reset()
+		s := NewStore(NewSqlite(pool), WithMiddleware(db.Logging(log, db.LoggingOptions{}), fail))
+		if _, _, err := s.Get(ctx, "a", &Person{}); !errors.Is(err, errInjected) {
+			t.Errorf("expected injected error, got %v", err)
+		}
+		if !strings.Contains(logs.String(), `"level":"ERROR"`) {
+			t.Errorf("expected the error to be logged, got %s", logs.String())
+		}
+	})
+	t.Run("Calls time out", func(t *testing.T) {
+		block := db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+		s := NewStore(NewSqlite(pool), WithMiddleware(db.Timeout(time.Millisecond, 0), block))
+		if _, _, err := s.Get(ctx, "a", &Person{}); !errors.Is(err, db.ErrTimeout) {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	})
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	named := func(name string) db.Middleware {
+		return db.Intercept(func(ctx context.Context, call db.Call, next db.Handler) (rows int, err error) {
+			calls = append(calls, name)
+			return next(ctx, call)
+		})
+	}
+	pool, err := sqlitex.NewPool("file:chain?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	d := db.Chain(named("a"), named("b"), named("c"))(NewSqlite(pool))
+	if _, err = d.QueryScalarInt64(context.Background(), "select 1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(calls, "") != "abc" {
+		t.Errorf("expected middleware to be called in order, got %v", calls)
+	}
+}
@@ -0,0 +1,95 @@
+package sqlitekv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// Migrate applies the migrations that haven't been applied to the store's tables, in version order,
+// and returns the migrations that were applied. The version of each applied migration is recorded
+// in the schema_version table.
+//
+// Each migration is applied in a single transaction. Migrate can be run by more than one process at
+// the same time, e.g. on each node of an rqlite cluster. If another process applies a migration
+// first, the migration is skipped.
+func (s *Store) Migrate(ctx context.Context) (applied []db.Migration, err error) {
+	if _, err = s.db.Mutate(ctx, db.CreateSchemaVersionTable()); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		mutations := m.Mutations()
+		if m.Version == 1 {
+			// Databases created before migrations were added may be missing columns that were added since.
+			legacy, err := s.addMissingColumns(ctx)
+			if err != nil {
+				return applied, fmt.Errorf("migrate: %v: %w", m, err)
+			}
+			mutations = append(mutations, legacy...)
+		}
+		if _, err = s.db.Mutate(ctx, mutations...); err != nil {
+			if version, versionErr := s.schemaVersion(ctx); versionErr == nil && version >= m.Version {
+				// Another process applied the migration.
+				continue
+			}
+			return applied, fmt.Errorf("migrate: %v: %w", m, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// PendingMigrations returns the migrations that haven't been applied to the store's tables, in version order.
+// It doesn't make any changes to the store.
+func (s *Store) PendingMigrations(ctx context.Context) (pending []db.Migration, err error) {
+	migrations, err := db.Migrations()
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	version, err := s.schemaVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// schemaVersion returns the version of the latest migration that has been applied, or 0 if none have been applied.
+func (s *Store) schemaVersion(ctx context.Context) (version int, err error) {
+	q := db.CountSchemaVersionTable()
+	n, err := s.db.QueryScalarInt64(ctx, q.SQL, q.Args)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	q = db.GetSchemaVersion()
+	n, err = s.db.QueryScalarInt64(ctx, q.SQL, q.Args)
+	return int(n), err
+}
+
+// addMissingColumns returns the mutations that add the columns that are missing from an existing kv table.
+func (s *Store) addMissingColumns(ctx context.Context) (mutations []db.Mutation, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.GetColumns())
+	if err != nil {
+		return nil, err
+	}
+	if len(outputs[0].Values) == 0 {
+		// The table doesn't exist yet.
+		return nil, nil
+	}
+	var columns []string
+	for _, row := range outputs[0].Values {
+		if name, ok := row[0].(string); ok {
+			columns = append(columns, name)
+		}
+	}
+	return db.AddColumns(columns), nil
+}
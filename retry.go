@@ -0,0 +1,63 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// RetryPolicy is the policy for retrying calls that fail because the database is busy or locked.
+// Retries wait for an exponentially increasing, jittered backoff.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first. Zero or one disables retries.
+	MaxAttempts int
+	// InitialBackoff is the maximum wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum wait before any retry.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used by NewSqlite.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     500 * time.Millisecond,
+}
+
+// isRetryable returns true if the error is caused by lock contention, so the call can be retried.
+func isRetryable(err error) bool {
+	return errors.Is(err, db.ErrBusy) || errors.Is(err, db.ErrLocked)
+}
+
+// do calls f until it succeeds, returns an error that isn't retryable, or the attempts are used up.
+func (p RetryPolicy) do(ctx context.Context, f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		t := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns the wait before the retry that follows the attempt, which is a random duration
+// between half of, and all of, the exponential backoff.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff << (attempt - 1)
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
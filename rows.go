@@ -0,0 +1,162 @@
+package sqlitekv
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// RowsOf returns the rows, with each row scanned into a type.
+//
+// If the type is a struct, columns are matched to fields using the json tag of the field, or the
+// name of the field if it has no tag. Columns that don't match a field are ignored. Text and blob
+// columns that contain JSON can be scanned into struct, map and slice fields, and text columns
+// that contain RFC3339 timestamps can be scanned into time.Time fields.
+//
+// Use map[string]any if you don't know the type.
+func RowsOf[T any](rows db.Rows) (values []T, err error) {
+	values = make([]T, len(rows.Values))
+	for i, row := range rows.Values {
+		if len(row) != len(rows.Columns) {
+			return nil, fmt.Errorf("row %d: expected %d columns, got %d", i, len(rows.Columns), len(row))
+		}
+		if err = scanRow(rows.Columns, row, reflect.ValueOf(&values[i]).Elem()); err != nil {
+			return nil, fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+	return values, nil
+}
+
+func scanRow(columns []string, row []any, dst reflect.Value) (err error) {
+	switch dst.Kind() {
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %v", dst.Type().Key())
+		}
+		dst.Set(reflect.MakeMapWithSize(dst.Type(), len(columns)))
+		for i, column := range columns {
+			v := reflect.New(dst.Type().Elem()).Elem()
+			if err = scanValue(row[i], v); err != nil {
+				return fmt.Errorf("column %q: %w", column, err)
+			}
+			dst.SetMapIndex(reflect.ValueOf(column).Convert(dst.Type().Key()), v)
+		}
+		return nil
+	case reflect.Struct:
+		fields := fieldsByColumn(dst.Type())
+		for i, column := range columns {
+			index, ok := fields[column]
+			if !ok {
+				continue
+			}
+			if err = scanValue(row[i], dst.FieldByIndex(index)); err != nil {
+				return fmt.Errorf("column %q: %w", column, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported type %v, expected a struct or map", dst.Type())
+}
+
+// fieldsByColumn returns the index of each exported field of a struct, keyed by column name.
+func fieldsByColumn(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int, t.NumField())
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name := f.Name
+		if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = f.Index
+	}
+	return fields
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func scanValue(src any, dst reflect.Value) error {
+	if src == nil {
+		dst.SetZero()
+		return nil
+	}
+	if dst.Kind() == reflect.Pointer {
+		v := reflect.New(dst.Type().Elem())
+		if err := scanValue(src, v.Elem()); err != nil {
+			return err
+		}
+		dst.Set(v)
+		return nil
+	}
+	if dst.Kind() == reflect.Interface {
+		dst.Set(reflect.ValueOf(src))
+		return nil
+	}
+	switch src := src.(type) {
+	case int64:
+		switch dst.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dst.SetInt(src)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			dst.SetUint(uint64(src))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(float64(src))
+			return nil
+		case reflect.Bool:
+			dst.SetBool(src != 0)
+			return nil
+		}
+	case float64:
+		switch dst.Kind() {
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(src)
+			return nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if src == float64(int64(src)) {
+				dst.SetInt(int64(src))
+				return nil
+			}
+		}
+	case string:
+		return scanBytes([]byte(src), dst)
+	case []byte:
+		return scanBytes(src, dst)
+	}
+	return fmt.Errorf("cannot scan %T into %v", src, dst.Type())
+}
+
+func scanBytes(src []byte, dst reflect.Value) error {
+	switch {
+	case dst.Kind() == reflect.String:
+		dst.SetString(string(src))
+		return nil
+	case dst.Type() == rawMessageType:
+		dst.SetBytes(append(json.RawMessage{}, src...))
+		return nil
+	case dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8:
+		dst.SetBytes(append([]byte{}, src...))
+		return nil
+	case dst.Type() == timeType:
+		t, err := time.Parse(time.RFC3339Nano, string(src))
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	case dst.Kind() == reflect.Struct, dst.Kind() == reflect.Map, dst.Kind() == reflect.Slice:
+		return json.Unmarshal(src, dst.Addr().Interface())
+	}
+	return fmt.Errorf("cannot scan text into %v", dst.Type())
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,13 +22,112 @@ func NewRqlite(client *rqlitehttp.Client) *Rqlite {
 }
 
 type Rqlite struct {
-	Client          *rqlitehttp.Client
-	Timeout         time.Duration
+	Client  *rqlitehttp.Client
+	Timeout time.Duration
+	// ReadConsistency is the read consistency level of queries, unless it's overridden by WithRqliteReadOptions.
 	ReadConsistency rqlitehttp.ReadConsistencyLevel
+	// cluster is set by NewRqliteFromAddresses, and routes requests to the nodes of the cluster.
+	cluster *rqliteCluster
 }
 
 func (r *Rqlite) isDB() db.DB { return r }
 
+// do calls f with the client of the node that should handle the request. If the Rqlite was created
+// by NewRqliteFromAddresses, f is called again with another node if the node is unavailable,
+// otherwise f is called with the Client.
+func (rq *Rqlite) do(ctx context.Context, write bool, f func(client *rqlitehttp.Client) error) error {
+	if rq.cluster == nil {
+		return f(rq.Client)
+	}
+	return rq.cluster.do(ctx, write, f)
+}
+
+// RqliteReadOptions are the options of the queries made with a context returned by WithRqliteReadOptions.
+// See https://rqlite.io/docs/api/read-consistency/.
+type RqliteReadOptions struct {
+	// Level is the read consistency level. If it's not set, the Rqlite's ReadConsistency is used.
+	Level rqlitehttp.ReadConsistencyLevel
+	// Freshness is the longest time since the node last heard from the leader, for queries with the
+	// none level. If the node hasn't heard from the leader for longer, the query fails. Zero means no limit.
+	Freshness time.Duration
+	// FreshnessStrict also fails queries if the node's data was last changed longer than Freshness ago,
+	// so that the data is known to be no older than Freshness.
+	FreshnessStrict bool
+	// LinearizableTimeout is how long linearizable queries wait for the leader to confirm that it's
+	// still the leader. Zero uses rqlite's default.
+	LinearizableTimeout time.Duration
+}
+
+type rqliteReadOptionsKey struct{}
+
+// WithRqliteReadOptions returns a context that makes Rqlite queries made with it use the options,
+// e.g. to make a read that can be served by any node, without contacting the leader:
+//
+//	ctx = sqlitekv.WithRqliteReadOptions(ctx, sqlitekv.RqliteReadOptions{
+//		Level:     rqlitehttp.ReadConsistencyLevelNone,
+//		Freshness: time.Second,
+//	})
+//	r, ok, err := store.Get(ctx, "key", &v)
+func WithRqliteReadOptions(ctx context.Context, opts RqliteReadOptions) context.Context {
+	return context.WithValue(ctx, rqliteReadOptionsKey{}, opts)
+}
+
+// RqliteWriteOptions are the options of the mutations made with a context returned by WithRqliteWriteOptions.
+type RqliteWriteOptions struct {
+	// Queue adds the mutations to the node's write queue, and returns before they've been committed.
+	// rqlite commits the queue in batches, so that many small writes can be ingested quickly.
+	//
+	// Queued mutations aren't checked for version mismatches, and the number of rows they affect isn't
+	// returned. If they fail, the error isn't returned. Use Flush to wait for the queue to be committed.
+	// See https://rqlite.io/docs/api/queued-writes/.
+	Queue bool
+	// Wait makes queued mutations return once they've been committed.
+	Wait bool
+}
+
+type rqliteWriteOptionsKey struct{}
+
+// WithRqliteWriteOptions returns a context that makes Rqlite mutations made with it use the options.
+func WithRqliteWriteOptions(ctx context.Context, opts RqliteWriteOptions) context.Context {
+	return context.WithValue(ctx, rqliteWriteOptionsKey{}, opts)
+}
+
+// ParseReadConsistencyLevel parses an rqlite read consistency level, e.g. "none", "weak", "strong",
+// "linearizable" or "auto".
+func ParseReadConsistencyLevel(s string) (level rqlitehttp.ReadConsistencyLevel, err error) {
+	for _, level := range []rqlitehttp.ReadConsistencyLevel{
+		rqlitehttp.ReadConsistencyLevelNone,
+		rqlitehttp.ReadConsistencyLevelWeak,
+		rqlitehttp.ReadConsistencyLevelStrong,
+		rqlitehttp.ReadConsistencyLevelLinearizable,
+		rqlitehttp.ReadConsistencyLevelAuto,
+	} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return level, fmt.Errorf("unknown read consistency level %q", s)
+}
+
+// queryOptions returns the options of queries made with the context.
+func (rq *Rqlite) queryOptions(ctx context.Context) *rqlitehttp.QueryOptions {
+	opts := &rqlitehttp.QueryOptions{
+		Timeout: rq.Timeout,
+		Level:   rq.ReadConsistency,
+		// Return blobs as arrays of bytes, so that values stored as blobs can be distinguished from JSON text.
+		BlobAsArray: true,
+	}
+	if ro, ok := ctx.Value(rqliteReadOptionsKey{}).(RqliteReadOptions); ok {
+		if ro.Level != rqlitehttp.ReadConsistencyLevelUnknown {
+			opts.Level = ro.Level
+		}
+		opts.Freshness = ro.Freshness
+		opts.FreshnessStrict = ro.FreshnessStrict
+		opts.LinearizableTimeout = ro.LinearizableTimeout
+	}
+	return opts
+}
+
 func (rq *Rqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]db.Record, err error) {
 	stmts := make(rqlitehttp.SQLStatements, len(queries))
 	for i, query := range queries {
@@ -35,11 +136,12 @@ func (rq *Rqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]d
 			NamedParams: convertToRqlite(query.Args),
 		}
 	}
-	opts := &rqlitehttp.QueryOptions{
-		Timeout: rq.Timeout,
-		Level:   rq.ReadConsistency,
-	}
-	qr, err := rq.Client.Query(ctx, stmts, opts)
+	opts := rq.queryOptions(ctx)
+	var qr *rqlitehttp.QueryResponse
+	err = rq.do(ctx, false, func(client *rqlitehttp.Client) (err error) {
+		qr, err = client.Query(ctx, stmts, opts)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
@@ -48,12 +150,13 @@ func (rq *Rqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]d
 		if result.Error != "" {
 			return nil, fmt.Errorf("query: index %d: %s", i, result.Error)
 		}
-		if err := checkResultColumns(result); err != nil {
+		indices, err := checkResultColumns(result)
+		if err != nil {
 			return nil, fmt.Errorf("query: %w", err)
 		}
 		outputs[i] = make([]db.Record, len(result.Values))
 		for j, values := range result.Values {
-			r, err := newRowFromValues(values)
+			r, err := newRowFromValues(values, indices)
 			if err != nil {
 				return nil, fmt.Errorf("query: index %d: row %d: %w", i, j, err)
 			}
@@ -63,32 +166,130 @@ func (rq *Rqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]d
 	return outputs, nil
 }
 
-func checkResultColumns(result rqlitehttp.QueryResult) (err error) {
-	if len(result.Columns) != 4 {
-		return fmt.Errorf("record: expected 4 columns, got %d", len(result.Columns))
+func (rq *Rqlite) QueryRows(ctx context.Context, queries ...db.Query) (outputs []db.Rows, err error) {
+	stmts := make(rqlitehttp.SQLStatements, len(queries))
+	for i, query := range queries {
+		stmts[i] = &rqlitehttp.SQLStatement{
+			SQL:         query.SQL,
+			NamedParams: convertToRqlite(query.Args),
+		}
 	}
-	if result.Columns[0] != "key" || result.Columns[1] != "version" || result.Columns[2] != "value" || result.Columns[3] != "created" {
-		return fmt.Errorf("record: expected id, key, version, value and created columns not found, got: %#v", result.Columns)
+	opts := rq.queryOptions(ctx)
+	var qr *rqlitehttp.QueryResponse
+	err = rq.do(ctx, false, func(client *rqlitehttp.Client) (err error) {
+		qr, err = client.Query(ctx, stmts, opts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
 	}
-	return nil
+	outputs = make([]db.Rows, len(qr.GetQueryResults()))
+	for i, result := range qr.GetQueryResults() {
+		if result.Error != "" {
+			return nil, fmt.Errorf("query: index %d: %s", i, result.Error)
+		}
+		outputs[i].Columns = result.Columns
+		outputs[i].Values = make([][]any, len(result.Values))
+		for j, values := range result.Values {
+			outputs[i].Values[j] = make([]any, len(values))
+			for k, v := range values {
+				var declaredType string
+				if k < len(result.Types) {
+					declaredType = result.Types[k]
+				}
+				if outputs[i].Values[j][k], err = convertFromRqlite(v, declaredType); err != nil {
+					return nil, fmt.Errorf("query: index %d: row %d: column %q: %w", i, j, result.Columns[k], err)
+				}
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// convertFromRqlite converts a value returned by rqlite to the type that the Sqlite implementation would return.
+//
+// rqlite returns all numbers as JSON numbers, so the declared type of the column is used to determine whether the
+// number is an integer. Computed columns have no declared type, so whole numbers are returned as int64 values.
+func convertFromRqlite(v any, declaredType string) (any, error) {
+	switch v := v.(type) {
+	case float64:
+		declaredType = strings.ToLower(declaredType)
+		isReal := strings.Contains(declaredType, "real") || strings.Contains(declaredType, "floa") || strings.Contains(declaredType, "doub")
+		if !isReal && v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+		return v, nil
+	case []any:
+		b := make([]byte, len(v))
+		for i, n := range v {
+			f, ok := n.(float64)
+			if !ok {
+				return nil, fmt.Errorf("blob: expected byte values, got %T", n)
+			}
+			b[i] = byte(f)
+		}
+		return b, nil
+	case string, nil:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unexpected type %T", v)
+	}
+}
+
+// recordColumns are the columns of a record. The encoding column is optional.
+var recordColumns = []string{"key", "version", "value", "encoding", "created"}
+
+// checkResultColumns checks that the result contains the columns of a record, and returns the
+// index of each column in recordColumns order, or -1 if the optional encoding column is missing.
+func checkResultColumns(result rqlitehttp.QueryResult) (indices []int, err error) {
+	indices = []int{-1, -1, -1, -1, -1}
+	for i, c := range result.Columns {
+		if !slices.Contains(recordColumns, c) {
+			return nil, fmt.Errorf("record: unexpected column %q, expected key, version, value, encoding and created columns, got: %#v", c, result.Columns)
+		}
+		indices[slices.Index(recordColumns, c)] = i
+	}
+	for i, index := range indices {
+		if index == -1 && recordColumns[i] != "encoding" {
+			return nil, fmt.Errorf("record: expected key, version, value and created columns not found, got: %#v", result.Columns)
+		}
+	}
+	return indices, nil
 }
 
-func newRowFromValues(values []any) (r db.Record, err error) {
-	if len(values) != 4 {
-		return r, fmt.Errorf("row: expected 4 columns, got %d", len(values))
+func newRowFromValues(values []any, indices []int) (r db.Record, err error) {
+	get := func(column int) any {
+		if indices[column] < 0 || indices[column] >= len(values) {
+			return nil
+		}
+		return values[indices[column]]
 	}
 	var ok bool
-	r.Key, ok = values[0].(string)
+	r.Key, ok = get(0).(string)
 	if !ok {
-		return r, fmt.Errorf("row: key: expected string, got %T", values[1])
+		return r, fmt.Errorf("row: key: expected string, got %T", get(0))
 	}
-	if r.Version, err = tryGetInt64(values[1]); err != nil {
+	if r.Version, err = tryGetInt64(get(1)); err != nil {
 		return r, fmt.Errorf("row: version: %w", err)
 	}
-	if values[2] != nil {
-		r.Value = []byte(values[2].(string))
+	value, err := convertFromRqlite(get(2), "")
+	if err != nil {
+		return r, fmt.Errorf("row: value: %w", err)
+	}
+	switch value := value.(type) {
+	case string:
+		r.Value = []byte(value)
+	case []byte:
+		r.Value = value
+	}
+	if encoding, ok := get(3).(string); ok {
+		r.Encoding = encoding
+	}
+	created, ok := get(4).(string)
+	if !ok {
+		return r, fmt.Errorf("row: created: expected string, got %T", get(4))
 	}
-	r.Created, err = time.Parse(time.RFC3339Nano, values[3].(string))
+	r.Created, err = time.Parse(time.RFC3339Nano, created)
 	if err != nil {
 		return r, fmt.Errorf("row: failed to parse created time: %w", err)
 	}
@@ -116,15 +317,29 @@ func (rq *Rqlite) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAff
 		Wait:        true,
 		Timeout:     rq.Timeout,
 	}
-	qr, err := rq.Client.Execute(ctx, stmts, opts)
+	if wo, ok := ctx.Value(rqliteWriteOptionsKey{}).(RqliteWriteOptions); ok && wo.Queue {
+		opts.Queue = true
+		opts.Wait = wo.Wait
+	}
+	var qr *rqlitehttp.ExecuteResponse
+	err = rq.do(ctx, true, func(client *rqlitehttp.Client) (err error) {
+		qr, err = client.Execute(ctx, stmts, opts)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("mutate: %w", err)
 	}
+	if opts.Queue {
+		// Queued mutations don't return results.
+		return make([]int64, len(mutations)), nil
+	}
 	rowsAffected = make([]int64, len(qr.Results))
 	errs := make([]error, len(qr.Results))
+	var txErr error
 	for i, result := range qr.Results {
 		if result.Error != "" {
 			errs[i] = errors.New(result.Error)
+			txErr = errs[i]
 			continue
 		}
 		rowsAffected[i] = result.RowsAffected
@@ -132,19 +347,45 @@ func (rq *Rqlite) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAff
 			errs[i] = db.ErrVersionMismatch
 		}
 	}
+	if txErr != nil {
+		// The mutations are run in a transaction, which is rolled back if any of them fail.
+		rollBack(rowsAffected, errs, txErr)
+	}
 	return rowsAffected, newBatchError(errs)
 }
 
-func (rq *Rqlite) QueryScalarInt64(ctx context.Context, sql string, params map[string]any) (int64, error) {
-	opts := &rqlitehttp.QueryOptions{
+// Flush waits until the mutations that were queued before it was called have been committed, see
+// RqliteWriteOptions.Queue.
+func (rq *Rqlite) Flush(ctx context.Context) error {
+	// The queue is committed in order, so once a queued statement has been committed, so have the
+	// statements queued before it.
+	opts := &rqlitehttp.ExecuteOptions{
+		Queue:   true,
+		Wait:    true,
 		Timeout: rq.Timeout,
-		Level:   rq.ReadConsistency,
 	}
+	err := rq.do(ctx, true, func(client *rqlitehttp.Client) error {
+		_, err := client.Execute(ctx, rqlitehttp.SQLStatements{{SQL: "select 1"}}, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
+}
+
+func (rq *Rqlite) QueryScalarInt64(ctx context.Context, sql string, params map[string]any) (int64, error) {
+	opts := rq.queryOptions(ctx)
+	opts.BlobAsArray = false
 	q := &rqlitehttp.SQLStatement{
 		SQL:         sql,
 		NamedParams: convertToRqlite(params),
 	}
-	qr, err := rq.Client.Query(ctx, rqlitehttp.SQLStatements{q}, opts)
+	var qr *rqlitehttp.QueryResponse
+	err := rq.do(ctx, false, func(client *rqlitehttp.Client) (err error) {
+		qr, err = client.Query(ctx, rqlitehttp.SQLStatements{q}, opts)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -173,6 +414,15 @@ func convertToRqlite(args map[string]any) (updated map[string]any) {
 	}
 	updated = make(map[string]any, len(args))
 	for k, v := range args {
+		// Blobs are sent as arrays of byte values, because []byte is marshaled as a base64 string, which
+		// rqlite would bind as text.
+		if b, ok := v.([]byte); ok {
+			bytes := make([]int, len(b))
+			for i, c := range b {
+				bytes[i] = int(c)
+			}
+			v = bytes
+		}
 		updated[strings.TrimPrefix(k, ":")] = v
 	}
 	return updated
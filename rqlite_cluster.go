@@ -0,0 +1,401 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	rqlitehttp "github.com/rqlite/rqlite-go-http"
+)
+
+// ErrNoRqliteNodes is returned when none of the nodes of an rqlite cluster are available.
+var ErrNoRqliteNodes = errors.New("no rqlite nodes are available")
+
+// RqliteOptions configures NewRqliteFromAddresses.
+type RqliteOptions struct {
+	// HTTPClient is the client used to make requests. Its transport is wrapped, so that redirects to
+	// the leader are followed. If nil, rqlitehttp.DefaultHTTPClient is used.
+	HTTPClient *http.Client
+	// User and Password are the credentials used to authenticate with each node, if set.
+	User     string
+	Password string
+	// DiscoverNodes adds the other members of the cluster, and finds the leader, using the /nodes
+	// endpoint. Nodes are discovered before the first request, and again each time a node fails.
+	DiscoverNodes bool
+	// MinBackoff is how long a node that has failed is skipped before its health is checked. It doubles
+	// each time the node fails, up to MaxBackoff. The defaults are DefaultRqliteMinBackoff and
+	// DefaultRqliteMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRqliteMinBackoff and DefaultRqliteMaxBackoff are the default backoffs of nodes that have failed.
+const (
+	DefaultRqliteMinBackoff = 250 * time.Millisecond
+	DefaultRqliteMaxBackoff = 30 * time.Second
+)
+
+// maxRqliteRedirects is the number of redirects that are followed by a request.
+const maxRqliteRedirects = 5
+
+// NewRqliteFromAddresses creates an Rqlite that connects to the nodes of an rqlite cluster, e.g.
+// "http://node1:4001" and "http://node2:4001".
+//
+// Requests are sent to the leader, if it's known, and otherwise to the first node that's healthy.
+// Redirects to the leader are followed. If a node can't be reached, or responds that it's
+// unavailable, it's skipped until its backoff has passed and a health check of its /readyz endpoint
+// succeeds, and the request is sent to the next node. Mutations are only sent to another node if
+// the failed node can't have applied them, i.e. it couldn't be connected to, or it responded that
+// it's unavailable.
+func NewRqliteFromAddresses(addresses []string, opts RqliteOptions) (*Rqlite, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("rqlite: %w: no addresses", ErrNoRqliteNodes)
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = rqlitehttp.DefaultHTTPClient()
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultRqliteMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultRqliteMaxBackoff
+	}
+	c := &rqliteCluster{
+		opts:       opts,
+		now:        time.Now,
+		discovered: !opts.DiscoverNodes,
+	}
+	httpClient := *opts.HTTPClient
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &rqliteTransport{base: base, cluster: c}
+	c.httpClient = &httpClient
+	for _, address := range addresses {
+		if _, err := c.add(address); err != nil {
+			return nil, err
+		}
+	}
+	rq := NewRqlite(c.nodes[0].client)
+	rq.cluster = c
+	return rq, nil
+}
+
+// rqliteCluster is the set of nodes of an rqlite cluster, and their health.
+type rqliteCluster struct {
+	opts       RqliteOptions
+	httpClient *http.Client
+	now        func() time.Time
+
+	mutex      sync.Mutex
+	nodes      []*rqliteNode
+	leader     string
+	discovered bool
+}
+
+type rqliteNode struct {
+	address string
+	client  *rqlitehttp.Client
+	// failures is the number of consecutive failures of the node. If it's non-zero, the node is
+	// skipped until retryAt.
+	failures int
+	retryAt  time.Time
+}
+
+// normalizeRqliteAddress returns the scheme and host of the address, which identify a node.
+func normalizeRqliteAddress(address string) (string, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("rqlite: invalid address %q: %w", address, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("rqlite: invalid address %q: no host", address)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// add adds a node to the cluster, if it's not already a member, and returns its address. The caller
+// must hold the mutex, or be the constructor.
+func (c *rqliteCluster) add(address string) (string, error) {
+	address, err := normalizeRqliteAddress(address)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range c.nodes {
+		if n.address == address {
+			return address, nil
+		}
+	}
+	client, err := rqlitehttp.NewClient(address, c.httpClient)
+	if err != nil {
+		return "", fmt.Errorf("rqlite: %w", err)
+	}
+	if c.opts.User != "" || c.opts.Password != "" {
+		client.SetBasicAuth(c.opts.User, c.opts.Password)
+	}
+	c.nodes = append(c.nodes, &rqliteNode{address: address, client: client})
+	return address, nil
+}
+
+// do calls f with the client of the leader, or the first healthy node, and calls it again with the
+// next node if the node is unavailable.
+func (c *rqliteCluster) do(ctx context.Context, write bool, f func(client *rqlitehttp.Client) error) (err error) {
+	if c.needsDiscovery() {
+		c.discover(ctx)
+	}
+	tried := make(map[*rqliteNode]bool)
+	for {
+		n := c.next(ctx, tried)
+		if n == nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == nil {
+				return ErrNoRqliteNodes
+			}
+			return fmt.Errorf("%w: %w", ErrNoRqliteNodes, err)
+		}
+		tried[n] = true
+		err = f(n.client)
+		if ctx.Err() != nil {
+			// The caller's context is done, which says nothing about the health of the node.
+			return err
+		}
+		var unavailable *rqliteUnavailableError
+		if !errors.As(err, &unavailable) {
+			c.succeeded(n)
+			return err
+		}
+		c.failed(n)
+		if write && unavailable.maybeApplied {
+			return err
+		}
+		if c.opts.DiscoverNodes {
+			// The leader may have changed, or the node may have been removed from the cluster.
+			c.discover(ctx)
+		}
+	}
+}
+
+func (c *rqliteCluster) needsDiscovery() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.discovered
+}
+
+// next returns the node to send a request to, or nil if there are no more nodes to try. Nodes that
+// have failed are skipped until their backoff has passed, and then health checked.
+func (c *rqliteCluster) next(ctx context.Context, tried map[*rqliteNode]bool) *rqliteNode {
+	c.mutex.Lock()
+	var candidates []*rqliteNode
+	// The leader is tried first, because followers forward requests to it.
+	for _, n := range c.nodes {
+		if n.address == c.leader && !tried[n] {
+			candidates = append(candidates, n)
+		}
+	}
+	for _, n := range c.nodes {
+		if n.address != c.leader && !tried[n] {
+			candidates = append(candidates, n)
+		}
+	}
+	// Nodes that have failed keep their place in the order, so that they're used again once they've
+	// recovered.
+	now := c.now()
+	down := make(map[*rqliteNode]bool)
+	for _, n := range candidates {
+		down[n] = n.failures > 0
+		if down[n] && now.Before(n.retryAt) {
+			tried[n] = true
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, n := range candidates {
+		if tried[n] {
+			continue
+		}
+		if !down[n] {
+			return n
+		}
+		tried[n] = true
+		if _, err := n.client.Ready(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			c.failed(n)
+			continue
+		}
+		c.succeeded(n)
+		return n
+	}
+	return nil
+}
+
+func (c *rqliteCluster) succeeded(n *rqliteNode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n.failures = 0
+}
+
+// failed skips the node until its backoff has passed.
+func (c *rqliteCluster) failed(n *rqliteNode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n.failures++
+	backoff := c.opts.MinBackoff << min(n.failures-1, 30)
+	if backoff <= 0 || backoff > c.opts.MaxBackoff {
+		backoff = c.opts.MaxBackoff
+	}
+	n.retryAt = c.now().Add(backoff)
+	if n.address == c.leader {
+		c.leader = ""
+	}
+}
+
+// redirected records that a node redirected a request to the leader.
+func (c *rqliteCluster) redirected(location *url.URL) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if address, err := c.add(location.String()); err == nil {
+		c.leader = address
+	}
+}
+
+// discover adds the members of the cluster, and finds the leader, using the /nodes endpoint of the
+// first node that responds.
+func (c *rqliteCluster) discover(ctx context.Context) {
+	c.mutex.Lock()
+	c.discovered = true
+	nodes := make([]*rqliteNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.failures == 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, n := range nodes {
+		raw, err := n.client.Nodes(ctx)
+		if err != nil {
+			continue
+		}
+		members, err := parseRqliteNodes(raw)
+		if err != nil {
+			continue
+		}
+		c.mutex.Lock()
+		for _, m := range members {
+			address, err := c.add(m.APIAddr)
+			if err == nil && m.Leader {
+				c.leader = address
+			}
+		}
+		c.mutex.Unlock()
+		return
+	}
+	if ctx.Err() != nil {
+		// Discover again on the next request, because the nodes weren't asked.
+		c.mutex.Lock()
+		c.discovered = false
+		c.mutex.Unlock()
+	}
+}
+
+// rqliteNodeInfo is a member of the cluster, as returned by the /nodes endpoint.
+type rqliteNodeInfo struct {
+	APIAddr   string `json:"api_addr"`
+	Reachable bool   `json:"reachable"`
+	Leader    bool   `json:"leader"`
+}
+
+// parseRqliteNodes parses the response of the /nodes endpoint, which is a list of nodes in rqlite 8
+// when requested with ?ver=2, and otherwise an object keyed by node ID.
+func parseRqliteNodes(raw []byte) (nodes []rqliteNodeInfo, err error) {
+	var list struct {
+		Nodes []rqliteNodeInfo `json:"nodes"`
+	}
+	if err = json.Unmarshal(raw, &list); err == nil && list.Nodes != nil {
+		return list.Nodes, nil
+	}
+	var byID map[string]rqliteNodeInfo
+	if err = json.Unmarshal(raw, &byID); err != nil {
+		return nil, fmt.Errorf("rqlite: invalid nodes response: %w", err)
+	}
+	for _, n := range byID {
+		if n.APIAddr != "" {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// rqliteUnavailableError is returned when a node can't be reached, or responds that it's unavailable.
+type rqliteUnavailableError struct {
+	err error
+	// maybeApplied is true if the request was sent, so the node may have applied it.
+	maybeApplied bool
+}
+
+func (e *rqliteUnavailableError) Error() string { return "rqlite node unavailable: " + e.err.Error() }
+func (e *rqliteUnavailableError) Unwrap() error { return e.err }
+
+// rqliteTransport follows redirects to the leader, including redirects of POST requests, which
+// http.Client would turn into GET requests, and returns an *rqliteUnavailableError if the node
+// can't be reached or is unavailable.
+type rqliteTransport struct {
+	base    http.RoundTripper
+	cluster *rqliteCluster
+}
+
+func (t *rqliteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for redirects := 0; ; redirects++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			if req.Context().Err() != nil {
+				// The caller cancelled the request, or its deadline passed, so the node isn't unavailable.
+				return nil, err
+			}
+			var opErr *net.OpError
+			dialFailed := errors.As(err, &opErr) && opErr.Op == "dial"
+			return nil, &rqliteUnavailableError{err: err, maybeApplied: !dialFailed}
+		}
+		switch resp.StatusCode {
+		case http.StatusServiceUnavailable:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, &rqliteUnavailableError{err: fmt.Errorf("%s: status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			location, err := resp.Location()
+			if err != nil || redirects >= maxRqliteRedirects || (req.Body != nil && req.GetBody == nil) {
+				return resp, nil
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			t.cluster.redirected(location)
+			next := req.Clone(req.Context())
+			next.URL = location
+			next.Host = ""
+			if req.GetBody != nil {
+				if next.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+			req = next
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -1,7 +1,21 @@
 package sqlitekv
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
 
 	rqlitehttp "github.com/rqlite/rqlite-go-http"
 )
@@ -22,3 +36,410 @@ func TestRqlite(t *testing.T) {
 	store := NewStore(db)
 	runStoreTests(t, store)
 }
+
+// fakeRqlite is an rqlite server that records the parameters of each request, and returns canned responses.
+type fakeRqlite struct {
+	mutex    sync.Mutex
+	requests []url.Values
+	// leader is the address of the leader that requests are redirected to, if it's set.
+	leader string
+	// nodes is the response of the /nodes endpoint.
+	nodes string
+	// unavailable nodes respond with 503 Service Unavailable.
+	unavailable bool
+	// abort closes the connection without responding.
+	abort bool
+	// slow nodes don't respond until the request is cancelled.
+	slow bool
+}
+
+func (f *fakeRqlite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.requests = append(f.requests, r.URL.Query())
+	leader, nodes, unavailable, abort, slow := f.leader, f.nodes, f.unavailable, f.abort, f.slow
+	f.mutex.Unlock()
+	if abort {
+		panic(http.ErrAbortHandler)
+	}
+	if slow {
+		// The body is read, so that the server notices when the client closes the connection.
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		return
+	}
+	if unavailable {
+		http.Error(w, "leader not found", http.StatusServiceUnavailable)
+		return
+	}
+	if leader != "" && strings.HasPrefix(r.URL.Path, "/db/") {
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/db/query":
+		fmt.Fprint(w, `{"results": [{"columns": ["key", "version", "value", "encoding", "created"], "types": ["text", "integer", "jsonb", "text", "text"], "values": [["a", 1, "{}", null, "2025-01-01T00:00:00Z"]]}]}`)
+	case r.URL.Path == "/db/execute" && r.URL.Query().Has("queue"):
+		fmt.Fprint(w, `{"results": [], "sequence_number": 1}`)
+	case r.URL.Path == "/db/execute":
+		fmt.Fprint(w, `{"results": [{"rows_affected": 1}]}`)
+	case r.URL.Path == "/nodes" && nodes != "":
+		fmt.Fprint(w, nodes)
+	case r.URL.Path == "/readyz":
+		fmt.Fprint(w, "[+]node ok")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRqlite) set(update func(f *fakeRqlite)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	update(f)
+}
+
+func (f *fakeRqlite) requestCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeRqlite) lastRequest() url.Values {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func TestRqliteQueryRows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"results": [{"columns": ["key", "name", "next"], "types": ["text", "", "integer"]}]}`)
+	}))
+	defer server.Close()
+	client, err := rqlitehttp.NewClient(server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create rqlite client: %v", err)
+	}
+	rq := NewRqlite(client)
+
+	t.Run("Queries that return no rows return their columns", func(t *testing.T) {
+		outputs, err := rq.QueryRows(context.Background(), db.Query{SQL: "select key, value ->> '$.name' as name, version + 1 as next from kv where false"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []db.Rows{{
+			Columns: []string{"key", "name", "next"},
+			Values:  [][]any{},
+		}}
+		if !reflect.DeepEqual(expected, outputs) {
+			t.Errorf("expected %#v, got %#v", expected, outputs)
+		}
+	})
+}
+
+func TestRqliteBlobs(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/db/execute" {
+			body, _ = io.ReadAll(r.Body)
+			fmt.Fprint(w, `{"results": [{"rows_affected": 1}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"results": [{"columns": ["data"], "types": ["blob"], "values": [[[0, 1, 255]]]}]}`)
+	}))
+	defer server.Close()
+	client, err := rqlitehttp.NewClient(server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create rqlite client: %v", err)
+	}
+	rq := NewRqlite(client)
+	ctx := context.Background()
+
+	t.Run("Blobs are sent as arrays of bytes", func(t *testing.T) {
+		if _, err := rq.Mutate(ctx, db.PutBlobChunk("id", "key", 0, []byte{0, 1, 255})); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(string(body), `"data":[0,1,255]`) {
+			t.Errorf("expected the data to be sent as an array of bytes, got %s", body)
+		}
+	})
+	t.Run("Blobs are read as bytes", func(t *testing.T) {
+		outputs, err := rq.QueryRows(ctx, db.GetBlobChunk("id", 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data, ok := outputs[0].Values[0][0].([]byte); !ok || !bytes.Equal(data, []byte{0, 1, 255}) {
+			t.Errorf("expected the data to be read as bytes, got %#v", outputs[0].Values[0][0])
+		}
+	})
+}
+
+func TestRqliteOptions(t *testing.T) {
+	fake := &fakeRqlite{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client, err := rqlitehttp.NewClient(server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create rqlite client: %v", err)
+	}
+	rq := NewRqlite(client)
+	ctx := context.Background()
+
+	t.Run("Queries use the default read consistency", func(t *testing.T) {
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if level := fake.lastRequest().Get("level"); level != "strong" {
+			t.Errorf("expected strong level, got %q", level)
+		}
+	})
+	t.Run("Read options override the read consistency", func(t *testing.T) {
+		ctx := WithRqliteReadOptions(ctx, RqliteReadOptions{
+			Level:           rqlitehttp.ReadConsistencyLevelNone,
+			Freshness:       time.Second,
+			FreshnessStrict: true,
+		})
+		outputs, err := rq.Query(ctx, db.Get("a"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(outputs[0]) != 1 || outputs[0][0].Key != "a" {
+			t.Errorf("unexpected records: %#v", outputs)
+		}
+		params := fake.lastRequest()
+		if level := params.Get("level"); level != "none" {
+			t.Errorf("expected none level, got %q", level)
+		}
+		if freshness := params.Get("freshness"); freshness != "1s" {
+			t.Errorf("expected 1s freshness, got %q", freshness)
+		}
+		if !params.Has("freshness_strict") {
+			t.Error("expected strict freshness")
+		}
+	})
+	t.Run("Mutations wait to be committed by default", func(t *testing.T) {
+		rowsAffected, err := rq.Mutate(ctx, db.Put("a", -1, map[string]any{}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rowsAffected) != 1 || rowsAffected[0] != 1 {
+			t.Errorf("expected 1 row affected, got %v", rowsAffected)
+		}
+		if params := fake.lastRequest(); params.Has("queue") {
+			t.Error("expected the mutation not to be queued")
+		}
+	})
+	t.Run("Mutations can be queued", func(t *testing.T) {
+		// Queued writes aren't batched, because rqlite batches them.
+		b := NewBatcher(rq, BatchOptions{})
+		ctx := WithRqliteWriteOptions(ctx, RqliteWriteOptions{Queue: true})
+		rowsAffected, err := b.Mutate(ctx, db.Put("a", 1, map[string]any{}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rowsAffected) != 1 {
+			t.Errorf("expected a result for each mutation, got %v", rowsAffected)
+		}
+		params := fake.lastRequest()
+		if !params.Has("queue") {
+			t.Error("expected the mutation to be queued")
+		}
+		if params.Has("wait") {
+			t.Error("expected the mutation not to wait")
+		}
+	})
+	t.Run("Flush waits for the queue", func(t *testing.T) {
+		if err := rq.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		params := fake.lastRequest()
+		if !params.Has("queue") || !params.Has("wait") {
+			t.Errorf("expected a queued request that waits, got %v", params)
+		}
+	})
+	t.Run("Read consistency levels can be parsed", func(t *testing.T) {
+		level, err := ParseReadConsistencyLevel("Linearizable")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if level != rqlitehttp.ReadConsistencyLevelLinearizable {
+			t.Errorf("expected linearizable, got %v", level)
+		}
+		if _, err := ParseReadConsistencyLevel("eventual"); err == nil {
+			t.Error("expected an error for an unknown level")
+		}
+	})
+}
+
+func TestRqliteCluster(t *testing.T) {
+	ctx := context.Background()
+	newNodes := func(t *testing.T, n int) (fakes []*fakeRqlite, addresses []string) {
+		for range n {
+			fake := &fakeRqlite{}
+			server := httptest.NewServer(fake)
+			t.Cleanup(server.Close)
+			fakes = append(fakes, fake)
+			addresses = append(addresses, server.URL)
+		}
+		return fakes, addresses
+	}
+
+	t.Run("Requests fail over to the next node", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 1)
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		rq, err := NewRqliteFromAddresses([]string{down.URL, addresses[0]}, RqliteOptions{})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The node couldn't be connected to, so the mutation can't have been applied.
+		if _, err := rq.Mutate(ctx, db.Put("a", -1, map[string]any{})); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := fakes[0].requestCount(); n != 2 {
+			t.Errorf("expected 2 requests to the second node, got %d", n)
+		}
+	})
+	t.Run("Followers redirect requests to the leader", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		follower, leader := fakes[0], fakes[1]
+		follower.set(func(f *fakeRqlite) { f.leader = addresses[1] })
+		rq, err := NewRqliteFromAddresses(addresses[:1], RqliteOptions{})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Mutate(ctx, db.Put("a", -1, map[string]any{})); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// Once the leader is known, requests are sent to it directly.
+		if n := follower.requestCount(); n != 1 {
+			t.Errorf("expected 1 request to the follower, got %d", n)
+		}
+		if n := leader.requestCount(); n != 2 {
+			t.Errorf("expected 2 requests to the leader, got %d", n)
+		}
+	})
+	t.Run("Nodes and the leader are discovered", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		fakes[0].set(func(f *fakeRqlite) {
+			f.nodes = fmt.Sprintf(`{"1": {"api_addr": %q, "reachable": true, "leader": false}, "2": {"api_addr": %q, "reachable": true, "leader": true}}`, addresses[0], addresses[1])
+		})
+		rq, err := NewRqliteFromAddresses(addresses[:1], RqliteOptions{DiscoverNodes: true})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := fakes[1].requestCount(); n != 1 {
+			t.Errorf("expected the query to be sent to the leader, got %d requests", n)
+		}
+		// The leader fails, so the first node is used.
+		fakes[1].set(func(f *fakeRqlite) { f.unavailable = true })
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("Failed nodes are health checked after their backoff", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		fakes[0].set(func(f *fakeRqlite) { f.unavailable = true })
+		rq, err := NewRqliteFromAddresses(addresses, RqliteOptions{MinBackoff: time.Minute})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		now := time.Now()
+		rq.cluster.now = func() time.Time { return now }
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fakes[0].set(func(f *fakeRqlite) { f.unavailable = false })
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := fakes[0].requestCount(); n != 1 {
+			t.Errorf("expected the failed node to be skipped during its backoff, got %d requests", n)
+		}
+		now = now.Add(time.Minute)
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// A health check, then the query.
+		if n := fakes[0].requestCount(); n != 3 {
+			t.Errorf("expected the node to be used after a health check, got %d requests", n)
+		}
+		if n := fakes[1].requestCount(); n != 2 {
+			t.Errorf("expected 2 requests to the second node, got %d", n)
+		}
+	})
+	t.Run("Mutations that may have been applied aren't retried", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		fakes[0].set(func(f *fakeRqlite) { f.abort = true })
+		rq, err := NewRqliteFromAddresses(addresses, RqliteOptions{})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Mutate(ctx, db.Put("a", -1, map[string]any{})); err == nil {
+			t.Fatal("expected an error")
+		}
+		if n := fakes[1].requestCount(); n != 0 {
+			t.Errorf("expected the mutation not to be retried, got %d requests", n)
+		}
+		// Queries are retried.
+		rq, err = NewRqliteFromAddresses(addresses, RqliteOptions{})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	t.Run("Cancelled requests don't mark the node as failed", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		fakes[0].set(func(f *fakeRqlite) { f.slow = true })
+		rq, err := NewRqliteFromAddresses(addresses, RqliteOptions{MinBackoff: time.Minute})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := rq.Query(timeoutCtx, db.Get("a")); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrNoRqliteNodes) {
+			t.Fatalf("expected the context's error, got %v", err)
+		}
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := rq.Query(cancelledCtx, db.Get("a")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the context's error, got %v", err)
+		}
+		if n := fakes[1].requestCount(); n != 0 {
+			t.Errorf("expected the query not to be retried on the second node, got %d requests", n)
+		}
+		// The node isn't in backoff, so it's used for the next request.
+		fakes[0].set(func(f *fakeRqlite) { f.slow = false })
+		if _, err := rq.Query(ctx, db.Get("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := fakes[0].requestCount(); n != 2 {
+			t.Errorf("expected 2 requests to the first node, got %d", n)
+		}
+	})
+	t.Run("An error is returned when no nodes are available", func(t *testing.T) {
+		fakes, addresses := newNodes(t, 2)
+		for _, fake := range fakes {
+			fake.set(func(f *fakeRqlite) { f.unavailable = true })
+		}
+		rq, err := NewRqliteFromAddresses(addresses, RqliteOptions{})
+		if err != nil {
+			t.Fatalf("failed to create rqlite: %v", err)
+		}
+		if _, err := rq.Query(ctx, db.Get("a")); !errors.Is(err, ErrNoRqliteNodes) {
+			t.Fatalf("expected ErrNoRqliteNodes, got %v", err)
+		}
+	})
+}
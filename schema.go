@@ -0,0 +1,278 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// Schema is a JSON Schema that the values of keys with the prefix must match.
+type Schema struct {
+	Prefix string          `json:"prefix"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// ValidationError is returned when a value doesn't match the JSON Schema for its key.
+type ValidationError struct {
+	// Key is the key of the record that failed validation.
+	Key string `json:"key"`
+	// Prefix is the prefix of the schema that the value was validated against.
+	Prefix string `json:"prefix"`
+	// Errors are the reasons that the value is invalid.
+	Errors []ValidationErrorDetail `json:"errors"`
+}
+
+// ValidationErrorDetail is a single reason that a value is invalid.
+type ValidationErrorDetail struct {
+	// InstanceLocation is the JSON pointer to the invalid part of the value, e.g. "/age".
+	InstanceLocation string `json:"instanceLocation"`
+	// KeywordLocation is the JSON pointer to the schema keyword that failed, e.g. "/properties/age/minimum".
+	KeywordLocation string `json:"keywordLocation"`
+	Message         string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("value of %q does not match the schema for prefix %q", e.Key, e.Prefix))
+	for i, d := range e.Errors {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s", d.InstanceLocation, d.Message))
+	}
+	return sb.String()
+}
+
+func newValidationError(key, prefix string, err error) error {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	output := &ValidationError{
+		Key:    key,
+		Prefix: prefix,
+	}
+	units := append([]jsonschema.OutputUnit{*ve.BasicOutput()}, ve.BasicOutput().Errors...)
+	for _, u := range units {
+		if u.Error == nil {
+			continue
+		}
+		location := u.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		output.Errors = append(output.Errors, ValidationErrorDetail{
+			InstanceLocation: location,
+			KeywordLocation:  u.KeywordLocation,
+			Message:          u.Error.String(),
+		})
+	}
+	return output
+}
+
+type compiledSchema struct {
+	prefix string
+	schema *jsonschema.Schema
+	// source is the JSON of the schema, so that it's only compiled again when it changes.
+	source string
+}
+
+// DefaultSchemaCacheTTL is the default time that the registered schemas are cached for, see WithSchemaCacheTTL.
+const DefaultSchemaCacheTTL = 30 * time.Second
+
+// WithSchemaCacheTTL sets how long the registered JSON Schemas are cached for before they're read
+// again, so that schemas registered or deleted by other processes are seen. Schemas registered or
+// deleted through the store are seen immediately. A negative TTL reads the schemas before every write.
+// The default is DefaultSchemaCacheTTL.
+func WithSchemaCacheTTL(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.schemaCacheTTL = ttl
+	}
+}
+
+func compileSchema(schema []byte) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(schema))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	if err = c.AddResource("schema.json", doc); err != nil {
+		return nil, err
+	}
+	return c.Compile("schema.json")
+}
+
+// RegisterSchema creates, or replaces, the JSON Schema that values of keys with the prefix must match.
+// If more than one schema matches a key, the schema with the longest prefix is used.
+//
+// Existing values are not validated against the schema. Other stores see the schema once their
+// cached schemas expire, see WithSchemaCacheTTL.
+func (s *Store) RegisterSchema(ctx context.Context, prefix string, schema any) (err error) {
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return fmt.Errorf("registerschema: %w", err)
+	}
+	if _, err = compileSchema(schemaJSON); err != nil {
+		return fmt.Errorf("registerschema: invalid schema: %w", err)
+	}
+	defer s.invalidateSchemas()
+	if _, err = s.db.Mutate(ctx, db.PutSchema(prefix, schemaJSON)); err != nil {
+		return fmt.Errorf("registerschema: %w", err)
+	}
+	return nil
+}
+
+// DeleteSchema deletes the JSON Schema for the prefix.
+func (s *Store) DeleteSchema(ctx context.Context, prefix string) (err error) {
+	defer s.invalidateSchemas()
+	if _, err = s.db.Mutate(ctx, db.DeleteSchema(prefix)); err != nil {
+		return fmt.Errorf("deleteschema: %w", err)
+	}
+	return nil
+}
+
+// Schemas returns the registered JSON Schemas, ordered by prefix.
+func (s *Store) Schemas(ctx context.Context) (schemas []Schema, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.GetSchemas())
+	if err != nil {
+		return nil, fmt.Errorf("schemas: %w", err)
+	}
+	if schemas, err = RowsOf[Schema](outputs[0]); err != nil {
+		return nil, fmt.Errorf("schemas: %w", err)
+	}
+	return schemas, nil
+}
+
+// ValidateValue validates the value against the JSON Schema for the key, without storing it.
+// If the value is invalid, a *ValidationError is returned.
+func (s *Store) ValidateValue(ctx context.Context, key string, value any) (err error) {
+	schemas, err := s.compiledSchemas(ctx)
+	if err != nil {
+		return fmt.Errorf("validatevalue: %w", err)
+	}
+	v, err := toJSONValue(value)
+	if err != nil {
+		return fmt.Errorf("validatevalue: %w", err)
+	}
+	return validateValue(schemas, key, v)
+}
+
+// compiledSchemas returns the registered schemas, longest prefix first. The schemas are cached for
+// the store's schema cache TTL, and each schema is only compiled again when it changes.
+func (s *Store) compiledSchemas(ctx context.Context) (compiled []compiledSchema, err error) {
+	s.schemaMutex.Lock()
+	if s.schemasLoaded && time.Since(s.schemasLoadedAt) < s.schemaCacheTTL {
+		defer s.schemaMutex.Unlock()
+		return s.schemas, nil
+	}
+	generation := s.schemaGeneration
+	s.schemaMutex.Unlock()
+
+	loadedAt := time.Now()
+	schemas, err := s.Schemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.schemaMutex.Lock()
+	defer s.schemaMutex.Unlock()
+	compiled = make([]compiledSchema, len(schemas))
+	for i, schema := range schemas {
+		cs, ok := s.schemaCache[schema.Prefix]
+		if !ok || cs.source != string(schema.Schema) {
+			cs = compiledSchema{prefix: schema.Prefix, source: string(schema.Schema)}
+			if cs.schema, err = compileSchema(schema.Schema); err != nil {
+				return nil, fmt.Errorf("invalid schema for prefix %q: %w", schema.Prefix, err)
+			}
+		}
+		compiled[i] = cs
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return len(compiled[i].prefix) > len(compiled[j].prefix)
+	})
+	// If the schemas were changed through the store while they were being read, they may be out of date.
+	if generation == s.schemaGeneration {
+		s.schemas, s.schemasLoaded, s.schemasLoadedAt = compiled, true, loadedAt
+		// Schemas are cached by prefix, so replaced and deleted schemas are dropped.
+		s.schemaCache = make(map[string]compiledSchema, len(compiled))
+		for _, cs := range compiled {
+			s.schemaCache[cs.prefix] = cs
+		}
+	}
+	return compiled, nil
+}
+
+// invalidateSchemas makes the next write read the registered schemas.
+func (s *Store) invalidateSchemas() {
+	s.schemaMutex.Lock()
+	defer s.schemaMutex.Unlock()
+	s.schemasLoaded = false
+	s.schemaGeneration++
+}
+
+func matchSchema(schemas []compiledSchema, key string) (schema compiledSchema, ok bool) {
+	for _, schema := range schemas {
+		if strings.HasPrefix(key, schema.prefix) {
+			return schema, true
+		}
+	}
+	return schema, false
+}
+
+func validateValue(schemas []compiledSchema, key string, value any) error {
+	schema, ok := matchSchema(schemas, key)
+	if !ok {
+		return nil
+	}
+	if err := schema.schema.Validate(value); err != nil {
+		return newValidationError(key, schema.prefix, err)
+	}
+	return nil
+}
+
+// toJSONValue converts a Go value into the form used by the JSON Schema validator.
+func toJSONValue(v any) (any, error) {
+	if e, ok := v.(db.Encoded); ok {
+		if !e.IsJSON() {
+			return nil, fmt.Errorf("values with the %q encoding cannot be validated or patched", e.Encoding)
+		}
+		return jsonschema.UnmarshalJSON(bytes.NewReader(e.Data))
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonschema.UnmarshalJSON(bytes.NewReader(data))
+}
+
+// mergePatch applies a JSON merge patch (RFC 7396) to the target.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t := make(map[string]any)
+	if existing, ok := target.(map[string]any); ok {
+		for k, v := range existing {
+			t[k] = v
+		}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
@@ -1,9 +1,13 @@
 package sqlitekv
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/a-h/sqlitekv/db"
@@ -13,18 +17,96 @@ import (
 
 func NewSqlite(pool *sqlitex.Pool) *Sqlite {
 	return &Sqlite{
-		pool: pool,
+		pool:  pool,
+		Retry: DefaultRetryPolicy,
 	}
 }
 
+// NewSqliteReadWrite creates a Sqlite that runs queries on connections from the read pool, and
+// mutations on connections from the write pool.
+//
+// The write pool should have a single connection, so that writes are serialized in-process rather
+// than contending for SQLite's write lock, and the database should be in WAL mode, so that reads can
+// run in parallel with writes. Use NewSqliteFromPath with SqliteOptions.SingleWriter to create the pools.
+func NewSqliteReadWrite(read, write *sqlitex.Pool) *Sqlite {
+	s := NewSqlite(read)
+	s.writePool = write
+	return s
+}
+
 type Sqlite struct {
 	pool *sqlitex.Pool
+	// writePool is used for mutations, if it's set. Otherwise, pool is used.
+	writePool *sqlitex.Pool
+	// BusyTimeout is how long a statement waits for a lock held by another connection before it fails
+	// with db.ErrBusy. If zero, statements wait until their context is done.
+	BusyTimeout time.Duration
+	// Retry is the policy for retrying calls that fail with db.ErrBusy or db.ErrLocked.
+	Retry RetryPolicy
+	// StatementCacheSize bounds the number of prepared statements kept by each connection.
+	// sqlitex.Execute keeps every statement that it prepares until the connection is closed, so the
+	// least recently used statements over the bound are finalized, so that ad hoc queries don't use an
+	// unbounded amount of memory. If zero, DefaultStatementCacheSize is used. If negative, statements
+	// are prepared each time they're run, and aren't kept.
+	StatementCacheSize int
+	// RawJSONB makes Query return JSON values as the JSONB stored in the database, with the
+	// db.EncodingJSONB encoding, rather than converting them to JSON text in SQL, see db.RawJSONB.
+	// The Store converts them to JSON in Go when they're read.
+	RawJSONB bool
+
+	// statements is the *statementCache of each connection.
+	statements sync.Map
 }
 
+// DefaultStatementCacheSize is the default bound on the number of prepared statements kept by each
+// connection. It's larger than the number of statements used by the Store, so that they stay prepared.
+const DefaultStatementCacheSize = 128
+
 func (s *Sqlite) isDB() db.DB { return s }
 
+// take takes a connection from the pool, and records the time spent waiting for it if the database is instrumented.
+func (s *Sqlite) take(ctx context.Context, pool *sqlitex.Pool) (*sqlite.Conn, error) {
+	started := time.Now()
+	conn, err := pool.Take(ctx)
+	recordPoolWait(ctx, time.Since(started))
+	if err == nil && s.BusyTimeout > 0 {
+		conn.SetBusyTimeout(s.BusyTimeout)
+	}
+	return conn, err
+}
+
+// execute runs the statement on the connection. sqlitex.Execute uses the connection's prepared
+// statement if it has one, and the statement cache finalizes the least recently used statements,
+// so that the number of statements the connection keeps is bounded.
+func (s *Sqlite) execute(conn *sqlite.Conn, sql string, opts *sqlitex.ExecOptions) error {
+	if s.StatementCacheSize < 0 {
+		return sqlitex.ExecuteTransient(conn, sql, opts)
+	}
+	err := sqlitex.Execute(conn, sql, opts)
+	s.used(conn, sql)
+	return err
+}
+
+// used records that the connection used the statement, which it prepared with conn.Prepare.
+func (s *Sqlite) used(conn *sqlite.Conn, sql string) {
+	size := s.StatementCacheSize
+	if size == 0 {
+		size = DefaultStatementCacheSize
+	}
+	c, _ := s.statements.LoadOrStore(conn, newStatementCache())
+	c.(*statementCache).used(conn, sql, size)
+}
+
 func (s *Sqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]db.Record, err error) {
-	conn, err := s.pool.Take(ctx)
+	err = s.Retry.do(ctx, func() (err error) {
+		outputs, err = s.query(ctx, queries...)
+		return err
+	})
+	return outputs, err
+}
+
+func (s *Sqlite) query(ctx context.Context, queries ...db.Query) (outputs [][]db.Record, err error) {
+	conn, err := s.take(ctx, s.pool)
 	if err != nil {
 		return nil, err
 	}
@@ -32,6 +114,10 @@ func (s *Sqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]db
 
 	outputs = make([][]db.Record, len(queries))
 	for i, q := range queries {
+		sql := q.SQL
+		if s.RawJSONB {
+			sql = db.RawJSONB(sql)
+		}
 		opts := &sqlitex.ExecOptions{
 			Named: q.Args,
 			ResultFunc: func(stmt *sqlite.Stmt) (err error) {
@@ -44,51 +130,181 @@ func (s *Sqlite) Query(ctx context.Context, queries ...db.Query) (outputs [][]db
 					return fmt.Errorf("query: error parsing created time: %w", err)
 				}
 				r := db.Record{
-					Key:     stmt.GetText("key"),
-					Version: stmt.GetInt64("version"),
-					Value:   valueBytes,
-					Created: created,
+					Key:      stmt.GetText("key"),
+					Version:  stmt.GetInt64("version"),
+					Value:    valueBytes,
+					Encoding: stmt.GetText("encoding"),
+					Created:  created,
+				}
+				// JSON values are stored as JSONB blobs, and values converted to JSON are text.
+				if s.RawJSONB && (r.Encoding == "" || r.Encoding == db.EncodingJSON) && stmt.ColumnType(stmt.ColumnIndex("value")) == sqlite.TypeBlob {
+					r.Encoding = db.EncodingJSONB
 				}
 				outputs[i] = append(outputs[i], r)
 				return nil
 			},
 		}
-		if err = sqlitex.Execute(conn, q.SQL, opts); err != nil {
-			return outputs, fmt.Errorf("query: error in query index %d: %w", i, err)
+		if err = s.execute(conn, sql, opts); err != nil {
+			return outputs, fmt.Errorf("query: error in query index %d: %w", i, classifySqliteError(err))
 		}
 	}
 
 	return outputs, nil
 }
 
-func (s *Sqlite) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
-	conn, err := s.pool.Take(ctx)
+func (s *Sqlite) QueryRows(ctx context.Context, queries ...db.Query) (outputs []db.Rows, err error) {
+	err = s.Retry.do(ctx, func() (err error) {
+		outputs, err = s.queryRows(ctx, queries...)
+		return err
+	})
+	return outputs, err
+}
+
+func (s *Sqlite) queryRows(ctx context.Context, queries ...db.Query) (outputs []db.Rows, err error) {
+	conn, err := s.take(ctx, s.pool)
 	if err != nil {
 		return nil, err
 	}
 	defer s.pool.Put(conn)
 
+	outputs = make([]db.Rows, len(queries))
+	for i, q := range queries {
+		opts := &sqlitex.ExecOptions{
+			Named: q.Args,
+			ResultFunc: func(stmt *sqlite.Stmt) (err error) {
+				if outputs[i].Columns == nil {
+					outputs[i].Columns = make([]string, stmt.ColumnCount())
+					for j := range outputs[i].Columns {
+						outputs[i].Columns[j] = stmt.ColumnName(j)
+					}
+				}
+				values := make([]any, stmt.ColumnCount())
+				for j := range values {
+					switch stmt.ColumnType(j) {
+					case sqlite.TypeInteger:
+						values[j] = stmt.ColumnInt64(j)
+					case sqlite.TypeFloat:
+						values[j] = stmt.ColumnFloat(j)
+					case sqlite.TypeText:
+						values[j] = stmt.ColumnText(j)
+					case sqlite.TypeBlob:
+						values[j], err = io.ReadAll(stmt.ColumnReader(j))
+						if err != nil {
+							return fmt.Errorf("query: error reading column %q: %w", stmt.ColumnName(j), err)
+						}
+					}
+				}
+				outputs[i].Values = append(outputs[i].Values, values)
+				return nil
+			},
+		}
+		if err = s.execute(conn, q.SQL, opts); err != nil {
+			return outputs, fmt.Errorf("query: error in query index %d: %w", i, classifySqliteError(err))
+		}
+		if outputs[i].Columns == nil {
+			// The query returned no rows, so the columns are read from the statement, as rqlite returns them.
+			if outputs[i].Columns, err = s.columns(conn, q.SQL); err != nil {
+				return outputs, fmt.Errorf("query: error in query index %d: %w", i, classifySqliteError(err))
+			}
+			outputs[i].Values = [][]any{}
+		}
+	}
+
+	return outputs, nil
+}
+
+// columns returns the names of the columns of the statement.
+func (s *Sqlite) columns(conn *sqlite.Conn, sql string) (columns []string, err error) {
+	var stmt *sqlite.Stmt
+	if s.StatementCacheSize < 0 {
+		if stmt, _, err = conn.PrepareTransient(sql); err != nil {
+			return nil, err
+		}
+		defer stmt.Finalize()
+	} else {
+		// The statement was prepared when it was executed, so it isn't prepared again.
+		if stmt, err = conn.Prepare(sql); err != nil {
+			return nil, err
+		}
+		s.used(conn, sql)
+	}
+	columns = make([]string, stmt.ColumnCount())
+	for i := range columns {
+		columns[i] = stmt.ColumnName(i)
+	}
+	return columns, nil
+}
+
+// Mutate runs the mutations in a transaction. If the transaction fails because the database is busy
+// or locked, it's rolled back, and retried according to the retry policy.
+func (s *Sqlite) Mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
+	err = s.Retry.do(ctx, func() (err error) {
+		rowsAffected, err = s.mutate(ctx, mutations...)
+		return err
+	})
+	return rowsAffected, err
+}
+
+func (s *Sqlite) mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
+	pool := s.pool
+	if s.writePool != nil {
+		pool = s.writePool
+	}
+	conn, err := s.take(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Put(conn)
+
+	// Run the mutations in a transaction, as rqlite does, so that if a mutation fails, the changes
+	// made by the other mutations are rolled back. The transaction takes the write lock when it
+	// starts, so that it waits for other writers, rather than failing when it tries to upgrade
+	// a read lock.
+	endTx, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return nil, fmt.Errorf("mutate: %w", classifySqliteError(err))
+	}
+	var txErr error
+	defer func() {
+		endTx(&txErr)
+		if txErr != nil && err == nil {
+			err = fmt.Errorf("mutate: %w", classifySqliteError(txErr))
+		}
+	}()
+
 	rowsAffected = make([]int64, len(mutations))
 	errs := make([]error, len(mutations))
 	for i, m := range mutations {
 		opts := &sqlitex.ExecOptions{
 			Named: m.Args,
 		}
-		if err = sqlitex.Execute(conn, m.SQL, opts); err != nil {
-			errs[i] = fmt.Errorf("mutate: error in mutation index %d: %w", i, err)
-			continue
+		if err = s.execute(conn, m.SQL, opts); err != nil {
+			errs[i] = fmt.Errorf("mutate: error in mutation index %d: %w", i, classifySqliteError(err))
+			txErr = err
+			break
 		}
 		rowsAffected[i] = int64(conn.Changes())
 		if mutations[i].MustAffectRows && rowsAffected[i] == 0 {
 			errs[i] = db.ErrVersionMismatch
 		}
 	}
+	if txErr != nil {
+		rollBack(rowsAffected, errs, classifySqliteError(txErr))
+	}
 
 	return rowsAffected, newBatchError(errs)
 }
 
 func (s *Sqlite) QueryScalarInt64(ctx context.Context, sql string, params map[string]any) (v int64, err error) {
-	conn, err := s.pool.Take(ctx)
+	err = s.Retry.do(ctx, func() (err error) {
+		v, err = s.queryScalarInt64(ctx, sql, params)
+		return err
+	})
+	return v, err
+}
+
+func (s *Sqlite) queryScalarInt64(ctx context.Context, sql string, params map[string]any) (v int64, err error) {
+	conn, err := s.take(ctx, s.pool)
 	if err != nil {
 		return 0, err
 	}
@@ -104,8 +320,163 @@ func (s *Sqlite) QueryScalarInt64(ctx context.Context, sql string, params map[st
 			return nil
 		},
 	}
-	if err := sqlitex.Execute(conn, sql, opts); err != nil {
-		return 0, err
+	if err := s.execute(conn, sql, opts); err != nil {
+		return 0, classifySqliteError(err)
 	}
 	return v, nil
 }
+
+// NewSqliteFromPath opens a pool of connections to the SQLite database at the path, which can be a
+// file name or a URI, e.g. "file:data.db?mode=rwc". The database is created if it doesn't exist.
+//
+// Connections use WAL mode, and the pragmas in opts.Pragmas. Mutations wait up to
+// DefaultSqliteBusyTimeout for locks held by other connections. Call Close to close the pool.
+func NewSqliteFromPath(path string, opts SqliteOptions) (s *Sqlite, err error) {
+	pragmas := opts.Pragmas
+	if pragmas == nil {
+		pragmas = DefaultSqlitePragmas
+	}
+	if !opts.SingleWriter {
+		pool, err := newSqlitePool(path, opts.PoolSize, pragmas)
+		if err != nil {
+			return nil, err
+		}
+		s = NewSqlite(pool)
+		s.BusyTimeout = DefaultSqliteBusyTimeout
+		return s, nil
+	}
+	write, err := newSqlitePool(path, 1, pragmas)
+	if err != nil {
+		return nil, err
+	}
+	read, err := newSqlitePool(path, opts.PoolSize, append(slices.Clone(pragmas), "query_only = on"))
+	if err != nil {
+		write.Close()
+		return nil, err
+	}
+	s = NewSqliteReadWrite(read, write)
+	s.BusyTimeout = DefaultSqliteBusyTimeout
+	return s, nil
+}
+
+func newSqlitePool(path string, size int, pragmas []string) (*sqlitex.Pool, error) {
+	return sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PoolSize: size,
+		PrepareConn: func(conn *sqlite.Conn) error {
+			for _, pragma := range pragmas {
+				if err := sqlitex.ExecuteTransient(conn, "pragma "+pragma+";", nil); err != nil {
+					return fmt.Errorf("pragma %s: %w", pragma, err)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// SqliteOptions configures NewSqliteFromPath.
+type SqliteOptions struct {
+	// PoolSize is the number of connections in the pool. If less than 1, a default is used.
+	PoolSize int
+	// SingleWriter opens a separate connection for mutations, so that writes are serialized in-process,
+	// and the pool's connections are only used for queries. See NewSqliteReadWrite.
+	SingleWriter bool
+	// Pragmas are run on each connection when it's opened, e.g. "cache_size = -20000". The default is DefaultSqlitePragmas.
+	Pragmas []string
+}
+
+// DefaultSqlitePragmas are the pragmas used by NewSqliteFromPath. WAL mode lets readers continue while a
+// write is in progress, and with synchronous = normal, transactions are durable once the WAL is checkpointed.
+var DefaultSqlitePragmas = []string{
+	"journal_mode = wal",
+	"synchronous = normal",
+	"foreign_keys = on",
+	"temp_store = memory",
+}
+
+// DefaultSqliteBusyTimeout is the busy timeout of databases opened by NewSqliteFromPath.
+const DefaultSqliteBusyTimeout = 5 * time.Second
+
+// Close closes the pools of connections.
+func (s *Sqlite) Close() error {
+	err := s.pool.Close()
+	if s.writePool != nil {
+		err = errors.Join(err, s.writePool.Close())
+	}
+	s.statements.Clear()
+	return err
+}
+
+// statementCache tracks the order that the prepared statements of a connection were used in. It's
+// only used by the goroutine that has taken the connection from the pool, so it doesn't need a lock.
+type statementCache struct {
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cachedStatement is a statement prepared by the connection, which is finalized when it's evicted.
+type cachedStatement struct {
+	sql  string
+	stmt *sqlite.Stmt
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// used records that the statement was run, and finalizes the least recently used statements if the
+// connection has more than size statements.
+func (c *statementCache) used(conn *sqlite.Conn, sql string, size int) {
+	if el, ok := c.entries[sql]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	// The statement is new, so get the statement that the connection prepared when it was run, if it
+	// was prepared successfully.
+	stmt, err := conn.Prepare(sql)
+	if err != nil {
+		return
+	}
+	c.entries[sql] = c.lru.PushFront(cachedStatement{sql: sql, stmt: stmt})
+	for c.lru.Len() > size {
+		evicted := c.lru.Remove(c.lru.Back()).(cachedStatement)
+		delete(c.entries, evicted.sql)
+		evicted.stmt.Finalize()
+	}
+}
+
+// classifySqliteError adds the db error that matches the SQLite result code of the error, if any, so
+// that it can be checked with errors.Is, e.g. errors.Is(err, db.ErrBusy).
+func classifySqliteError(err error) error {
+	var kind error
+	switch sqlite.ErrCode(err).ToPrimary() {
+	case sqlite.ResultBusy:
+		kind = db.ErrBusy
+	case sqlite.ResultLocked:
+		kind = db.ErrLocked
+	case sqlite.ResultConstraint:
+		kind = db.ErrConstraint
+	case sqlite.ResultReadOnly:
+		kind = db.ErrReadOnly
+	case sqlite.ResultFull:
+		kind = db.ErrFull
+	case sqlite.ResultCorrupt, sqlite.ResultNotADB:
+		kind = db.ErrCorrupt
+	case sqlite.ResultInterrupt:
+		kind = db.ErrInterrupted
+	default:
+		return err
+	}
+	return &classifiedError{kind: kind, err: err}
+}
+
+// classifiedError is an error that matches a db error, but keeps the message of the original error.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.kind, e.err} }
@@ -1,8 +1,19 @@
 package sqlitekv
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/a-h/sqlitekv/db"
+	"google.golang.org/protobuf/types/known/apipb"
+	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
 
@@ -17,3 +28,506 @@ func TestSqlite(t *testing.T) {
 	store := NewStore(db)
 	runStoreTests(t, store)
 }
+
+func TestSqliteInitUpgradesExistingTables(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:upgrade?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	store := NewStore(NewSqlite(pool))
+
+	// Create the table used by earlier versions, which didn't have the data and encoding columns.
+	_, err = store.MutateAll(ctx,
+		db.Mutation{SQL: `create table kv (key text primary key, version integer, value jsonb, created text) without rowid;`},
+		db.Mutation{SQL: `insert into kv (key, version, value, created) values ('existing', 1, jsonb('{"name":"Alice"}'), '2025-03-10T08:16:13Z');`},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating table: %v", err)
+	}
+	for range 2 {
+		if err = store.Init(ctx); err != nil {
+			t.Fatalf("unexpected error initializing store: %v", err)
+		}
+	}
+
+	var p Person
+	if _, ok, err := store.Get(ctx, "existing", &p); err != nil || !ok || p.Name != "Alice" {
+		t.Errorf("expected existing record to be readable, got %v, ok=%v, err=%v", p, ok, err)
+	}
+	if err = NewStore(store.db, WithCodec(ProtobufCodec{})).Put(ctx, "new", -1, &apipb.Method{Name: "GetPerson"}); err != nil {
+		t.Errorf("unexpected error putting protobuf value: %v", err)
+	}
+}
+
+func TestSqliteMigrateConcurrently(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:"+filepath.Join(t.TempDir(), "migrate.db"), sqlitex.PoolOptions{PoolSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	store := NewStore(NewSqlite(pool))
+
+	var wg sync.WaitGroup
+	applied := make([]int, 4)
+	errs := make([]error, 4)
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var migrations []db.Migration
+			migrations, errs[i] = store.Migrate(ctx)
+			applied[i] = len(migrations)
+		}()
+	}
+	wg.Wait()
+
+	var total int
+	for i := range 4 {
+		if errs[i] != nil {
+			t.Errorf("unexpected error migrating: %v", errs[i])
+		}
+		total += applied[i]
+	}
+	migrations, err := db.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(migrations) {
+		t.Errorf("expected each migration to be applied once, got %d applied", total)
+	}
+}
+
+func TestSqliteBusy(t *testing.T) {
+	s, err := NewSqliteFromPath(filepath.Join(t.TempDir(), "busy.db"), SqliteOptions{PoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	store := NewStore(s)
+	if err = store.Init(ctx); err != nil {
+		t.Fatalf("unexpected error initializing store: %v", err)
+	}
+	var mode string
+	if err = queryText(ctx, s, "pragma journal_mode;", &mode); err != nil || mode != "wal" {
+		t.Errorf("expected WAL mode, got %q, %v", mode, err)
+	}
+
+	// Hold the write lock on another connection.
+	lock := func(t *testing.T) (release func()) {
+		conn, err := s.pool.Take(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sqlitex.ExecuteTransient(conn, "begin immediate;", nil); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			if err := sqlitex.ExecuteTransient(conn, "rollback;", nil); err != nil {
+				t.Error(err)
+			}
+			s.pool.Put(conn)
+		}
+	}
+
+	t.Run("Busy errors are classified", func(t *testing.T) {
+		release := lock(t)
+		defer release()
+		s.BusyTimeout, s.Retry = time.Millisecond, RetryPolicy{}
+		err := store.Put(ctx, "busy", -1, Person{Name: "Alice"})
+		if !errors.Is(err, db.ErrBusy) {
+			t.Errorf("expected busy error, got %v", err)
+		}
+	})
+	t.Run("Busy calls are retried", func(t *testing.T) {
+		release := lock(t)
+		s.BusyTimeout, s.Retry = time.Millisecond, RetryPolicy{MaxAttempts: 20, InitialBackoff: 5 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			release()
+		}()
+		if err := store.Put(ctx, "busy", -1, Person{Name: "Alice"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	t.Run("Constraint errors are classified", func(t *testing.T) {
+		_, err := store.MutateAll(ctx, db.Mutation{SQL: `insert into kv (key, version, value, created) values ('busy', 1, jsonb('{}'), '');`})
+		if !errors.Is(err, db.ErrConstraint) || errors.Is(err, db.ErrBusy) {
+			t.Errorf("expected constraint error, got %v", err)
+		}
+	})
+}
+
+func queryText(ctx context.Context, s *Sqlite, sql string, v *string) error {
+	outputs, err := s.QueryRows(ctx, db.Query{SQL: sql})
+	if err != nil {
+		return err
+	}
+	if len(outputs[0].Values) != 1 {
+		return errors.New("expected 1 row")
+	}
+	*v, _ = outputs[0].Values[0][0].(string)
+	return nil
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for attempt, max := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 100: 50 * time.Millisecond} {
+		for range 100 {
+			if d := p.backoff(attempt); d < max/2 || d > max {
+				t.Fatalf("attempt %d: expected backoff between %v and %v, got %v", attempt, max/2, max, d)
+			}
+		}
+	}
+}
+
+func TestSqliteReadWrite(t *testing.T) {
+	s, err := NewSqliteFromPath(filepath.Join(t.TempDir(), "readwrite.db"), SqliteOptions{PoolSize: 4, SingleWriter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	store := NewStore(s)
+	runStoreTests(t, store)
+
+	ctx := context.Background()
+	t.Run("Queries can't write", func(t *testing.T) {
+		_, err := store.QueryRows(ctx, `insert into kv (key, version, value, created) values ('readonly', 1, jsonb('{}'), '');`, nil)
+		if !errors.Is(err, db.ErrReadOnly) {
+			t.Errorf("expected read-only error, got %v", err)
+		}
+	})
+	t.Run("Concurrent writes are serialized", func(t *testing.T) {
+		s.Retry = RetryPolicy{}
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 25 {
+					if errs[i] = store.Patch(ctx, "readwrite", -1, map[string]any{"worker": i}); errs[i] != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if _, err := store.Delete(ctx, "readwrite"); err != nil {
+			t.Fatalf("unexpected error deleting: %v", err)
+		}
+	})
+}
+
+func TestSqliteMutateRollsBack(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:rollback?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	s := NewSqlite(pool)
+	if err := NewStore(s).Init(ctx); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	rowsAffected, err := s.Mutate(ctx,
+		db.Put("rollback/a", -1, "a"),
+		db.Put("rollback/b", -1, "b"),
+		// The key already exists, so the insert fails.
+		db.Mutation{SQL: `insert into kv (key, version, value, created) values ('rollback/a', 1, jsonb('{}'), '');`},
+		db.Put("rollback/d", -1, "d"),
+	)
+	if !errors.Is(err, db.ErrConstraint) {
+		t.Fatalf("expected constraint error, got %v", err)
+	}
+	expectRowsAffectedEqual(t, []int64{0, 0, 0, 0}, rowsAffected)
+	var be *BatchError
+	if !errors.As(err, &be) {
+		t.Fatalf("expected a batch error, got %T", err)
+	}
+	for i, err := range be.Errors {
+		if !errors.Is(err, db.ErrConstraint) {
+			t.Errorf("index %d: expected the constraint error, got %v", i, err)
+		}
+		if i != 2 && !strings.Contains(fmt.Sprint(err), "rolled back") {
+			t.Errorf("index %d: expected a rolled back error, got %v", i, err)
+		}
+	}
+	count, err := s.QueryScalarInt64(ctx, `select count(*) from kv where key like 'rollback/%';`, nil)
+	if err != nil {
+		t.Fatalf("unexpected error counting: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected the mutations to be rolled back, got %d records", count)
+	}
+}
+
+func TestSqliteStatementCache(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:statementcache?mode=memory&cache=shared", sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	s := NewSqlite(pool)
+	s.StatementCacheSize = 2
+	for _, sql := range []string{"select 1;", "select 2;", "select 1;", "select 3;"} {
+		if _, err := s.QueryScalarInt64(ctx, sql, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	var caches int
+	held := make(map[string]*sqlite.Stmt)
+	s.statements.Range(func(_, c any) bool {
+		caches++
+		var statements []string
+		for el := c.(*statementCache).lru.Front(); el != nil; el = el.Next() {
+			cached := el.Value.(cachedStatement)
+			statements = append(statements, cached.sql)
+			held[cached.sql] = cached.stmt
+		}
+		if expected := []string{"select 3;", "select 1;"}; !slices.Equal(statements, expected) {
+			t.Errorf("expected statements %v, got %v", expected, statements)
+		}
+		return true
+	})
+	if caches != 1 {
+		t.Errorf("expected 1 connection with cached statements, got %d", caches)
+	}
+
+	t.Run("Cached statements are the connection's prepared statements", func(t *testing.T) {
+		conn, err := pool.Take(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Put(conn)
+		for _, sql := range []string{"select 3;", "select 1;"} {
+			stmt, err := conn.Prepare(sql)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stmt != held[sql] {
+				t.Errorf("expected %q to be the connection's prepared statement", sql)
+			}
+		}
+	})
+
+	t.Run("Statements can be prepared each time they're run", func(t *testing.T) {
+		s := NewSqlite(pool)
+		s.StatementCacheSize = -1
+		v, err := s.QueryScalarInt64(ctx, "select 4;", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != 4 {
+			t.Errorf("expected 4, got %d", v)
+		}
+		outputs, err := s.QueryRows(ctx, db.Query{SQL: "select 5 as five where false;"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if columns := outputs[0].Columns; !slices.Equal(columns, []string{"five"}) {
+			t.Errorf("expected the columns of a query with no rows, got %v", columns)
+		}
+		s.statements.Range(func(_, _ any) bool {
+			t.Error("expected no cached statements")
+			return false
+		})
+	})
+}
+
+// BenchmarkSqlite compares running the Store's statements with values that are converted to JSON
+// text in SQL, and with values that are read as JSONB.
+func BenchmarkSqlite(b *testing.B) {
+	for _, bm := range []struct {
+		name     string
+		rawJSONB bool
+	}{
+		{name: "json"},
+		{name: "rawjsonb", rawJSONB: true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			s, err := NewSqliteFromPath(filepath.Join(b.TempDir(), "benchmark.db"), SqliteOptions{PoolSize: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			s.RawJSONB = bm.rawJSONB
+			ctx := context.Background()
+			store := NewStore(s)
+			if err := store.Init(ctx); err != nil {
+				b.Fatal(err)
+			}
+			value := map[string]any{"name": "benchmark", "count": 1}
+			if err := store.Put(ctx, "benchmark", -1, value); err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run("Get", func(b *testing.B) {
+				for range b.N {
+					var v map[string]any
+					if _, ok, err := store.Get(ctx, "benchmark", &v); err != nil || !ok {
+						b.Fatalf("unexpected result: %v, %v", ok, err)
+					}
+				}
+			})
+			b.Run("Put", func(b *testing.B) {
+				for range b.N {
+					if err := store.Put(ctx, "benchmark", -1, value); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("PutPatches", func(b *testing.B) {
+				for range b.N {
+					if _, err := store.MutateAll(ctx, db.PutPatches(db.PutInput("benchmark", -1, value), db.PatchInput("benchmark", -1, map[string]any{"count": 2}))); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSqliteRawJSONB(t *testing.T) {
+	pool, err := sqlitex.NewPool("file:rawjsonb?mode=memory&cache=shared", sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	s := NewSqlite(pool)
+	s.RawJSONB = true
+	store := NewStore(s)
+	runStoreTests(t, store)
+
+	ctx := context.Background()
+	t.Run("Records are read as JSONB", func(t *testing.T) {
+		defer store.Delete(ctx, "rawjsonb")
+		if err := store.Put(ctx, "rawjsonb", -1, map[string]any{"name": "Alice"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		outputs, err := s.Query(ctx, db.Get("rawjsonb"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		r := outputs[0][0]
+		if r.Encoding != db.EncodingJSONB {
+			t.Errorf("expected encoding %q, got %q", db.EncodingJSONB, r.Encoding)
+		}
+		value, err := r.JSON()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := `{"name":"Alice"}`; string(value) != expected {
+			t.Errorf("expected %s, got %s", expected, value)
+		}
+	})
+	t.Run("JSONB is converted to the same JSON as SQLite", func(t *testing.T) {
+		values := []string{
+			`null`, `true`, `false`, `0`, `-12`, `1.5`, `-1e10`, `""`, `"hello"`,
+			`"quote \" backslash \\ newline \n tab \t unicode é 😀"`,
+			`[]`, `{}`, `[1,[2,[3,{"a":[]}]]]`, `{"a":{"b":{"c":null}},"d":[true,false]}`,
+			`{"long":"` + strings.Repeat("x", 300) + `","longer":"` + strings.Repeat("y", 70000) + `"}`,
+			// JSON5.
+			`0x1F`, `-0xff`, `+1`, `.5`, `5.`, `-.5e3`, `Infinity`, `-Infinity`, `NaN`,
+			`{unquoted: 'single', 'esc': '\x41\'\0'}`, `"line \
+continued"`, `[1, 2, ]`, `// comment
+{"a": 1}`,
+		}
+		queries := make([]db.Query, len(values))
+		for i, v := range values {
+			queries[i] = db.Query{SQL: `select json(jsonb(:v)), jsonb(:v);`, Args: map[string]any{":v": v}}
+		}
+		// Text that's added to JSONB by SQL functions is stored without being escaped.
+		queries = append(queries, db.Query{
+			SQL:  `select json(jsonb_object('k', :v)), jsonb_object('k', :v);`,
+			Args: map[string]any{":v": "quote \" backslash \\ control \x01\x1f newline \n é"},
+		})
+		for _, q := range queries {
+			v := q.Args[":v"]
+			outputs, err := s.QueryRows(ctx, q)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", v, err)
+			}
+			expected, jsonb := outputs[0].Values[0][0].(string), outputs[0].Values[0][1].([]byte)
+			actual, err := db.JSONBToJSON(jsonb)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", v, err)
+				continue
+			}
+			if string(actual) != expected {
+				t.Errorf("%s: expected %s, got %s", v, expected, actual)
+			}
+		}
+		if _, err := db.JSONBToJSON([]byte{0x23, 'a'}); !errors.Is(err, db.ErrInvalidJSONB) {
+			t.Errorf("expected invalid JSONB error for truncated value, got %v", err)
+		}
+	})
+}
+
+// BenchmarkSqliteExecute compares running statements with sqlitex.Execute alone, which keeps every
+// statement that it prepares, with Sqlite.execute, which bounds the statements that are kept, and with
+// statements that are prepared each time they're run.
+func BenchmarkSqliteExecute(b *testing.B) {
+	s, err := NewSqliteFromPath(filepath.Join(b.TempDir(), "benchmark.db"), SqliteOptions{PoolSize: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	if err := NewStore(s).Init(ctx); err != nil {
+		b.Fatal(err)
+	}
+	conn, err := s.pool.Take(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.pool.Put(conn)
+
+	get := db.Get("benchmark")
+	put := db.Put("benchmark", -1, map[string]any{"name": "benchmark", "count": 1})
+	for _, bm := range []struct {
+		name    string
+		execute func(sql string, opts *sqlitex.ExecOptions) error
+	}{
+		{name: "baseline", execute: func(sql string, opts *sqlitex.ExecOptions) error {
+			return sqlitex.Execute(conn, sql, opts)
+		}},
+		{name: "bounded", execute: func(sql string, opts *sqlitex.ExecOptions) error {
+			return s.execute(conn, sql, opts)
+		}},
+		{name: "transient", execute: func(sql string, opts *sqlitex.ExecOptions) error {
+			return sqlitex.ExecuteTransient(conn, sql, opts)
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.Run("Put", func(b *testing.B) {
+				for range b.N {
+					if err := bm.execute(put.SQL, &sqlitex.ExecOptions{Named: put.Args}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("Get", func(b *testing.B) {
+				for range b.N {
+					if err := bm.execute(get.SQL, &sqlitex.ExecOptions{Named: get.Args, ResultFunc: func(*sqlite.Stmt) error { return nil }}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
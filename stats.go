@@ -0,0 +1,103 @@
+package sqlitekv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// Stats are the number of records in the store, and the size of their values.
+type Stats struct {
+	Records int64 `json:"records"`
+	// StoredBytes is the size of the stored values, including the plaintext fields of encrypted values.
+	StoredBytes int64 `json:"storedBytes"`
+	// UncompressedBytes is the size the values would be if they weren't compressed.
+	UncompressedBytes int64 `json:"uncompressedBytes"`
+	// CompressionRatio is UncompressedBytes divided by StoredBytes.
+	CompressionRatio float64 `json:"compressionRatio"`
+	// Encodings are the stats of the values with each encoding, e.g. "json" or "json+zstd".
+	Encodings []EncodingStats `json:"encodings"`
+}
+
+// EncodingStats are the number of records with an encoding, and the size of their values.
+type EncodingStats struct {
+	Encoding          string  `json:"encoding"`
+	Records           int64   `json:"records"`
+	StoredBytes       int64   `json:"storedBytes"`
+	UncompressedBytes int64   `json:"uncompressedBytes"`
+	CompressionRatio  float64 `json:"compressionRatio"`
+}
+
+// statsBatchSize is the number of compressed records that are decompressed at a time by Stats.
+const statsBatchSize = 1000
+
+// Stats returns the number of records with the prefix, and the size of their values.
+//
+// The uncompressed size of compressed values isn't stored, so compressed values are read and
+// decompressed to calculate it. Encrypted values that are compressed are decrypted, so the store
+// must have the keys that were used to encrypt them.
+func (s *Store) Stats(ctx context.Context, prefix string) (stats Stats, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.Stats(prefix))
+	if err != nil {
+		return stats, fmt.Errorf("stats: %w", err)
+	}
+	type row struct {
+		Encoding    string `json:"encoding"`
+		Records     int64  `json:"records"`
+		StoredBytes int64  `json:"stored_bytes"`
+	}
+	rows, err := RowsOf[row](outputs[0])
+	if err != nil {
+		return stats, fmt.Errorf("stats: %w", err)
+	}
+	stats.Encodings = make([]EncodingStats, len(rows))
+	for i, r := range rows {
+		es := EncodingStats{
+			Encoding:          r.Encoding,
+			Records:           r.Records,
+			StoredBytes:       r.StoredBytes,
+			UncompressedBytes: r.StoredBytes,
+		}
+		if _, _, ok := s.compressorOf(r.Encoding); ok {
+			if es.UncompressedBytes, err = s.uncompressedBytes(ctx, prefix, r.Encoding); err != nil {
+				return stats, fmt.Errorf("stats: %w", err)
+			}
+		}
+		es.CompressionRatio = ratio(es.UncompressedBytes, es.StoredBytes)
+		stats.Encodings[i] = es
+		stats.Records += es.Records
+		stats.StoredBytes += es.StoredBytes
+		stats.UncompressedBytes += es.UncompressedBytes
+	}
+	stats.CompressionRatio = ratio(stats.UncompressedBytes, stats.StoredBytes)
+	return stats, nil
+}
+
+// uncompressedBytes returns the total size of the decompressed values of records with the prefix and encoding.
+func (s *Store) uncompressedBytes(ctx context.Context, prefix, encoding string) (n int64, err error) {
+	var after string
+	for {
+		outputs, err := s.db.Query(ctx, db.GetPrefixWithEncoding(prefix, encoding, after, statsBatchSize))
+		if err != nil {
+			return n, err
+		}
+		for _, r := range outputs[0] {
+			if r, err = s.decodeRecord(ctx, r); err != nil {
+				return n, err
+			}
+			n += int64(len(r.Value))
+			after = r.Key
+		}
+		if len(outputs[0]) < statsBatchSize {
+			return n, nil
+		}
+	}
+}
+
+func ratio(uncompressed, stored int64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(uncompressed) / float64(stored)
+}
@@ -5,16 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/a-h/sqlitekv/db"
 )
 
 // ValuesOf returns the values of the records, unmarshaled into the given type.
-func ValuesOf[T any](records []db.Record) (values []T, err error) {
+//
+// Each value is decoded by the codec with the same encoding as the record. JSON values are decoded
+// with encoding/json if no JSON codec is provided. Use store.Codec() to decode values written by a store.
+func ValuesOf[T any](records []db.Record, codecs ...Codec) (values []T, err error) {
 	values = make([]T, len(records))
 	for i, r := range records {
-		err = json.Unmarshal(r.Value, &values[i])
+		err = decode(r, &values[i], codecs...)
 		if err != nil {
 			return nil, err
 		}
@@ -31,10 +35,12 @@ type RecordOf[T any] struct {
 
 // RecordsOf returns the records, with the value unmarshaled into a type.
 // Use map[string]any if you don't know the type.
-func RecordsOf[T any](records []db.Record) (values []RecordOf[T], err error) {
+//
+// Values are decoded in the same way as ValuesOf.
+func RecordsOf[T any](records []db.Record, codecs ...Codec) (values []RecordOf[T], err error) {
 	values = make([]RecordOf[T], len(records))
 	for i, r := range records {
-		err = json.Unmarshal(r.Value, &values[i].Value)
+		err = decode(r, &values[i].Value, codecs...)
 		if err != nil {
 			return nil, err
 		}
@@ -61,10 +67,25 @@ func newBatchError(errs []error) error {
 	}
 }
 
+// rollBack sets the results of mutations that were run in a transaction that was rolled back because
+// of the cause. No rows were affected, and the mutations that didn't fail have an error that wraps the cause.
+func rollBack(rowsAffected []int64, errs []error, cause error) {
+	for i := range errs {
+		rowsAffected[i] = 0
+		if errs[i] == nil {
+			errs[i] = fmt.Errorf("mutate: mutation index %d rolled back: %w", i, cause)
+		}
+	}
+}
+
 type BatchError struct {
 	Errors []error
 }
 
+func (be *BatchError) Unwrap() []error {
+	return be.Errors
+}
+
 func (be *BatchError) Error() string {
 	var sb strings.Builder
 	for i, err := range be.Errors {
@@ -75,24 +96,93 @@ func (be *BatchError) Error() string {
 	return sb.String()
 }
 
-func NewStore(db db.DB) *Store {
-	return &Store{
-		db: db,
+// StoreOption configures a Store.
+type StoreOption func(s *Store)
+
+// WithMiddleware wraps the store's database with the middleware, e.g. db.Logging, db.SlowQueries or
+// db.Timeout. The first middleware is the outermost, so it sees each call first.
+func WithMiddleware(middleware ...db.Middleware) StoreOption {
+	return func(s *Store) {
+		s.middleware = append(s.middleware, middleware...)
+	}
+}
+
+// WithCodec sets the codec used to encode and decode values. The default is JSONCodec.
+func WithCodec(codec Codec) StoreOption {
+	return func(s *Store) {
+		s.codec = codec
+	}
+}
+
+func NewStore(d db.DB, opts ...StoreOption) *Store {
+	s := &Store{
+		db:            d,
+		codec:         JSONCodec{},
+		blobChunkSize: DefaultBlobChunkSize,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	if s.schemaCacheTTL == 0 {
+		s.schemaCacheTTL = DefaultSchemaCacheTTL
+	}
+	if s.batching != nil {
+		s.db = NewBatcher(s.db, *s.batching)
+	}
+	s.db = db.Chain(s.middleware...)(s.db)
+	if s.cache != nil {
+		s.db = s.cache.middleware()(s.db)
+	}
+	return s
 }
 
 type Store struct {
-	db db.DB
+	db            db.DB
+	codec         Codec
+	blobChunkSize int
+
+	middleware []db.Middleware
+	cache      *cache
+	batching   *BatchOptions
+
+	compression     []compressionRule
+	keys            KeyProvider
+	plaintextFields []string
+
+	schemaCacheTTL time.Duration
+	schemaMutex    sync.Mutex
+	// schemas are the registered schemas, read at schemasLoadedAt.
+	schemas         []compiledSchema
+	schemasLoaded   bool
+	schemasLoadedAt time.Time
+	// schemaGeneration is incremented each time the store changes the registered schemas.
+	schemaGeneration uint64
+	// schemaCache holds the compiled schema of each prefix.
+	schemaCache map[string]compiledSchema
 }
 
-// Init initializes the store. It should be called before any other method, and creates the necessary table.
+// Init initializes the store. It should be called before any other method, and creates the necessary tables
+// by applying any migrations that haven't been applied, see Migrate.
 func (s *Store) Init(ctx context.Context) error {
-	_, err := s.db.Mutate(ctx, db.Init()...)
+	_, err := s.Migrate(ctx)
 	return err
 }
 
 // Get gets a key from the store, and populates v with the value. If the key does not exist, it returns ok=false.
+//
+// If v is nil, the value isn't unmarshaled, e.g. when only the version is needed. Use r.UnmarshalValue
+// to unmarshal it later.
 func (s *Store) Get(ctx context.Context, key string, v any) (r db.Record, ok bool, err error) {
+	var epoch uint64
+	if s.cache != nil {
+		if r, ok, err = s.getCached(ctx, key); err != nil {
+			return db.Record{}, false, fmt.Errorf("get: %w", err)
+		}
+		if ok {
+			return r, true, decode(r, v, s.codec)
+		}
+		epoch = s.cache.currentEpoch()
+	}
 	outputs, err := s.db.Query(ctx, db.Get(key))
 	if err != nil {
 		return db.Record{}, false, fmt.Errorf("get: %w", err)
@@ -104,36 +194,127 @@ func (s *Store) Get(ctx context.Context, key string, v any) (r db.Record, ok boo
 	if len(rows) > 1 {
 		return db.Record{}, false, fmt.Errorf("get: multiple rows found for key %q", key)
 	}
+	if r, err = s.decodeRecord(ctx, rows[0]); err != nil {
+		return r, true, fmt.Errorf("get: %w", err)
+	}
+	if s.cache != nil {
+		s.cache.add(r, epoch)
+	}
+	err = decode(r, v, s.codec)
+	return r, true, err
+}
+
+// Codec returns the codec used by the store. Pass it to ValuesOf and RecordsOf to decode the values of records.
+func (s *Store) Codec() Codec {
+	return s.codec
+}
+
+// GetPath gets the value at the JSON path within the value of a key, e.g. "$.name" or "address.city", and populates v with it.
+// If the key does not exist, or the path is not present in the value, it returns ok=false.
+//
+// Only the plaintext fields of values that aren't stored as JSON, e.g. because they're compressed or
+// encrypted, can be read, see WithEncryption. Reading other paths of those values returns an error.
+func (s *Store) GetPath(ctx context.Context, key, path string, v any) (r db.Record, ok bool, err error) {
+	outputs, err := s.db.Query(ctx, db.GetPath(key, path))
+	if err != nil {
+		return db.Record{}, false, fmt.Errorf("getpath: %w", err)
+	}
+	rows := outputs[0]
+	if len(rows) == 0 {
+		return db.Record{}, false, nil
+	}
+	if len(rows) > 1 {
+		return db.Record{}, false, fmt.Errorf("getpath: multiple rows found for key %q", key)
+	}
 	r = rows[0]
+	encoding := r.Encoding
+	r.Encoding = ""
+	if len(r.Value) == 0 {
+		// Values that aren't stored as JSON only have their plaintext fields in the value column.
+		if !(db.Encoded{Encoding: encoding}).IsJSON() {
+			return r, false, fmt.Errorf("getpath: %q isn't a plaintext field of the value of %q, which has the %q encoding", path, key, encoding)
+		}
+		return r, false, nil
+	}
 	err = json.Unmarshal(r.Value, v)
 	return r, true, err
 }
 
 // GetPrefix gets all keys with a given prefix from the store.
-func (s *Store) GetPrefix(ctx context.Context, prefix string, offset, limit int) (rows []db.Record, err error) {
-	outputs, err := s.db.Query(ctx, db.GetPrefix(prefix, offset, limit))
+// Use db.WithFields to return only selected fields of each value, and db.WithOrderBy or db.WithReverse to change the order.
+func (s *Store) GetPrefix(ctx context.Context, prefix string, offset, limit int, opts ...db.ScanOption) (rows []db.Record, err error) {
+	q := db.GetPrefix(prefix, offset, limit, opts...)
+	if q.ArgsError != nil {
+		return nil, fmt.Errorf("getprefix: %w", q.ArgsError)
+	}
+	outputs, err := s.db.Query(ctx, q)
 	if err != nil {
 		return nil, fmt.Errorf("getprefix: %w", err)
 	}
+	if err = s.decodeRecords(ctx, outputs[0]); err != nil {
+		return nil, fmt.Errorf("getprefix: %w", err)
+	}
 	return outputs[0], nil
 }
 
 // GetRange gets all keys between the key from (inclusive) and to (exclusive).
 // e.g. select key from kv where key >= 'a' and key < 'c';
-func (s *Store) GetRange(ctx context.Context, from, to string, offset, limit int) (rows []db.Record, err error) {
-	outputs, err := s.db.Query(ctx, db.GetRange(from, to, offset, limit))
+// Use db.WithFields to return only selected fields of each value, and db.WithOrderBy or db.WithReverse to change the order.
+func (s *Store) GetRange(ctx context.Context, from, to string, offset, limit int, opts ...db.ScanOption) (rows []db.Record, err error) {
+	q := db.GetRange(from, to, offset, limit, opts...)
+	if q.ArgsError != nil {
+		return nil, fmt.Errorf("getrange: %w", q.ArgsError)
+	}
+	outputs, err := s.db.Query(ctx, q)
 	if err != nil {
 		return nil, fmt.Errorf("getrange: %w", err)
 	}
+	if err = s.decodeRecords(ctx, outputs[0]); err != nil {
+		return nil, fmt.Errorf("getrange: %w", err)
+	}
 	return outputs[0], nil
 }
 
 // List gets all keys from the store, starting from the given offset and limiting the number of results to the given limit.
-func (s *Store) List(ctx context.Context, start, limit int) (rows []db.Record, err error) {
-	outputs, err := s.db.Query(ctx, db.List(start, limit))
+// Use db.WithFields to return only selected fields of each value, and db.WithOrderBy or db.WithReverse to change the order.
+func (s *Store) List(ctx context.Context, start, limit int, opts ...db.ScanOption) (rows []db.Record, err error) {
+	q := db.List(start, limit, opts...)
+	if q.ArgsError != nil {
+		return nil, fmt.Errorf("list: %w", q.ArgsError)
+	}
+	outputs, err := s.db.Query(ctx, q)
 	if err != nil {
 		return nil, fmt.Errorf("list: %w", err)
 	}
+	if err = s.decodeRecords(ctx, outputs[0]); err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	return outputs[0], nil
+}
+
+// Find gets records with a given prefix that match the filter expression, in the order given by the sort expression,
+// e.g. `name == "Alice" && age > 30` and `age desc`. See db.ParseFilter and db.ParseSort for the syntax.
+// Use db.WithFields to return only selected fields of each value, and db.WithOrderBy or db.WithReverse to change the order.
+func (s *Store) Find(ctx context.Context, prefix, filter, sort string, offset, limit int, opts ...db.ScanOption) (rows []db.Record, err error) {
+	f, err := db.ParseFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("find: %w", err)
+	}
+	so, err := db.ParseSort(sort)
+	if err != nil {
+		return nil, fmt.Errorf("find: %w", err)
+	}
+	q := db.Find(prefix, f, so, offset, limit, opts...)
+	if q.ArgsError != nil {
+		return nil, fmt.Errorf("find: %w", q.ArgsError)
+	}
+	outputs, err := s.db.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("find: %w", err)
+	}
+	if err = s.decodeRecords(ctx, outputs[0]); err != nil {
+		return nil, fmt.Errorf("find: %w", err)
+	}
 	return outputs[0], nil
 }
 
@@ -146,12 +327,18 @@ func (s *Store) List(ctx context.Context, start, limit int) (rows []db.Record, e
 // If the version is -1, it will skip the version check.
 //
 // If the version is 0, it will only insert the key if it does not already exist.
+//
+// If the key has a JSON Schema, the value is validated before it's written, and a *ValidationError is returned if it's invalid.
 func (s *Store) Put(ctx context.Context, key string, version int64, value any) (err error) {
-	put := db.Put(key, version, value)
+	encoded, err := encode(s.codec, value)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	put := db.Put(key, version, encoded)
 	if put.ArgsError != nil {
 		return fmt.Errorf("put: %w", put.ArgsError)
 	}
-	if _, err = s.db.Mutate(ctx, put); err != nil {
+	if _, err = s.mutate(ctx, put); err != nil {
 		return fmt.Errorf("put: %w", err)
 	}
 	return nil
@@ -220,24 +407,198 @@ func (s *Store) CountRange(ctx context.Context, from, to string) (count int64, e
 	return count, nil
 }
 
+// AggregateRow is a row returned by Aggregate.
+type AggregateRow struct {
+	// Group is the value of the field the records were grouped by, or nil if they were not grouped.
+	Group any `json:"group"`
+	// Values are the results of each aggregation, in the order they were requested.
+	// Counts are int64 values, sums and averages are float64 values, and the minimum and maximum
+	// are float64 or string values. Averages, minimums and maximums are nil if there are no values.
+	Values []any `json:"values"`
+}
+
+// Aggregate aggregates the values of records with a given prefix, optionally grouped by the value at a JSON path.
+// e.g. store.Aggregate(ctx, "person/", "$.city", db.Aggregation{Func: db.AggregateCount}, db.Aggregation{Func: db.AggregateAvg, Path: "$.age"})
+func (s *Store) Aggregate(ctx context.Context, prefix, groupByPath string, aggregations ...db.Aggregation) (rows []AggregateRow, err error) {
+	query, err := db.Aggregate(prefix, groupByPath, aggregations...)
+	if err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	outputs, err := s.db.QueryRows(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	rows = make([]AggregateRow, len(outputs[0].Values))
+	for i, values := range outputs[0].Values {
+		if rows[i], err = newAggregateRow(values, aggregations); err != nil {
+			return nil, fmt.Errorf("aggregate: row %d: %w", i, err)
+		}
+	}
+	return rows, nil
+}
+
+func newAggregateRow(values []any, aggregations []db.Aggregation) (r AggregateRow, err error) {
+	if len(values) != len(aggregations)+1 {
+		return r, fmt.Errorf("expected %d columns, got %d", len(aggregations)+1, len(values))
+	}
+	if group, ok := values[0].(string); ok {
+		if err = json.Unmarshal([]byte(group), &r.Group); err != nil {
+			return r, fmt.Errorf("failed to unmarshal group: %w", err)
+		}
+	}
+	r.Values = make([]any, len(aggregations))
+	for i, a := range aggregations {
+		v := values[i+1]
+		switch a.Func {
+		case db.AggregateCount:
+			f, isFloat := v.(float64)
+			if isFloat {
+				v = int64(f)
+			}
+		default:
+			n, isInt := v.(int64)
+			if isInt {
+				v = float64(n)
+			}
+		}
+		r.Values[i] = v
+	}
+	return r, nil
+}
+
+// CreateSearchIndex creates, or replaces, a full-text search index over the values at the JSON paths
+// of records with the given prefix, e.g. store.CreateSearchIndex(ctx, "article/", "$.title", "$.body").
+// Existing records are indexed, and the index is kept up-to-date as records are written.
+func (s *Store) CreateSearchIndex(ctx context.Context, prefix string, paths ...string) (err error) {
+	mutations, err := db.CreateSearchIndex(prefix, paths)
+	if err != nil {
+		return fmt.Errorf("createsearchindex: %w", err)
+	}
+	if _, err = s.db.Mutate(ctx, mutations...); err != nil {
+		return fmt.Errorf("createsearchindex: %w", err)
+	}
+	return nil
+}
+
+// DropSearchIndex removes the full-text search index for the prefix.
+func (s *Store) DropSearchIndex(ctx context.Context, prefix string) (err error) {
+	if _, err = s.db.Mutate(ctx, db.DropSearchIndex(prefix)...); err != nil {
+		return fmt.Errorf("dropsearchindex: %w", err)
+	}
+	return nil
+}
+
+// SearchResult is a record returned by Search.
+type SearchResult struct {
+	Record db.Record `json:"record"`
+	// Snippet is the matching text, with matches surrounded by <mark> and </mark>.
+	Snippet string `json:"snippet"`
+	// Rank is the bm25 rank of the result. Lower values are better matches.
+	Rank float64 `json:"rank"`
+}
+
+// Search returns records with the given prefix that match the full-text search query, best match first.
+// The query uses the SQLite FTS5 query syntax, e.g. "sqlite AND (search OR index)".
+//
+// Only records covered by a search index created with CreateSearchIndex are returned. Only the
+// plaintext fields of encrypted values are indexed, see WithEncryption.
+func (s *Store) Search(ctx context.Context, prefix, query string, offset, limit int) (results []SearchResult, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.Search(prefix, query, offset, limit))
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	type row struct {
+		Key      string    `json:"key"`
+		Version  int64     `json:"version"`
+		Value    []byte    `json:"value"`
+		Encoding string    `json:"encoding"`
+		Created  time.Time `json:"created"`
+		Snippet  string    `json:"snippet"`
+		Rank     float64   `json:"rank"`
+	}
+	rows, err := RowsOf[row](outputs[0])
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	results = make([]SearchResult, len(rows))
+	for i, r := range rows {
+		record, err := s.decodeRecord(ctx, db.Record{
+			Key:      r.Key,
+			Version:  r.Version,
+			Value:    r.Value,
+			Encoding: r.Encoding,
+			Created:  r.Created,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("search: %w", err)
+		}
+		results[i] = SearchResult{
+			Record:  record,
+			Snippet: r.Snippet,
+			Rank:    r.Rank,
+		}
+	}
+	return results, nil
+}
+
 // Patch patches a key in the store. The patch is a JSON merge patch (RFC 7396), so would look something like map[string]any{"key": "value"}.
+//
+// If the key has a JSON Schema, the patched value is validated before it's written, and a *ValidationError is returned if it's invalid.
+// If the version is not -1 and doesn't match the current version, db.ErrVersionMismatch is returned.
+// Values that are compressed, encrypted or not JSON encoded can only be patched by a store with the same options,
+// otherwise ErrEncodedValuePatch is returned.
 func (s *Store) Patch(ctx context.Context, key string, version int64, patch any) (err error) {
+	if s.codec.Encoding() != db.EncodingJSON {
+		return fmt.Errorf("patch: values with the %q encoding cannot be patched", s.codec.Encoding())
+	}
 	patchMutation := db.Patch(key, version, patch)
 	if patchMutation.ArgsError != nil {
 		return fmt.Errorf("patch: %w", patchMutation.ArgsError)
 	}
-	if _, err = s.db.Mutate(ctx, patchMutation); err != nil {
+	if _, err = s.mutate(ctx, patchMutation); err != nil {
 		return fmt.Errorf("patch: %w", err)
 	}
 	return nil
 }
 
+// JSONPatch applies a JSON Patch (RFC 6902) to a key in the store, e.g.
+// []db.JSONPatchOperation{{Op: "add", Path: "/phone_numbers/-", Value: "123-456-7890"}}.
+//
+// The operations are applied in order. If any operation fails, including a test operation, no
+// changes are made and an error is returned. A failed test operation returns db.ErrJSONPatchTestFailed.
+//
+// If the version is -1, the patch is applied to the current value, and retried if the value is
+// changed by another writer before the patched value is written.
+func (s *Store) JSONPatch(ctx context.Context, key string, version int64, ops []db.JSONPatchOperation) (err error) {
+	if _, err = s.mutate(ctx, db.PutPatches(db.JSONPatchInput(key, version, ops))); err != nil {
+		return fmt.Errorf("jsonpatch: %w", err)
+	}
+	return nil
+}
+
 // Query runs a select query against the store, and returns the results.
+//
+// Encrypted values are decrypted if the query selects them as `coalesce(data, json(value)) as value, encoding`.
 func (s *Store) Query(ctx context.Context, query string, args map[string]any) (output []db.Record, err error) {
 	outputs, err := s.db.Query(ctx, db.Query{SQL: query, Args: args})
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
+	if err = s.decodeRecords(ctx, outputs[0]); err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return outputs[0], nil
+}
+
+// QueryRows runs a query against the store, and returns the columns and values of each row.
+// Unlike Query, the query can return any columns, e.g. from joins, json_each expansions or computed columns.
+//
+// Use RowsOf to scan the rows into structs.
+func (s *Store) QueryRows(ctx context.Context, query string, args map[string]any) (output db.Rows, err error) {
+	outputs, err := s.db.QueryRows(ctx, db.Query{SQL: query, Args: args})
+	if err != nil {
+		return output, fmt.Errorf("queryrows: %w", err)
+	}
 	return outputs[0], nil
 }
 
@@ -253,6 +614,8 @@ func (s *Store) Mutate(ctx context.Context, query string, args map[string]any) (
 // MutateAll runs the mutations against the store, in the order they are provided.
 //
 // Use the Put, Patch, PutPatches, Delete, DeleteKeys, DeletePrefix and DeleteRange functions to populate the operations argument.
+//
+// The values written by Put, Patch and PutPatches mutations are validated against the registered JSON Schemas before any mutation is run.
 func (s *Store) MutateAll(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
-	return s.db.Mutate(ctx, mutations...)
+	return s.mutate(ctx, mutations...)
 }
@@ -0,0 +1,88 @@
+package sqlitekv
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newAggregateTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		inputs := map[string]any{
+			"aggregate/alice":   map[string]any{"name": "Alice", "city": "London", "age": 40},
+			"aggregate/bob":     map[string]any{"name": "Bob", "city": "Paris", "age": 20},
+			"aggregate/charlie": map[string]any{"name": "Charlie", "city": "London", "age": 30.5},
+			"aggregate/david":   map[string]any{"name": "David", "city": "London"},
+			"aggregate/eve":     map[string]any{"name": "Eve", "age": 10},
+			"other/frank":       map[string]any{"name": "Frank", "city": "Paris", "age": 100},
+		}
+		for key, value := range inputs {
+			if err := store.Put(ctx, key, -1, value); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+		}
+
+		aggregations := []db.Aggregation{
+			{Func: db.AggregateCount},
+			{Func: db.AggregateCount, Path: "$.age"},
+			{Func: db.AggregateSum, Path: "$.age"},
+			{Func: db.AggregateMin, Path: "$.age"},
+			{Func: db.AggregateMax, Path: "age"},
+			{Func: db.AggregateAvg, Path: "$.age"},
+			{Func: db.AggregateMin, Path: "$.name"},
+		}
+
+		t.Run("Can aggregate without grouping", func(t *testing.T) {
+			actual, err := store.Aggregate(ctx, "aggregate/", "", aggregations...)
+			if err != nil {
+				t.Fatalf("unexpected error aggregating data: %v", err)
+			}
+			expected := []AggregateRow{
+				{Group: nil, Values: []any{int64(5), int64(4), 100.5, 10.0, 40.0, 25.125, "Alice"}},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Can group by a field", func(t *testing.T) {
+			actual, err := store.Aggregate(ctx, "aggregate/", "$.city", aggregations...)
+			if err != nil {
+				t.Fatalf("unexpected error aggregating data: %v", err)
+			}
+			expected := []AggregateRow{
+				{Group: nil, Values: []any{int64(1), int64(1), 10.0, 10.0, 10.0, 10.0, "Eve"}},
+				{Group: "London", Values: []any{int64(3), int64(2), 70.5, 30.5, 40.0, 35.25, "Alice"}},
+				{Group: "Paris", Values: []any{int64(1), int64(1), 20.0, 20.0, 20.0, 20.0, "Bob"}},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Groups with no values return nil averages", func(t *testing.T) {
+			actual, err := store.Aggregate(ctx, "aggregate/david", "", db.Aggregation{Func: db.AggregateSum, Path: "$.age"}, db.Aggregation{Func: db.AggregateAvg, Path: "$.age"})
+			if err != nil {
+				t.Fatalf("unexpected error aggregating data: %v", err)
+			}
+			expected := []AggregateRow{
+				{Group: nil, Values: []any{0.0, nil}},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Sum requires a path", func(t *testing.T) {
+			_, err := store.Aggregate(ctx, "aggregate/", "", db.Aggregation{Func: db.AggregateSum})
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.HasPrefix(err.Error(), "aggregate: ") {
+				t.Errorf("expected the error to be prefixed with the method name, got %q", err)
+			}
+		})
+	}
+}
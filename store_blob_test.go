@@ -0,0 +1,226 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newBlobTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		s := NewStore(store.db, WithBlobChunkSize(1024))
+
+		countChunks := func(t *testing.T) int64 {
+			t.Helper()
+			n, err := s.db.QueryScalarInt64(ctx, `select count(*) from kv_blob where key like 'blob/%';`, nil)
+			if err != nil {
+				t.Fatalf("unexpected error counting chunks: %v", err)
+			}
+			return n
+		}
+
+		data := make([]byte, 2500)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("unexpected error generating data: %v", err)
+		}
+
+		t.Run("Can put and get blobs", func(t *testing.T) {
+			info, err := s.PutBlob(ctx, "blob/a", -1, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			if info.Size != 2500 || info.Chunks != 3 {
+				t.Errorf("expected 2500 bytes in 3 chunks, got %d bytes in %d chunks", info.Size, info.Chunks)
+			}
+			var buf bytes.Buffer
+			actual, ok, err := s.GetBlob(ctx, "blob/a", &buf)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting blob: %v, ok=%v", err, ok)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("expected blob to match the data that was put")
+			}
+			if actual != info {
+				t.Errorf("expected %#v, got %#v", info, actual)
+			}
+		})
+		t.Run("The blob metadata is the value of the key", func(t *testing.T) {
+			var info BlobInfo
+			r, ok, err := s.Get(ctx, "blob/a", &info)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting metadata: %v, ok=%v", err, ok)
+			}
+			if info.Size != 2500 || r.Version != 1 {
+				t.Errorf("unexpected metadata: %#v, version %d", info, r.Version)
+			}
+		})
+		t.Run("Empty blobs can be stored", func(t *testing.T) {
+			if _, err := s.PutBlob(ctx, "blob/empty", -1, bytes.NewReader(nil)); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			var buf bytes.Buffer
+			info, ok, err := s.GetBlob(ctx, "blob/empty", &buf)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting blob: %v, ok=%v", err, ok)
+			}
+			if info.Size != 0 || buf.Len() != 0 {
+				t.Errorf("expected empty blob, got %d bytes", buf.Len())
+			}
+		})
+		t.Run("Missing blobs return ok=false", func(t *testing.T) {
+			_, ok, err := s.GetBlob(ctx, "blob/missing", &bytes.Buffer{})
+			if err != nil || ok {
+				t.Errorf("expected ok=false and no error, got ok=%v, err=%v", ok, err)
+			}
+		})
+		t.Run("Replacing a blob removes the old chunks", func(t *testing.T) {
+			if _, err := s.PutBlob(ctx, "blob/a", 1, bytes.NewReader(data[:100])); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			if n := countChunks(t); n != 1 {
+				t.Errorf("expected 1 chunk, got %d", n)
+			}
+			var buf bytes.Buffer
+			if _, _, err := s.GetBlob(ctx, "blob/a", &buf); err != nil {
+				t.Fatalf("unexpected error getting blob: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), data[:100]) {
+				t.Error("expected blob to be replaced")
+			}
+		})
+		t.Run("Version mismatches store nothing", func(t *testing.T) {
+			_, err := s.PutBlob(ctx, "blob/a", 1, bytes.NewReader(data))
+			if !errors.Is(err, db.ErrVersionMismatch) {
+				t.Fatalf("expected version mismatch, got %v", err)
+			}
+			if n := countChunks(t); n != 1 {
+				t.Errorf("expected the chunks of the failed blob to be removed, got %d chunks", n)
+			}
+		})
+		t.Run("Corrupted blobs fail the checksum", func(t *testing.T) {
+			if _, err := s.PutBlob(ctx, "blob/corrupt", -1, bytes.NewReader(data)); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			if _, err := s.Mutate(ctx, `update kv_blob set data = zeroblob(10) where key = 'blob/corrupt' and chunk = 1;`, nil); err != nil {
+				t.Fatalf("unexpected error corrupting blob: %v", err)
+			}
+			_, _, err := s.GetBlob(ctx, "blob/corrupt", &bytes.Buffer{})
+			if !errors.Is(err, ErrBlobChecksumMismatch) {
+				t.Errorf("expected checksum mismatch, got %v", err)
+			}
+		})
+		t.Run("Values that are not blobs return an error", func(t *testing.T) {
+			if err := s.Put(ctx, "blob/value", -1, Person{Name: "Alice"}); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			if _, _, err := s.GetBlob(ctx, "blob/value", &bytes.Buffer{}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+		t.Run("Concurrent writes to the same key keep each other's chunks", func(t *testing.T) {
+			if _, err := s.PutBlob(ctx, "blob/concurrent", -1, bytes.NewReader(data[:10])); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			small := NewStore(store.db, WithBlobChunkSize(4))
+			a, b := newSteppedReader(), newSteppedReader()
+			aErr, bErr := make(chan error), make(chan error)
+			go func() {
+				_, err := small.PutBlob(ctx, "blob/concurrent", -1, a)
+				aErr <- err
+			}()
+			go func() {
+				_, err := small.PutBlob(ctx, "blob/concurrent", -1, b)
+				bErr <- err
+			}()
+			// Both writers write their first chunk, then a finishes while b is still writing.
+			a.step("aaaa")
+			b.step("bbbb")
+			close(a.data)
+			if err := <-aErr; err != nil {
+				t.Fatalf("unexpected error putting the first blob: %v", err)
+			}
+			b.step("bbbb")
+			close(b.data)
+			if err := <-bErr; err != nil {
+				t.Fatalf("unexpected error putting the second blob: %v", err)
+			}
+			var buf bytes.Buffer
+			if _, _, err := s.GetBlob(ctx, "blob/concurrent", &buf); err != nil {
+				t.Fatalf("unexpected error getting blob: %v", err)
+			}
+			if buf.String() != "bbbbbbbb" {
+				t.Errorf("expected the second blob, got %q", buf.String())
+			}
+			n, err := s.db.QueryScalarInt64(ctx, `select count(*) from kv_blob where key = 'blob/concurrent';`, nil)
+			if err != nil {
+				t.Fatalf("unexpected error counting chunks: %v", err)
+			}
+			if n != 2 {
+				t.Errorf("expected only the chunks of the second blob, got %d chunks", n)
+			}
+			if _, err := s.Delete(ctx, "blob/concurrent"); err != nil {
+				t.Fatalf("unexpected error deleting: %v", err)
+			}
+		})
+		t.Run("Deleting keys deletes their blobs", func(t *testing.T) {
+			if _, err := s.Delete(ctx, "blob/a"); err != nil {
+				t.Fatalf("unexpected error deleting: %v", err)
+			}
+			if _, err := s.DeleteRange(ctx, "blob/corrupt", "blob/corrupu", 0, -1); err != nil {
+				t.Fatalf("unexpected error deleting range: %v", err)
+			}
+			if n := countChunks(t); n != 0 {
+				t.Errorf("expected no chunks, got %d", n)
+			}
+			if _, err := s.PutBlob(ctx, "blob/b", -1, bytes.NewReader(data)); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+			if _, err := s.DeletePrefix(ctx, "blob/", 0, -1); err != nil {
+				t.Fatalf("unexpected error deleting prefix: %v", err)
+			}
+			if n := countChunks(t); n != 0 {
+				t.Errorf("expected no chunks, got %d", n)
+			}
+		})
+	}
+}
+
+// steppedReader returns the data sent by step, one read at a time, so that tests can control when
+// each chunk of a blob is written.
+type steppedReader struct {
+	ready chan struct{}
+	data  chan string
+	// reading is true once the reader has been called for the data after the last step.
+	reading bool
+}
+
+func newSteppedReader() *steppedReader {
+	return &steppedReader{ready: make(chan struct{}), data: make(chan string)}
+}
+
+func (r *steppedReader) Read(p []byte) (n int, err error) {
+	r.ready <- struct{}{}
+	data, ok := <-r.data
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, data), nil
+}
+
+// step sends data to the reader, and waits until the reader has been called again, i.e. the data
+// has been written.
+func (r *steppedReader) step(data string) {
+	if !r.reading {
+		<-r.ready
+	}
+	r.data <- data
+	<-r.ready
+	r.reading = true
+}
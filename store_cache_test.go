@@ -0,0 +1,133 @@
+package sqlitekv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newCacheTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		get := func(t *testing.T, s *Store, key string) (p Person, ok bool) {
+			t.Helper()
+			_, ok, err := s.Get(ctx, key, &p)
+			if err != nil {
+				t.Fatalf("unexpected error getting %q: %v", key, err)
+			}
+			return p, ok
+		}
+		put := func(t *testing.T, s *Store, key, name string) {
+			t.Helper()
+			if err := s.Put(ctx, key, -1, Person{Name: name}); err != nil {
+				t.Fatalf("unexpected error putting %q: %v", key, err)
+			}
+		}
+		expectStats := func(t *testing.T, s *Store, hits, misses int64) {
+			t.Helper()
+			stats, ok := s.CacheStats()
+			if !ok {
+				t.Fatal("expected the store to have a cache")
+			}
+			if stats.Hits != hits || stats.Misses != misses {
+				t.Errorf("expected %d hits and %d misses, got %+v", hits, misses, stats)
+			}
+		}
+
+		t.Run("Gets are served from the cache", func(t *testing.T) {
+			s := NewStore(store.db, WithCache(CacheOptions{}))
+			put(t, s, "cache/a", "Alice")
+			for range 3 {
+				if p, ok := get(t, s, "cache/a"); !ok || p.Name != "Alice" {
+					t.Errorf("expected Alice, got %v", p)
+				}
+			}
+			expectStats(t, s, 2, 1)
+		})
+		t.Run("Writes invalidate the cache", func(t *testing.T) {
+			s := NewStore(store.db, WithCache(CacheOptions{}))
+			put(t, s, "cache/b", "Bob")
+			get(t, s, "cache/b")
+			put(t, s, "cache/b", "Robert")
+			if p, _ := get(t, s, "cache/b"); p.Name != "Robert" {
+				t.Errorf("expected put to invalidate the cache, got %v", p)
+			}
+			if err := s.Patch(ctx, "cache/b", -1, map[string]any{"name": "Rob"}); err != nil {
+				t.Fatalf("unexpected error patching: %v", err)
+			}
+			if p, _ := get(t, s, "cache/b"); p.Name != "Rob" {
+				t.Errorf("expected patch to invalidate the cache, got %v", p)
+			}
+			if _, err := s.MutateAll(ctx, db.Mutation{SQL: `update kv set value = jsonb('{"name":"Bobby"}') where key = 'cache/b'`}); err != nil {
+				t.Fatalf("unexpected error mutating: %v", err)
+			}
+			if p, _ := get(t, s, "cache/b"); p.Name != "Bobby" {
+				t.Errorf("expected mutations to clear the cache, got %v", p)
+			}
+			if _, err := s.Delete(ctx, "cache/b"); err != nil {
+				t.Fatalf("unexpected error deleting: %v", err)
+			}
+			if _, ok := get(t, s, "cache/b"); ok {
+				t.Error("expected delete to invalidate the cache")
+			}
+			expectStats(t, s, 0, 5)
+		})
+		t.Run("Writes made elsewhere are seen after revalidation", func(t *testing.T) {
+			// Writes made through the store don't pass through the cache's store, as if they were made by another process.
+			s := NewStore(store.db, WithCache(CacheOptions{Revalidate: time.Minute}))
+			now := time.Now()
+			s.cache.now = func() time.Time { return now }
+			put(t, s, "cache/c", "Charlie")
+			get(t, s, "cache/c")
+			put(t, store, "cache/c", "Chuck")
+			if p, _ := get(t, s, "cache/c"); p.Name != "Charlie" {
+				t.Errorf("expected the cached record to be used until it's revalidated, got %v", p)
+			}
+			now = now.Add(time.Minute)
+			if p, _ := get(t, s, "cache/c"); p.Name != "Chuck" {
+				t.Errorf("expected revalidation to find the new version, got %v", p)
+			}
+			now = now.Add(time.Minute)
+			if p, _ := get(t, s, "cache/c"); p.Name != "Chuck" {
+				t.Errorf("expected the current record to be revalidated, got %v", p)
+			}
+			stats, _ := s.CacheStats()
+			if stats.Revalidations != 2 || stats.Hits != 2 || stats.Misses != 2 {
+				t.Errorf("unexpected stats: %+v", stats)
+			}
+		})
+		t.Run("Records expire", func(t *testing.T) {
+			s := NewStore(store.db, WithCache(CacheOptions{TTL: time.Minute}))
+			now := time.Now()
+			s.cache.now = func() time.Time { return now }
+			put(t, s, "cache/d", "Dave")
+			get(t, s, "cache/d")
+			get(t, s, "cache/d")
+			now = now.Add(time.Minute)
+			get(t, s, "cache/d")
+			expectStats(t, s, 1, 2)
+		})
+		t.Run("Least recently used records are evicted", func(t *testing.T) {
+			s := NewStore(store.db, WithCache(CacheOptions{MaxEntries: 2}))
+			for i := range 3 {
+				put(t, s, fmt.Sprintf("cache/lru/%d", i), "Person")
+			}
+			get(t, s, "cache/lru/0")
+			get(t, s, "cache/lru/1")
+			get(t, s, "cache/lru/0")
+			get(t, s, "cache/lru/2")
+			stats, _ := s.CacheStats()
+			if stats.Entries != 2 || stats.Evictions != 1 {
+				t.Errorf("expected 2 entries and 1 eviction, got %+v", stats)
+			}
+			// 1 was least recently used, so it was evicted.
+			get(t, s, "cache/lru/0")
+			get(t, s, "cache/lru/1")
+			expectStats(t, s, 2, 4)
+		})
+	}
+}
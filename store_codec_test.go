@@ -0,0 +1,127 @@
+package sqlitekv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/apipb"
+)
+
+func newCodecTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		t.Run("JSONIter values can be queried", func(t *testing.T) {
+			s := NewStore(store.db, WithCodec(JSONIterCodec{}))
+			expected := Person{Name: "Alice", PhoneNumbers: []string{"123"}}
+			if err := s.Put(ctx, "codec/jsoniter", -1, expected); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			var actual Person
+			r, ok, err := s.Get(ctx, "codec/jsoniter", &actual)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting data: %v, ok=%v", err, ok)
+			}
+			if !actual.Equals(expected) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+			if r.Encoding != "" {
+				t.Errorf("expected JSON values to have no encoding, got %q", r.Encoding)
+			}
+			var name string
+			if _, ok, err = s.GetPath(ctx, "codec/jsoniter", "name", &name); err != nil || !ok || name != "Alice" {
+				t.Errorf("expected name to be queryable, got %q, ok=%v, err=%v", name, ok, err)
+			}
+		})
+		t.Run("ProtoJSON values can be queried", func(t *testing.T) {
+			s := NewStore(store.db, WithCodec(ProtoJSONCodec{}))
+			expected := &apipb.Method{Name: "GetPerson", RequestTypeUrl: "type.googleapis.com/Person"}
+			if err := s.Put(ctx, "codec/protojson", -1, expected); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			actual := &apipb.Method{}
+			if _, ok, err := s.Get(ctx, "codec/protojson", actual); err != nil || !ok {
+				t.Fatalf("unexpected error getting data: %v, ok=%v", err, ok)
+			}
+			if !proto.Equal(expected, actual) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+			var url string
+			if _, ok, err := s.GetPath(ctx, "codec/protojson", "requestTypeUrl", &url); err != nil || !ok || url != expected.RequestTypeUrl {
+				t.Errorf("expected requestTypeUrl to be queryable, got %q, ok=%v, err=%v", url, ok, err)
+			}
+			if err := s.Put(ctx, "codec/protojson", -1, Person{}); err == nil {
+				t.Error("expected error putting a value that isn't a proto.Message, got nil")
+			}
+		})
+		t.Run("Protobuf values are stored as blobs", func(t *testing.T) {
+			s := NewStore(store.db, WithCodec(ProtobufCodec{}))
+			expected := &apipb.Method{Name: "ListPeople", ResponseStreaming: true}
+			if err := s.Put(ctx, "codec/protobuf", -1, expected); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			actual := &apipb.Method{}
+			r, ok, err := s.Get(ctx, "codec/protobuf", actual)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting data: %v, ok=%v", err, ok)
+			}
+			if !proto.Equal(expected, actual) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+			if r.Encoding != "protobuf" {
+				t.Errorf("expected protobuf encoding, got %q", r.Encoding)
+			}
+			if err := s.Put(ctx, "codec/protobuf", 1, &apipb.Method{Name: "ListPeople", RequestStreaming: true}); err != nil {
+				t.Fatalf("unexpected error updating data: %v", err)
+			}
+
+			records, err := s.GetPrefix(ctx, "codec/protobuf", 0, -1)
+			if err != nil {
+				t.Fatalf("unexpected error getting prefix: %v", err)
+			}
+			values, err := ValuesOf[apipb.Method](records, s.Codec())
+			if err != nil {
+				t.Fatalf("unexpected error decoding values: %v", err)
+			}
+			if len(values) != 1 || !values[0].RequestStreaming || values[0].ResponseStreaming {
+				t.Errorf("unexpected values: %v", records)
+			}
+			if records[0].Version != 2 {
+				t.Errorf("expected version 2, got %d", records[0].Version)
+			}
+		})
+		t.Run("Protobuf values can be written with PutPatches", func(t *testing.T) {
+			data, err := proto.Marshal(&apipb.Method{Name: "DeletePerson"})
+			if err != nil {
+				t.Fatalf("unexpected error marshaling: %v", err)
+			}
+			_, err = store.MutateAll(ctx, db.PutPatches(db.PutInput("codec/putpatches", -1, db.Encoded{Encoding: "protobuf", Data: data})))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actual := &apipb.Method{}
+			if _, _, err = NewStore(store.db, WithCodec(ProtobufCodec{})).Get(ctx, "codec/putpatches", actual); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if actual.Name != "DeletePerson" {
+				t.Errorf("expected DeletePerson, got %q", actual.Name)
+			}
+		})
+		t.Run("Protobuf values cannot be patched", func(t *testing.T) {
+			s := NewStore(store.db, WithCodec(ProtobufCodec{}))
+			if err := s.Patch(ctx, "codec/protobuf", -1, map[string]any{"name": "x"}); err == nil {
+				t.Error("expected error, got nil")
+			}
+			if err := s.JSONPatch(ctx, "codec/protobuf", -1, []db.JSONPatchOperation{{Op: "remove", Path: "/name"}}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+		t.Run("Values with an unknown encoding cannot be decoded", func(t *testing.T) {
+			if _, _, err := store.Get(ctx, "codec/protobuf", &map[string]any{}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newCompressionTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		s := NewStore(store.db,
+			WithCompression("compression/", ZstdCompressor{}, 100),
+			WithCompression("compression/gzip/", GzipCompressor{}, 100),
+		)
+		large := Person{Name: "Alice", PhoneNumbers: strings.Split(strings.Repeat("123-456-7890,", 100), ",")}
+		small := Person{Name: "Bob"}
+
+		rawEncoding := func(t *testing.T, key string) string {
+			outputs, err := store.db.Query(ctx, db.Get(key))
+			if err != nil || len(outputs[0]) != 1 {
+				t.Fatalf("unexpected error querying %q: %v", key, err)
+			}
+			return outputs[0][0].Encoding
+		}
+
+		t.Run("Values above the threshold are compressed", func(t *testing.T) {
+			if err := s.Put(ctx, "compression/large", -1, large); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			if err := s.Put(ctx, "compression/gzip/large", -1, large); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			if err := s.Put(ctx, "compression/small", -1, small); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			if enc := rawEncoding(t, "compression/large"); enc != "json+zstd" {
+				t.Errorf("expected json+zstd encoding, got %q", enc)
+			}
+			if enc := rawEncoding(t, "compression/gzip/large"); enc != "json+gzip" {
+				t.Errorf("expected json+gzip encoding, got %q", enc)
+			}
+			if enc := rawEncoding(t, "compression/small"); enc != "" && enc != db.EncodingJSONB {
+				t.Errorf("expected small value to be stored as JSON, got %q", enc)
+			}
+		})
+		t.Run("Compressed values are decompressed when read", func(t *testing.T) {
+			var actual Person
+			r, _, err := store.Get(ctx, "compression/large", &actual)
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if !actual.Equals(large) {
+				t.Errorf("expected %d phone numbers, got %d", len(large.PhoneNumbers), len(actual.PhoneNumbers))
+			}
+			if r.Encoding != "" {
+				t.Errorf("expected decompressed JSON values to have no encoding, got %q", r.Encoding)
+			}
+			records, err := store.GetPrefix(ctx, "compression/", 0, -1)
+			if err != nil {
+				t.Fatalf("unexpected error getting prefix: %v", err)
+			}
+			values, err := ValuesOf[Person](records)
+			if err != nil {
+				t.Fatalf("unexpected error decoding values: %v", err)
+			}
+			if len(values) != 3 || !values[0].Equals(large) || !values[1].Equals(large) || !values[2].Equals(small) {
+				t.Errorf("unexpected values: %v", values)
+			}
+		})
+		t.Run("Paths within compressed values can't be read", func(t *testing.T) {
+			var name string
+			if _, ok, err := s.GetPath(ctx, "compression/large", "name", &name); err == nil || ok {
+				t.Errorf("expected an error reading a path of a compressed value, got %q, ok=%v, err=%v", name, ok, err)
+			}
+			if _, ok, err := s.GetPath(ctx, "compression/small", "name", &name); err != nil || !ok || name != "Bob" {
+				t.Errorf("expected the name of the uncompressed value, got %q, ok=%v, err=%v", name, ok, err)
+			}
+		})
+		t.Run("Compressed values can be patched", func(t *testing.T) {
+			if err := s.Patch(ctx, "compression/large", -1, map[string]any{"name": "Alicia"}); err != nil {
+				t.Fatalf("unexpected error patching data: %v", err)
+			}
+			var actual Person
+			if _, _, err := s.Get(ctx, "compression/large", &actual); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if actual.Name != "Alicia" || len(actual.PhoneNumbers) != len(large.PhoneNumbers) {
+				t.Errorf("unexpected value: %v", actual.Name)
+			}
+			if enc := rawEncoding(t, "compression/large"); enc != "json+zstd" {
+				t.Errorf("expected patched value to be compressed, got %q", enc)
+			}
+		})
+		t.Run("Compressed values can't be patched by a store that doesn't decompress them", func(t *testing.T) {
+			err := store.Patch(ctx, "compression/large", -1, map[string]any{"name": "Alice"})
+			if !errors.Is(err, ErrEncodedValuePatch) {
+				t.Errorf("expected encoded value patch error from Patch, got %v", err)
+			}
+			_, err = store.MutateAll(ctx, db.PutPatches(db.PatchInput("compression/large", -1, map[string]any{"name": "Alice"})))
+			if !errors.Is(err, ErrEncodedValuePatch) {
+				t.Errorf("expected encoded value patch error from PutPatches, got %v", err)
+			}
+			var actual Person
+			if _, _, err := s.Get(ctx, "compression/large", &actual); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if actual.Name != "Alicia" || len(actual.PhoneNumbers) != len(large.PhoneNumbers) {
+				t.Errorf("expected the value to be unchanged, got %q with %d phone numbers", actual.Name, len(actual.PhoneNumbers))
+			}
+			if enc := rawEncoding(t, "compression/large"); enc != "json+zstd" {
+				t.Errorf("expected value to stay compressed, got %q", enc)
+			}
+		})
+		t.Run("Compressed values can be encrypted", func(t *testing.T) {
+			keys, err := NewStaticKeyProvider("a", map[string][]byte{"a": bytes.Repeat([]byte{1}, 32)})
+			if err != nil {
+				t.Fatalf("unexpected error creating key provider: %v", err)
+			}
+			es := NewStore(store.db, WithCompression("", ZstdCompressor{}, 0), WithEncryption(keys, "name"))
+			if err := es.Put(ctx, "compression/encrypted", -1, large); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			if enc := rawEncoding(t, "compression/encrypted"); enc != "json+zstd+aes-gcm" {
+				t.Errorf("expected json+zstd+aes-gcm encoding, got %q", enc)
+			}
+			var actual Person
+			if _, _, err = es.Get(ctx, "compression/encrypted", &actual); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if !actual.Equals(large) {
+				t.Errorf("unexpected value: %v", actual)
+			}
+			stats, err := es.Stats(ctx, "compression/encrypted")
+			if err != nil {
+				t.Fatalf("unexpected error getting stats: %v", err)
+			}
+			if stats.Records != 1 || stats.CompressionRatio <= 1 {
+				t.Errorf("expected compressed and encrypted value to be smaller than the value, got %+v", stats)
+			}
+			if _, err = es.Delete(ctx, "compression/encrypted"); err != nil {
+				t.Fatalf("unexpected error deleting data: %v", err)
+			}
+		})
+		t.Run("Stats show the compression ratio", func(t *testing.T) {
+			stats, err := s.Stats(ctx, "compression/")
+			if err != nil {
+				t.Fatalf("unexpected error getting stats: %v", err)
+			}
+			if stats.Records != 3 {
+				t.Errorf("expected 3 records, got %d", stats.Records)
+			}
+			if len(stats.Encodings) != 3 {
+				t.Fatalf("expected 3 encodings, got %+v", stats.Encodings)
+			}
+			for _, es := range stats.Encodings {
+				switch es.Encoding {
+				case "json":
+					if es.Records != 1 || es.CompressionRatio != 1 {
+						t.Errorf("unexpected stats for uncompressed values: %+v", es)
+					}
+				case "json+zstd", "json+gzip":
+					if es.Records != 1 || es.CompressionRatio <= 5 {
+						t.Errorf("expected values to be compressed, got %+v", es)
+					}
+				default:
+					t.Errorf("unexpected encoding %q", es.Encoding)
+				}
+			}
+			if stats.UncompressedBytes <= stats.StoredBytes {
+				t.Errorf("expected uncompressed size to be larger than the stored size, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte("compress me "), 100)
+	for _, c := range []Compressor{ZstdCompressor{}, GzipCompressor{}} {
+		t.Run(c.Name(), func(t *testing.T) {
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatalf("unexpected error compressing: %v", err)
+			}
+			if len(compressed) >= len(data) {
+				t.Errorf("expected compressed data to be smaller than %d bytes, got %d", len(data), len(compressed))
+			}
+			actual, err := c.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("unexpected error decompressing: %v", err)
+			}
+			if !bytes.Equal(actual, data) {
+				t.Error("expected decompressed data to match")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newDataMigrationTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		type PersonV2 struct {
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+		}
+		put := func(t *testing.T, prefix string, n int) {
+			for i := range n {
+				if err := store.Put(ctx, fmt.Sprintf("%s%d", prefix, i), -1, Person{Name: fmt.Sprintf("Person %d", i)}); err != nil {
+					t.Fatalf("unexpected error putting data: %v", err)
+				}
+			}
+		}
+
+		t.Run("Values are migrated to the new type", func(t *testing.T) {
+			put(t, "datamigration/typed/", 5)
+			split := func(key string, p Person) (PersonV2, bool, error) {
+				first, last, ok := strings.Cut(p.Name, " ")
+				return PersonV2{FirstName: first, LastName: last}, ok, nil
+			}
+			result, err := MigrateValues(ctx, store, "typed", "datamigration/typed/", split)
+			if err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if expected := (DataMigrationResult{Migrated: 5, Completed: true}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+			var actual PersonV2
+			r, ok, err := store.Get(ctx, "datamigration/typed/3", &actual)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if actual.FirstName != "Person" || actual.LastName != "3" || r.Version != 2 {
+				t.Errorf("unexpected record: version %d, %+v", r.Version, actual)
+			}
+		})
+		t.Run("Completed migrations are not run again", func(t *testing.T) {
+			result, err := MigrateValues(ctx, store, "typed", "datamigration/typed/", func(key string, p Person) (Person, bool, error) {
+				return p, false, errors.New("unexpected call")
+			})
+			if err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if !result.Completed || result.Migrated != 5 {
+				t.Errorf("expected the previous result, got %+v", result)
+			}
+		})
+		t.Run("Migrations resume from the last batch", func(t *testing.T) {
+			put(t, "datamigration/resume/", 5)
+			var calls int
+			m := DataMigration{
+				Name:      "resume",
+				Prefix:    "datamigration/resume/",
+				BatchSize: 2,
+				Migrate: func(r db.Record) (value any, ok bool, err error) {
+					calls++
+					if r.Key == "datamigration/resume/3" {
+						return nil, false, errors.New("interrupted")
+					}
+					return map[string]any{"name": r.Key}, r.Key != "datamigration/resume/0", nil
+				},
+			}
+			result, err := store.MigrateData(ctx, m)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if expected := (DataMigrationResult{Migrated: 1, Skipped: 1}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+			calls = 0
+			m.Migrate = func(r db.Record) (value any, ok bool, err error) {
+				calls++
+				return map[string]any{"name": r.Key}, true, nil
+			}
+			if result, err = store.MigrateData(ctx, m); err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if calls != 3 {
+				t.Errorf("expected to resume from the third record, got %d calls", calls)
+			}
+			if expected := (DataMigrationResult{Migrated: 4, Skipped: 1, Completed: true}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+		})
+		t.Run("Migrations can be reset", func(t *testing.T) {
+			if err := store.ResetDataMigration(ctx, "resume"); err != nil {
+				t.Fatalf("unexpected error resetting migration: %v", err)
+			}
+			result, err := store.MigrateData(ctx, DataMigration{
+				Name:    "resume",
+				Prefix:  "datamigration/resume/",
+				Migrate: func(r db.Record) (value any, ok bool, err error) { return nil, false, nil },
+			})
+			if err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if expected := (DataMigrationResult{Skipped: 5, Completed: true}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+		})
+		t.Run("Records changed by other writers are migrated again", func(t *testing.T) {
+			put(t, "datamigration/conflict/", 3)
+			result, err := store.MigrateData(ctx, DataMigration{
+				Name:   "conflict",
+				Prefix: "datamigration/conflict/",
+				Migrate: func(r db.Record) (value any, ok bool, err error) {
+					// Change record 1 once, and record 2 every time it's migrated.
+					if (r.Key == "datamigration/conflict/1" && r.Version == 1) || r.Key == "datamigration/conflict/2" {
+						if _, err = store.db.Mutate(ctx, db.PutPatches(db.PutInput(r.Key, -1, Person{Name: "Changed"}))); err != nil {
+							return nil, false, err
+						}
+					}
+					return Person{Name: "Migrated"}, true, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			expected := DataMigrationResult{Migrated: 2, Conflicted: 1, ConflictedKeys: []string{"datamigration/conflict/2"}, Completed: true}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+			var actual Person
+			if _, _, err = store.Get(ctx, "datamigration/conflict/1", &actual); err != nil || actual.Name != "Migrated" {
+				t.Errorf("expected record 1 to be migrated, got %+v, %v", actual, err)
+			}
+			if _, _, err = store.Get(ctx, "datamigration/conflict/2", &actual); err != nil || actual.Name != "Changed" {
+				t.Errorf("expected record 2 to keep the other writer's change, got %+v, %v", actual, err)
+			}
+		})
+		t.Run("Conflicted records are migrated by the next run", func(t *testing.T) {
+			var migrated []string
+			result, err := store.MigrateData(ctx, DataMigration{
+				Name:   "conflict",
+				Prefix: "datamigration/conflict/",
+				Migrate: func(r db.Record) (value any, ok bool, err error) {
+					migrated = append(migrated, r.Key)
+					return Person{Name: "Migrated"}, true, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if expected := []string{"datamigration/conflict/2"}; !slices.Equal(migrated, expected) {
+				t.Errorf("expected only the conflicted record to be migrated, got %v", migrated)
+			}
+			if expected := (DataMigrationResult{Migrated: 3, Completed: true}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+		})
+		t.Run("Records aren't counted twice when a migration resumes after a conflict", func(t *testing.T) {
+			put(t, "datamigration/interrupted/", 2)
+			m := DataMigration{
+				Name:   "interrupted",
+				Prefix: "datamigration/interrupted/",
+				Migrate: func(r db.Record) (value any, ok bool, err error) {
+					if r.Key == "datamigration/interrupted/1" {
+						if r.Version > 1 {
+							return nil, false, errors.New("interrupted")
+						}
+						if _, err = store.db.Mutate(ctx, db.PutPatches(db.PutInput(r.Key, -1, Person{Name: "Changed"}))); err != nil {
+							return nil, false, err
+						}
+					}
+					return Person{Name: "Migrated"}, true, nil
+				},
+			}
+			result, err := store.MigrateData(ctx, m)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			expected := DataMigrationResult{Migrated: 1, Conflicted: 1, ConflictedKeys: []string{"datamigration/interrupted/1"}}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+			// Migrated records are skipped, so they would be counted again if the batch was run again.
+			m.Migrate = func(r db.Record) (value any, ok bool, err error) {
+				var p Person
+				if err = r.UnmarshalValue(&p); err != nil {
+					return nil, false, err
+				}
+				return Person{Name: "Migrated"}, p.Name != "Migrated", nil
+			}
+			if result, err = store.MigrateData(ctx, m); err != nil {
+				t.Fatalf("unexpected error migrating data: %v", err)
+			}
+			if expected := (DataMigrationResult{Migrated: 2, Completed: true}); !reflect.DeepEqual(result, expected) {
+				t.Errorf("expected %+v, got %+v", expected, result)
+			}
+		})
+		t.Run("Migrations can't change prefix", func(t *testing.T) {
+			_, err := store.MigrateData(ctx, DataMigration{
+				Name:    "conflict",
+				Prefix:  "datamigration/other/",
+				Migrate: func(r db.Record) (value any, ok bool, err error) { return nil, false, nil },
+			})
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
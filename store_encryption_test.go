@@ -0,0 +1,203 @@
+package sqlitekv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/apipb"
+)
+
+func newEncryptionTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		keys := map[string][]byte{
+			"2024": bytes.Repeat([]byte{1}, 32),
+			"2025": bytes.Repeat([]byte{2}, 32),
+		}
+		oldKeys, err := NewStaticKeyProvider("2024", keys)
+		if err != nil {
+			t.Fatalf("unexpected error creating key provider: %v", err)
+		}
+		newKeys, err := NewStaticKeyProvider("2025", keys)
+		if err != nil {
+			t.Fatalf("unexpected error creating key provider: %v", err)
+		}
+		s := NewStore(store.db, WithEncryption(oldKeys, "name"))
+
+		t.Run("Values are encrypted at rest", func(t *testing.T) {
+			expected := Person{Name: "Alice", PhoneNumbers: []string{"123-456-7890"}}
+			if err := s.Put(ctx, "encryption/alice", -1, expected); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			var actual Person
+			r, ok, err := s.Get(ctx, "encryption/alice", &actual)
+			if err != nil || !ok {
+				t.Fatalf("unexpected error getting data: %v, ok=%v", err, ok)
+			}
+			if !actual.Equals(expected) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+			if r.Encoding != "" {
+				t.Errorf("expected decrypted JSON values to have no encoding, got %q", r.Encoding)
+			}
+
+			if _, _, err = store.Get(ctx, "encryption/alice", &struct{}{}); err == nil {
+				t.Error("expected error getting encrypted data without a key provider, got nil")
+			}
+			outputs, err := store.db.Query(ctx, db.Get("encryption/alice"))
+			if err != nil {
+				t.Fatalf("unexpected error querying data: %v", err)
+			}
+			raw := outputs[0][0]
+			if raw.Encoding != "json+aes-gcm" {
+				t.Errorf("expected json+aes-gcm encoding, got %q", raw.Encoding)
+			}
+			if bytes.Contains(raw.Value, []byte("123-456-7890")) {
+				t.Error("expected value to be encrypted")
+			}
+		})
+		t.Run("Plaintext fields can be queried", func(t *testing.T) {
+			if err := s.Put(ctx, "encryption/bob", -1, Person{Name: "Bob", PhoneNumbers: []string{"234-567-8901"}}); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			records, err := s.Find(ctx, "encryption/", `name == "Bob"`, "", 0, -1)
+			if err != nil {
+				t.Fatalf("unexpected error finding data: %v", err)
+			}
+			values, err := ValuesOf[Person](records)
+			if err != nil {
+				t.Fatalf("unexpected error decoding values: %v", err)
+			}
+			if len(values) != 1 || values[0].Name != "Bob" || len(values[0].PhoneNumbers) != 1 {
+				t.Errorf("expected Bob's decrypted record, got %#v", values)
+			}
+			var name string
+			if _, ok, err := s.GetPath(ctx, "encryption/bob", "name", &name); err != nil || !ok || name != "Bob" {
+				t.Errorf("expected name to be queryable, got %q, ok=%v, err=%v", name, ok, err)
+			}
+			var numbers []string
+			if _, ok, err := s.GetPath(ctx, "encryption/bob", "phone_numbers", &numbers); err == nil || ok {
+				t.Errorf("expected an error reading phone numbers, got %v, ok=%v, err=%v", numbers, ok, err)
+			}
+		})
+		t.Run("Encrypted values can be patched", func(t *testing.T) {
+			if err := s.Patch(ctx, "encryption/bob", -1, map[string]any{"name": "Robert"}); err != nil {
+				t.Fatalf("unexpected error patching data: %v", err)
+			}
+			if err := s.JSONPatch(ctx, "encryption/bob", -1, []db.JSONPatchOperation{{Op: "add", Path: "/phone_numbers/-", Value: "345-678-9012"}}); err != nil {
+				t.Fatalf("unexpected error patching data: %v", err)
+			}
+			var actual Person
+			r, _, err := s.Get(ctx, "encryption/bob", &actual)
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			expected := Person{Name: "Robert", PhoneNumbers: []string{"234-567-8901", "345-678-9012"}}
+			if !actual.Equals(expected) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+			if r.Version != 3 {
+				t.Errorf("expected version 3, got %d", r.Version)
+			}
+			records, err := s.Find(ctx, "encryption/", `name == "Robert"`, "", 0, -1)
+			if err != nil || len(records) != 1 {
+				t.Errorf("expected patched plaintext field to be queryable, got %d records, err=%v", len(records), err)
+			}
+		})
+		t.Run("Values that aren't JSON can be encrypted", func(t *testing.T) {
+			ps := NewStore(store.db, WithCodec(ProtobufCodec{}), WithEncryption(oldKeys))
+			expected := &apipb.Method{Name: "GetPerson"}
+			if err := ps.Put(ctx, "encryption/method", -1, expected); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+			actual := &apipb.Method{}
+			r, _, err := ps.Get(ctx, "encryption/method", actual)
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if !proto.Equal(expected, actual) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+			if r.Encoding != "protobuf" {
+				t.Errorf("expected protobuf encoding, got %q", r.Encoding)
+			}
+		})
+		t.Run("Values can't be moved to another key", func(t *testing.T) {
+			_, err := store.Mutate(ctx, `update kv set data = (select data from kv where key = 'encryption/alice') where key = 'encryption/bob'`, nil)
+			if err != nil {
+				t.Fatalf("unexpected error copying data: %v", err)
+			}
+			if _, _, err = s.Get(ctx, "encryption/bob", &Person{}); err == nil {
+				t.Error("expected error decrypting a value copied from another key, got nil")
+			}
+			if _, err = store.Delete(ctx, "encryption/bob"); err != nil {
+				t.Fatalf("unexpected error deleting data: %v", err)
+			}
+		})
+		t.Run("Keys can be rotated", func(t *testing.T) {
+			rs := NewStore(store.db, WithEncryption(newKeys, "name"))
+			rotated, err := rs.RotateKeys(ctx, "encryption/", 1)
+			if err != nil {
+				t.Fatalf("unexpected error rotating keys: %v", err)
+			}
+			if rotated != 2 {
+				t.Errorf("expected 2 records to be rotated, got %d", rotated)
+			}
+			if rotated, err = rs.RotateKeys(ctx, "encryption/", 1); err != nil || rotated != 0 {
+				t.Errorf("expected no records to be rotated, got %d, err=%v", rotated, err)
+			}
+
+			onlyNewKey, err := NewStaticKeyProvider("2025", map[string][]byte{"2025": keys["2025"]})
+			if err != nil {
+				t.Fatalf("unexpected error creating key provider: %v", err)
+			}
+			var actual Person
+			if _, _, err = NewStore(store.db, WithEncryption(onlyNewKey)).Get(ctx, "encryption/alice", &actual); err != nil {
+				t.Fatalf("unexpected error getting data with the new key: %v", err)
+			}
+			if actual.Name != "Alice" {
+				t.Errorf("expected Alice, got %q", actual.Name)
+			}
+			method := &apipb.Method{}
+			if _, _, err = NewStore(store.db, WithCodec(ProtobufCodec{}), WithEncryption(onlyNewKey)).Get(ctx, "encryption/method", method); err != nil || method.Name != "GetPerson" {
+				t.Errorf("expected rotated protobuf value to be readable, got %v, err=%v", method, err)
+			}
+			records, err := rs.Find(ctx, "encryption/", `name == "Alice"`, "", 0, -1)
+			if err != nil || len(records) != 1 {
+				t.Errorf("expected plaintext fields to be queryable after rotation, got %d records, err=%v", len(records), err)
+			}
+		})
+		t.Run("Blobs can't be stored by stores that encrypt values", func(t *testing.T) {
+			_, err := s.PutBlob(ctx, "encryption/blob", -1, strings.NewReader("secret"))
+			if !errors.Is(err, ErrBlobEncryptionUnsupported) {
+				t.Fatalf("expected ErrBlobEncryptionUnsupported, got %v", err)
+			}
+			if _, ok, _ := s.GetBlob(ctx, "encryption/blob", io.Discard); ok {
+				t.Error("expected the blob not to be stored")
+			}
+		})
+		t.Run("Unknown keys can't be used", func(t *testing.T) {
+			onlyOldKey, err := NewStaticKeyProvider("2024", map[string][]byte{"2024": keys["2024"]})
+			if err != nil {
+				t.Fatalf("unexpected error creating key provider: %v", err)
+			}
+			_, _, err = NewStore(store.db, WithEncryption(onlyOldKey)).Get(ctx, "encryption/alice", &Person{})
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected ErrKeyNotFound, got %v", err)
+			}
+			if _, err = NewStaticKeyProvider("2026", keys); err == nil {
+				t.Error("expected error creating a key provider without the current key, got nil")
+			}
+			if _, err = NewStaticKeyProvider("short", map[string][]byte{"short": []byte("too short")}); err == nil {
+				t.Error("expected error creating a key provider with an invalid key, got nil")
+			}
+		})
+	}
+}
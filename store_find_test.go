@@ -0,0 +1,187 @@
+package sqlitekv
+
+import (
+	"context"
+	"testing"
+)
+
+type findTestData struct {
+	Name    string   `json:"name"`
+	Age     int      `json:"age"`
+	Tags    []string `json:"tags"`
+	Active  bool     `json:"active"`
+	Address *struct {
+		City string `json:"city"`
+	} `json:"address,omitempty"`
+}
+
+func newFindTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		inputs := map[string]any{
+			"find/alice":   map[string]any{"name": "Alice", "age": 42, "tags": []string{"admin", "x"}, "active": true, "address": map[string]any{"city": "London"}},
+			"find/bob":     map[string]any{"name": "Bob", "age": 25, "tags": []string{"x"}, "active": false},
+			"find/charlie": map[string]any{"name": "Charlie", "age": 31, "tags": []string{}, "active": true, "address": map[string]any{"city": "Paris"}},
+			"find/david":   map[string]any{"name": "David", "age": 31.5, "active": true, "nickname": nil},
+			"other/eve":    map[string]any{"name": "Eve", "age": 50, "tags": []string{"x"}, "active": true},
+		}
+		for key, value := range inputs {
+			if err := store.Put(ctx, key, -1, value); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name         string
+			filter       string
+			sort         string
+			offset       int
+			limit        int
+			expectedKeys []string
+		}{
+			{
+				name:         "An empty filter returns all records with the prefix",
+				filter:       "",
+				limit:        -1,
+				expectedKeys: []string{"find/alice", "find/bob", "find/charlie", "find/david"},
+			},
+			{
+				name:         "Can filter on string equality",
+				filter:       `name == "Alice"`,
+				limit:        -1,
+				expectedKeys: []string{"find/alice"},
+			},
+			{
+				name:         "Can filter on numeric comparisons",
+				filter:       `age > 30 && age <= 42`,
+				limit:        -1,
+				expectedKeys: []string{"find/alice", "find/charlie", "find/david"},
+			},
+			{
+				name:         "Can filter on booleans",
+				filter:       `active == false`,
+				limit:        -1,
+				expectedKeys: []string{"find/bob"},
+			},
+			{
+				name:         "Can filter on array membership",
+				filter:       `tags contains "x"`,
+				limit:        -1,
+				expectedKeys: []string{"find/alice", "find/bob"},
+			},
+			{
+				name:         "Can filter on substrings",
+				filter:       `name contains "li"`,
+				limit:        -1,
+				expectedKeys: []string{"find/alice", "find/charlie"},
+			},
+			{
+				name:         "Can filter on nested fields",
+				filter:       `address.city == "Paris"`,
+				limit:        -1,
+				expectedKeys: []string{"find/charlie"},
+			},
+			{
+				name:         "Can filter on array elements",
+				filter:       `$.tags[0] == "admin"`,
+				limit:        -1,
+				expectedKeys: []string{"find/alice"},
+			},
+			{
+				name:         "Can filter on null and missing fields",
+				filter:       `address == null`,
+				limit:        -1,
+				expectedKeys: []string{"find/bob", "find/david"},
+			},
+			{
+				name:         "Can combine with or, not and parentheses",
+				filter:       `!(age < 30 || name == "Alice") && (active == true || tags contains "admin")`,
+				limit:        -1,
+				expectedKeys: []string{"find/charlie", "find/david"},
+			},
+			{
+				name:         "Can filter on the key",
+				filter:       `key >= "find/c"`,
+				limit:        -1,
+				expectedKeys: []string{"find/charlie", "find/david"},
+			},
+			{
+				name:         "Can sort by a field",
+				filter:       `active == true`,
+				sort:         "age desc",
+				limit:        -1,
+				expectedKeys: []string{"find/alice", "find/david", "find/charlie"},
+			},
+			{
+				name:         "Can sort by multiple fields",
+				sort:         "active, name desc",
+				limit:        -1,
+				expectedKeys: []string{"find/bob", "find/david", "find/charlie", "find/alice"},
+			},
+			{
+				name:         "Can offset and limit",
+				sort:         "key desc",
+				offset:       1,
+				limit:        2,
+				expectedKeys: []string{"find/charlie", "find/bob"},
+			},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				actual, err := store.Find(ctx, "find/", test.filter, test.sort, test.offset, test.limit)
+				if err != nil {
+					t.Fatalf("unexpected error finding data: %v", err)
+				}
+				actualKeys := make([]string, len(actual))
+				for i, r := range actual {
+					actualKeys[i] = r.Key
+				}
+				if len(test.expectedKeys) != len(actualKeys) {
+					t.Fatalf("expected keys %#v, got keys %#v", test.expectedKeys, actualKeys)
+				}
+				for i, expectedKey := range test.expectedKeys {
+					if expectedKey != actualKeys[i] {
+						t.Errorf("index %d: expected key %q, got %q", i, expectedKey, actualKeys[i])
+					}
+				}
+			})
+		}
+		t.Run("Values can be unmarshaled", func(t *testing.T) {
+			actual, err := store.Find(ctx, "find/", `name == "Alice"`, "", 0, -1)
+			if err != nil {
+				t.Fatalf("unexpected error finding data: %v", err)
+			}
+			values, err := ValuesOf[findTestData](actual)
+			if err != nil {
+				t.Fatalf("unexpected error getting values: %v", err)
+			}
+			if len(values) != 1 || values[0].Address == nil || values[0].Address.City != "London" {
+				t.Errorf("unexpected values: %#v", values)
+			}
+		})
+		t.Run("Invalid expressions return an error", func(t *testing.T) {
+			invalid := []struct {
+				filter string
+				sort   string
+			}{
+				{filter: `name ==`},
+				{filter: `name = "Alice"`},
+				{filter: `name == "Alice" &&`},
+				{filter: `(name == "Alice"`},
+				{filter: `name == "Alice`},
+				{filter: `age > true`},
+				{filter: `name == Alice`},
+				{filter: `name == "Alice"; drop table kv`},
+				{sort: `name sideways`},
+				{sort: `name,`},
+			}
+			for _, test := range invalid {
+				_, err := store.Find(ctx, "find/", test.filter, test.sort, 0, -1)
+				if err == nil {
+					t.Errorf("filter %q, sort %q: expected error, got nil", test.filter, test.sort)
+				}
+			}
+		})
+	}
+}
@@ -33,6 +33,25 @@ func newGetTest(ctx context.Context, store *Store) func(t *testing.T) {
 				t.Errorf("expected version 1, got %d", r.Version)
 			}
 		})
+		t.Run("Can get the version without unmarshaling the value", func(t *testing.T) {
+			r, ok, err := store.Get(ctx, "get", nil)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Error("expected data to be found")
+			}
+			if r.Version != 1 {
+				t.Errorf("expected version 1, got %d", r.Version)
+			}
+			var actual Person
+			if err = r.UnmarshalValue(&actual); err != nil {
+				t.Errorf("unexpected error unmarshaling value: %v", err)
+			}
+			if !expected.Equals(actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
 		t.Run("Returns ok=false if the key does not exist", func(t *testing.T) {
 			var actual Person
 			_, ok, err := store.Get(ctx, "get-does-not-exist", &actual)
@@ -0,0 +1,96 @@
+package sqlitekv
+
+import (
+	"context"
+	"testing"
+)
+
+func newGetPathTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		data := Person{
+			Name:         "Alice",
+			PhoneNumbers: []string{"123-456-7890", "234-567-8901"},
+		}
+		if err := store.Put(ctx, "getpath", -1, data); err != nil {
+			t.Errorf("unexpected error putting data: %v", err)
+		}
+
+		t.Run("Can get a string field", func(t *testing.T) {
+			var name string
+			r, ok, err := store.GetPath(ctx, "getpath", "$.name", &name)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Error("expected data to be found")
+			}
+			if name != data.Name {
+				t.Errorf("expected %q, got %q", data.Name, name)
+			}
+			if r.Version != 1 {
+				t.Errorf("expected version 1, got %d", r.Version)
+			}
+		})
+		t.Run("The $ prefix is optional", func(t *testing.T) {
+			var name string
+			_, ok, err := store.GetPath(ctx, "getpath", "name", &name)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Error("expected data to be found")
+			}
+			if name != data.Name {
+				t.Errorf("expected %q, got %q", data.Name, name)
+			}
+		})
+		t.Run("Can get an array field", func(t *testing.T) {
+			var phoneNumbers []string
+			_, ok, err := store.GetPath(ctx, "getpath", "$.phone_numbers", &phoneNumbers)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Error("expected data to be found")
+			}
+			if len(phoneNumbers) != 2 || phoneNumbers[1] != data.PhoneNumbers[1] {
+				t.Errorf("expected %#v, got %#v", data.PhoneNumbers, phoneNumbers)
+			}
+		})
+		t.Run("Can get an array element", func(t *testing.T) {
+			var phoneNumber string
+			_, ok, err := store.GetPath(ctx, "getpath", "$.phone_numbers[1]", &phoneNumber)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Error("expected data to be found")
+			}
+			if phoneNumber != data.PhoneNumbers[1] {
+				t.Errorf("expected %q, got %q", data.PhoneNumbers[1], phoneNumber)
+			}
+		})
+		t.Run("Returns ok=false if the path does not exist", func(t *testing.T) {
+			var v any
+			_, ok, err := store.GetPath(ctx, "getpath", "$.does_not_exist", &v)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if ok {
+				t.Error("expected data not to be found")
+			}
+		})
+		t.Run("Returns ok=false if the key does not exist", func(t *testing.T) {
+			var v any
+			_, ok, err := store.GetPath(ctx, "getpath-does-not-exist", "$.name", &v)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if ok {
+				t.Error("expected data not to be found")
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 func newGetPrefixTest(ctx context.Context, store *Store) func(t *testing.T) {
@@ -74,6 +77,55 @@ func newGetPrefixTest(ctx context.Context, store *Store) func(t *testing.T) {
 				t.Errorf("expected %#v, got %#v", expected[1:], actualValues)
 			}
 		})
+		t.Run("Can select fields", func(t *testing.T) {
+			actual, err := store.GetPrefix(ctx, "getprefix", 0, -1, db.WithFields("name"))
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			actualValues, err := ValuesOf[map[string]any](actual)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			if len(actualValues) != len(expected) {
+				t.Fatalf("expected %d records, got %d", len(expected), len(actualValues))
+			}
+			for i, v := range actualValues {
+				if len(v) != 1 {
+					t.Errorf("index %d: expected only the name field, got %#v", i, v)
+				}
+				if v["name"] != expected[i].Name {
+					t.Errorf("index %d: expected name %q, got %v", i, expected[i].Name, v["name"])
+				}
+			}
+		})
+		t.Run("Can get the latest records by created time", func(t *testing.T) {
+			defer store.DeletePrefix(ctx, "getprefix-created/", 0, -1)
+			insertTimes := []time.Time{
+				time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC),
+				time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+			}
+			for i, person := range expected {
+				db.TestTime = insertTimes[i]
+				if err := store.Put(ctx, "getprefix-created/"+strings.ToLower(person.Name), -1, person); err != nil {
+					t.Errorf("unexpected error putting data: %v", err)
+				}
+			}
+			db.TestTime = time.Time{}
+
+			actual, err := store.GetPrefix(ctx, "getprefix-created/", 0, 2, db.WithOrderBy(db.Sort{{Field: "created"}}), db.WithReverse())
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			actualValues, err := ValuesOf[Person](actual)
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			latest := []Person{expected[0], expected[2]}
+			if !personSliceIsEqual(latest, actualValues) {
+				t.Errorf("expected %#v, got %#v", latest, actualValues)
+			}
+		})
 		t.Run("Outside the prefix, no records are returned", func(t *testing.T) {
 			actual, err := store.GetPrefix(ctx, "getprefix/zzz", 0, -1)
 			if err != nil {
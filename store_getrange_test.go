@@ -4,6 +4,8 @@ import (
 	"context"
 	"strings"
 	"testing"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 func newGetRangeTest(ctx context.Context, store *Store) func(t *testing.T) {
@@ -70,6 +72,20 @@ func newGetRangeTest(ctx context.Context, store *Store) func(t *testing.T) {
 				t.Errorf("expected %#v, got %#v", expected[1:3], actualValues)
 			}
 		})
+		t.Run("Can get range in reverse order", func(t *testing.T) {
+			actual, err := store.GetRange(ctx, "getrange/c", "getrange/e", 0, -1, db.WithReverse())
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			actualValues, err := ValuesOf[Person](actual)
+			if err != nil {
+				t.Errorf("unexpected error converting rows: %v", err)
+			}
+			reversed := []Person{expected[2], expected[1]}
+			if !personSliceIsEqual(reversed, actualValues) {
+				t.Errorf("expected %#v, got %#v", reversed, actualValues)
+			}
+		})
 		t.Run("Can limit the number of results", func(t *testing.T) {
 			actual, err := store.GetRange(ctx, "getrange/a", "getrange/z", 0, 2)
 			if err != nil {
@@ -0,0 +1,196 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newJSONPatchTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		get := func(t *testing.T, key string) (p Person, version int64) {
+			t.Helper()
+			r, ok, err := store.Get(ctx, key, &p)
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if !ok {
+				t.Fatalf("expected %q to exist", key)
+			}
+			return p, r.Version
+		}
+
+		if err := store.Put(ctx, "jsonpatch/alice", -1, Person{Name: "Alice", PhoneNumbers: []string{"123", "456"}}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+
+		t.Run("Can append to and remove from arrays", func(t *testing.T) {
+			err := store.JSONPatch(ctx, "jsonpatch/alice", -1, []db.JSONPatchOperation{
+				{Op: "remove", Path: "/phone_numbers/0"},
+				{Op: "add", Path: "/phone_numbers/-", Value: "789"},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actual, version := get(t, "jsonpatch/alice")
+			expected := Person{Name: "Alice", PhoneNumbers: []string{"456", "789"}}
+			if !actual.Equals(expected) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+			if version != 2 {
+				t.Errorf("expected version 2, got %d", version)
+			}
+		})
+		t.Run("A failed test operation makes no changes", func(t *testing.T) {
+			err := store.JSONPatch(ctx, "jsonpatch/alice", -1, []db.JSONPatchOperation{
+				{Op: "replace", Path: "/name", Value: "Bob"},
+				{Op: "test", Path: "/phone_numbers/0", Value: "123"},
+			})
+			if !errors.Is(err, db.ErrJSONPatchTestFailed) {
+				t.Fatalf("expected test failure, got %v", err)
+			}
+			actual, version := get(t, "jsonpatch/alice")
+			if actual.Name != "Alice" {
+				t.Errorf("expected name to be unchanged, got %q", actual.Name)
+			}
+			if version != 2 {
+				t.Errorf("expected version 2, got %d", version)
+			}
+		})
+		t.Run("A passing test operation allows the changes", func(t *testing.T) {
+			err := store.JSONPatch(ctx, "jsonpatch/alice", 2, []db.JSONPatchOperation{
+				{Op: "test", Path: "/phone_numbers/0", Value: "456"},
+				{Op: "replace", Path: "/name", Value: "Alicia"},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actual, _ := get(t, "jsonpatch/alice")
+			if actual.Name != "Alicia" {
+				t.Errorf("expected name to be Alicia, got %q", actual.Name)
+			}
+		})
+		t.Run("Version mismatches are returned", func(t *testing.T) {
+			err := store.JSONPatch(ctx, "jsonpatch/alice", 1, []db.JSONPatchOperation{
+				{Op: "replace", Path: "/name", Value: "Alice"},
+			})
+			if !errors.Is(err, db.ErrVersionMismatch) {
+				t.Errorf("expected version mismatch, got %v", err)
+			}
+		})
+		t.Run("Invalid paths return an error", func(t *testing.T) {
+			err := store.JSONPatch(ctx, "jsonpatch/alice", -1, []db.JSONPatchOperation{
+				{Op: "remove", Path: "/missing"},
+			})
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+		t.Run("Can be used in PutPatches", func(t *testing.T) {
+			_, err := store.MutateAll(ctx, db.PutPatches(
+				db.PutInput("jsonpatch/bob", -1, Person{Name: "Bob"}),
+				db.JSONPatchInput("jsonpatch/bob", -1, []db.JSONPatchOperation{
+					{Op: "add", Path: "/phone_numbers", Value: []string{"111"}},
+				}),
+				db.JSONPatchInput("jsonpatch/alice", -1, []db.JSONPatchOperation{
+					{Op: "copy", From: "/phone_numbers", Path: "/old_numbers"},
+					{Op: "move", From: "/old_numbers", Path: "/previous_numbers"},
+				}),
+			))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			bob, _ := get(t, "jsonpatch/bob")
+			if expected := (Person{Name: "Bob", PhoneNumbers: []string{"111"}}); !bob.Equals(expected) {
+				t.Errorf("expected %#v, got %#v", expected, bob)
+			}
+			var alice map[string]any
+			if _, _, err = store.Get(ctx, "jsonpatch/alice", &alice); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if _, ok := alice["old_numbers"]; ok {
+				t.Errorf("expected old_numbers to be moved, got %v", alice)
+			}
+			if _, ok := alice["previous_numbers"]; !ok {
+				t.Errorf("expected previous_numbers to be set, got %v", alice)
+			}
+		})
+		t.Run("A failed test in PutPatches makes no changes", func(t *testing.T) {
+			_, err := store.MutateAll(ctx, db.PutPatches(
+				db.PutInput("jsonpatch/charlie", -1, Person{Name: "Charlie"}),
+				db.JSONPatchInput("jsonpatch/bob", -1, []db.JSONPatchOperation{
+					{Op: "test", Path: "/name", Value: "Robert"},
+				}),
+			))
+			if !errors.Is(err, db.ErrJSONPatchTestFailed) {
+				t.Fatalf("expected test failure, got %v", err)
+			}
+			if _, ok, _ := store.Get(ctx, "jsonpatch/charlie", &Person{}); ok {
+				t.Error("expected no entries to be stored")
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		patch    string
+		expected string
+		err      bool
+	}{
+		{name: "Add an object member", doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"}]`, expected: `{"baz":"qux","foo":"bar"}`},
+		{name: "Add an array element", doc: `{"foo":["bar","baz"]}`, patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, expected: `{"foo":["bar","qux","baz"]}`},
+		{name: "Remove an object member", doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"remove","path":"/baz"}]`, expected: `{"foo":"bar"}`},
+		{name: "Remove an array element", doc: `{"foo":["bar","qux","baz"]}`, patch: `[{"op":"remove","path":"/foo/1"}]`, expected: `{"foo":["bar","baz"]}`},
+		{name: "Replace a value", doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, expected: `{"baz":"boo","foo":"bar"}`},
+		{name: "Move a value", doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{name: "Move an array element", doc: `{"foo":["all","grass","cows","eat"]}`, patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, expected: `{"foo":["all","cows","eat","grass"]}`},
+		{name: "Copy a value", doc: `{"foo":{"bar":1}}`, patch: `[{"op":"copy","from":"/foo","path":"/baz"}]`, expected: `{"baz":{"bar":1},"foo":{"bar":1}}`},
+		{name: "Test a value", doc: `{"baz":"qux","foo":["a",2,"c"]}`, patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, expected: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{name: "Test a value fails", doc: `{"baz":"qux"}`, patch: `[{"op":"test","path":"/baz","value":"bar"}]`, err: true},
+		{name: "Add to a nonexistent target fails", doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, err: true},
+		{name: "Escaped pointers", doc: `{"a/b":1,"m~n":2}`, patch: `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/m~0n","value":3}]`, expected: `{"m~n":3}`},
+		{name: "Replace the whole document", doc: `{"foo":"bar"}`, patch: `[{"op":"replace","path":"","value":[1]}]`, expected: `[1]`},
+		{name: "Append to an array", doc: `{"foo":[1]}`, patch: `[{"op":"add","path":"/foo/-","value":2}]`, expected: `{"foo":[1,2]}`},
+		{name: "Out of range index fails", doc: `{"foo":[1]}`, patch: `[{"op":"add","path":"/foo/2","value":2}]`, err: true},
+		{name: "Leading zero index fails", doc: `{"foo":[1,2]}`, patch: `[{"op":"remove","path":"/foo/01"}]`, err: true},
+		{name: "Move into a child fails", doc: `{"foo":{"bar":1}}`, patch: `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, err: true},
+		{name: "Unknown operations fail", doc: `{}`, patch: `[{"op":"frobnicate","path":"/foo"}]`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var doc any
+			if err := json.Unmarshal([]byte(test.doc), &doc); err != nil {
+				t.Fatalf("invalid doc: %v", err)
+			}
+			ops, err := decodeJSONPatch(json.RawMessage(test.patch))
+			if err != nil {
+				t.Fatalf("invalid patch: %v", err)
+			}
+			actual, err := applyJSONPatch(doc, ops)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actualJSON, err := json.Marshal(actual)
+			if err != nil {
+				t.Fatalf("unexpected error marshaling result: %v", err)
+			}
+			if string(actualJSON) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actualJSON)
+			}
+		})
+	}
+}
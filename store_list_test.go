@@ -4,6 +4,8 @@ import (
 	"context"
 	"strings"
 	"testing"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 func newListTest(ctx context.Context, store *Store) func(t *testing.T) {
@@ -69,6 +71,54 @@ func newListTest(ctx context.Context, store *Store) func(t *testing.T) {
 				t.Errorf("expected %#v, got %#v", expected[:2], actualValues)
 			}
 		})
+		t.Run("Can select nested fields", func(t *testing.T) {
+			actual, err := store.List(ctx, 0, 1, db.WithFields("$.name", "$.phone_numbers", "$.address.city"))
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if len(actual) != 1 {
+				t.Fatalf("expected 1 record, got %d", len(actual))
+			}
+			expectedValue := `{"name":"Alice","phone_numbers":["123-456-7890"],"address":{"city":null}}`
+			if string(actual[0].Value) != expectedValue {
+				t.Errorf("expected %s, got %s", expectedValue, string(actual[0].Value))
+			}
+		})
+		t.Run("Can't select array elements", func(t *testing.T) {
+			for _, path := range []string{"$.phone_numbers[0]", "$.phone_numbers[1]", "phone_numbers[1].number"} {
+				if _, err := store.List(ctx, 0, 1, db.WithFields("$.name", path)); err == nil {
+					t.Errorf("%s: expected an error", path)
+				}
+			}
+		})
+		t.Run("Can list in reverse order", func(t *testing.T) {
+			actual, err := store.List(ctx, 0, 2, db.WithReverse())
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			actualValues, err := ValuesOf[Person](actual)
+			if err != nil {
+				t.Errorf("unexpected error getting values: %v", err)
+			}
+			reversed := []Person{expected[5], expected[4]}
+			if !personSliceIsEqual(reversed, actualValues) {
+				t.Errorf("expected %#v, got %#v", reversed, actualValues)
+			}
+		})
+		t.Run("Can order by a JSON path", func(t *testing.T) {
+			actual, err := store.List(ctx, 0, 2, db.WithOrderBy(db.Sort{{Field: "$.phone_numbers[0]", Desc: true}}))
+			if err != nil {
+				t.Errorf("unexpected error getting data: %v", err)
+			}
+			actualValues, err := ValuesOf[Person](actual)
+			if err != nil {
+				t.Errorf("unexpected error getting values: %v", err)
+			}
+			ordered := []Person{expected[5], expected[4]}
+			if !personSliceIsEqual(ordered, actualValues) {
+				t.Errorf("expected %#v, got %#v", ordered, actualValues)
+			}
+		})
 		t.Run("Can offset the results", func(t *testing.T) {
 			actual, err := store.List(ctx, 1, -1)
 			if err != nil {
@@ -0,0 +1,78 @@
+package sqlitekv
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newMigrateTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		migrations, err := db.Migrations()
+		if err != nil {
+			t.Fatalf("unexpected error getting migrations: %v", err)
+		}
+		t.Run("Init applies all migrations", func(t *testing.T) {
+			pending, err := store.PendingMigrations(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error getting pending migrations: %v", err)
+			}
+			if len(pending) != 0 {
+				t.Errorf("expected no pending migrations, got %v", pending)
+			}
+			rows, err := store.QueryRows(ctx, `select version, name from schema_version order by version`, nil)
+			if err != nil {
+				t.Fatalf("unexpected error querying schema_version: %v", err)
+			}
+			type row struct {
+				Version int    `json:"version"`
+				Name    string `json:"name"`
+			}
+			versions, err := RowsOf[row](rows)
+			if err != nil {
+				t.Fatalf("unexpected error scanning rows: %v", err)
+			}
+			if len(versions) != len(migrations) {
+				t.Fatalf("expected %d versions, got %v", len(migrations), versions)
+			}
+			for i, v := range versions {
+				if v.Version != migrations[i].Version || v.Name != migrations[i].Name {
+					t.Errorf("expected version %v, got %v", migrations[i], v)
+				}
+			}
+		})
+		t.Run("Migrate can be run more than once", func(t *testing.T) {
+			applied, err := store.Migrate(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error migrating: %v", err)
+			}
+			if len(applied) != 0 {
+				t.Errorf("expected no migrations to be applied, got %v", applied)
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := db.Migrations()
+	if err != nil {
+		t.Fatalf("unexpected error getting migrations: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].String() != "0001_init" {
+		t.Fatalf("expected the first migration to be 0001_init, got %v", migrations)
+	}
+	var triggers int
+	for _, stmt := range migrations[0].Statements {
+		if !strings.HasSuffix(stmt, ";") {
+			t.Errorf("expected statement to end with a semicolon, got %q", stmt)
+		}
+		if strings.HasPrefix(stmt, "create trigger") {
+			triggers++
+		}
+	}
+	if triggers != 5 {
+		t.Errorf("expected 5 triggers, got %d", triggers)
+	}
+}
@@ -2,7 +2,10 @@ package sqlitekv
 
 import (
 	"context"
+	"errors"
 	"testing"
+
+	"github.com/a-h/sqlitekv/db"
 )
 
 func newPatchTest(ctx context.Context, store *Store) func(t *testing.T) {
@@ -73,6 +76,32 @@ func newPatchTest(ctx context.Context, store *Store) func(t *testing.T) {
 				t.Errorf("expected name %q, got %q", patch["name"].(string), updated.Name)
 			}
 		})
+		t.Run("Patching with the wrong version returns ErrVersionMismatch", func(t *testing.T) {
+			defer store.DeletePrefix(ctx, "*", 0, -1)
+
+			// Patches made by the compressing store are resolved into puts, while the others are run as they are.
+			stores := map[string]*Store{
+				"unresolved": store,
+				"resolved":   NewStore(store.db, WithCompression("patch-version/", ZstdCompressor{}, 100)),
+			}
+			for name, s := range stores {
+				key := "patch-version/" + name
+				if err := s.Put(ctx, key, -1, Person{Name: "Jess"}); err != nil {
+					t.Fatalf("%s: unexpected error putting data: %v", name, err)
+				}
+				err := s.Patch(ctx, key, 3, map[string]any{"name": "Jessie"})
+				if !errors.Is(err, db.ErrVersionMismatch) {
+					t.Errorf("%s: expected version mismatch error, got %v", name, err)
+				}
+				var actual Person
+				if _, _, err := s.Get(ctx, key, &actual); err != nil {
+					t.Fatalf("%s: unexpected error getting data: %v", name, err)
+				}
+				if actual.Name != "Jess" {
+					t.Errorf("%s: expected the value to be unchanged, got name %q", name, actual.Name)
+				}
+			}
+		})
 		t.Run("The created field is set and not updated", func(t *testing.T) {
 			defer store.DeletePrefix(ctx, "*", 0, -1)
 
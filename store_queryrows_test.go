@@ -0,0 +1,153 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newQueryRowsTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+
+		inputs := map[string]any{
+			"queryrows/alice": map[string]any{"name": "Alice", "age": 40, "tags": []string{"a", "b"}},
+			"queryrows/bob":   map[string]any{"name": "Bob", "age": 20.5, "tags": []string{"c"}},
+		}
+		for key, value := range inputs {
+			if err := store.Put(ctx, key, -1, value); err != nil {
+				t.Fatalf("unexpected error putting data: %v", err)
+			}
+		}
+
+		t.Run("Can return computed columns", func(t *testing.T) {
+			actual, err := store.QueryRows(ctx, `select key, value ->> '$.name' as name, value ->> '$.age' as age, version + 1 as next, value ->> '$.missing' as missing from kv where key like :prefix order by key`, map[string]any{":prefix": "queryrows/%"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := db.Rows{
+				Columns: []string{"key", "name", "age", "next", "missing"},
+				Values: [][]any{
+					{"queryrows/alice", "Alice", int64(40), int64(2), nil},
+					{"queryrows/bob", "Bob", 20.5, int64(2), nil},
+				},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Returns the columns of queries that return no rows", func(t *testing.T) {
+			actual, err := store.QueryRows(ctx, `select key, value ->> '$.name' as name, version + 1 as next from kv where key like :prefix`, map[string]any{":prefix": "queryrows/missing/%"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := db.Rows{
+				Columns: []string{"key", "name", "next"},
+				Values:  [][]any{},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Can expand arrays with json_each", func(t *testing.T) {
+			actual, err := store.QueryRows(ctx, `select kv.key, tags.value as tag from kv, json_each(kv.value, '$.tags') as tags where kv.key like :prefix order by kv.key, tags.value`, map[string]any{":prefix": "queryrows/%"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := db.Rows{
+				Columns: []string{"key", "tag"},
+				Values: [][]any{
+					{"queryrows/alice", "a"},
+					{"queryrows/alice", "b"},
+					{"queryrows/bob", "c"},
+				},
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected %#v, got %#v", expected, actual)
+			}
+		})
+		t.Run("Can scan rows into structs", func(t *testing.T) {
+			rows, err := store.QueryRows(ctx, `select key, json(value) as value, created, count(*) over () as total from kv where key like :prefix order by key`, map[string]any{":prefix": "queryrows/%"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			type row struct {
+				Key     string    `json:"key"`
+				Value   Person    `json:"value"`
+				Created time.Time `json:"created"`
+				Total   int       `json:"total"`
+			}
+			actual, err := RowsOf[row](rows)
+			if err != nil {
+				t.Fatalf("unexpected error scanning rows: %v", err)
+			}
+			if len(actual) != 2 {
+				t.Fatalf("expected 2 rows, got %d", len(actual))
+			}
+			if actual[0].Key != "queryrows/alice" || actual[0].Value.Name != "Alice" || actual[0].Total != 2 {
+				t.Errorf("unexpected row: %#v", actual[0])
+			}
+			if actual[0].Created.IsZero() {
+				t.Errorf("expected created to be set")
+			}
+		})
+		t.Run("Invalid queries return an error", func(t *testing.T) {
+			if _, err := store.QueryRows(ctx, `select * from missing_table`, nil); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestRowsOf(t *testing.T) {
+	rows := db.Rows{
+		Columns: []string{"name", "age", "score", "active", "tags", "raw", "created", "note", "ignored"},
+		Values: [][]any{
+			{"Alice", int64(40), int64(3), int64(1), `["a","b"]`, `{"x":1}`, "2025-03-10T08:16:13Z", "hello", "x"},
+			{"Bob", float64(20), 2.5, int64(0), []byte(`[]`), nil, nil, nil, nil},
+		},
+	}
+	type row struct {
+		Name    string          `json:"name"`
+		Age     int             `json:"age"`
+		Score   float64         `json:"score"`
+		Active  bool            `json:"active"`
+		Tags    []string        `json:"tags"`
+		Raw     json.RawMessage `json:"raw"`
+		Created time.Time       `json:"created"`
+		Note    *string         `json:"note"`
+	}
+	t.Run("Can scan into structs", func(t *testing.T) {
+		actual, err := RowsOf[row](rows)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		note := "hello"
+		expected := []row{
+			{Name: "Alice", Age: 40, Score: 3, Active: true, Tags: []string{"a", "b"}, Raw: json.RawMessage(`{"x":1}`), Created: time.Date(2025, 3, 10, 8, 16, 13, 0, time.UTC), Note: &note},
+			{Name: "Bob", Age: 20, Score: 2.5, Tags: []string{}},
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %#v, got %#v", expected, actual)
+		}
+	})
+	t.Run("Can scan into maps", func(t *testing.T) {
+		actual, err := RowsOf[map[string]any](db.Rows{Columns: []string{"a", "b"}, Values: [][]any{{int64(1), nil}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []map[string]any{{"a": int64(1), "b": nil}}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected %#v, got %#v", expected, actual)
+		}
+	})
+	t.Run("Returns an error for incompatible types", func(t *testing.T) {
+		if _, err := RowsOf[row](db.Rows{Columns: []string{"age"}, Values: [][]any{{"forty"}}}); err == nil {
+			t.Error("expected error, got nil")
+		}
+	})
+}
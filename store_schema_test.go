@@ -0,0 +1,218 @@
+package sqlitekv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+func newSchemaTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+		defer store.DeleteSchema(ctx, "schema/person/")
+
+		personSchema := map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"name": map[string]any{"type": "string"},
+				"age":  map[string]any{"type": "integer", "minimum": 0},
+			},
+			"required":             []string{"name"},
+			"additionalProperties": false,
+		}
+		if err := store.RegisterSchema(ctx, "schema/person/", personSchema); err != nil {
+			t.Fatalf("unexpected error registering schema: %v", err)
+		}
+
+		expectValidationError := func(t *testing.T, err error, key, instanceLocation string) {
+			t.Helper()
+			var ve *ValidationError
+			if !errors.As(err, &ve) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if ve.Key != key {
+				t.Errorf("expected key %q, got %q", key, ve.Key)
+			}
+			if ve.Prefix != "schema/person/" {
+				t.Errorf("expected prefix %q, got %q", "schema/person/", ve.Prefix)
+			}
+			for _, d := range ve.Errors {
+				if d.InstanceLocation == instanceLocation {
+					return
+				}
+			}
+			t.Errorf("expected an error at %q, got %#v", instanceLocation, ve.Errors)
+		}
+
+		t.Run("Schemas can be listed", func(t *testing.T) {
+			schemas, err := store.Schemas(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error listing schemas: %v", err)
+			}
+			if len(schemas) != 1 || schemas[0].Prefix != "schema/person/" {
+				t.Fatalf("expected the schema/person/ schema, got %v", schemas)
+			}
+		})
+		t.Run("Invalid schemas cannot be registered", func(t *testing.T) {
+			if err := store.RegisterSchema(ctx, "schema/invalid/", map[string]any{"type": 123}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+		t.Run("Valid values can be put", func(t *testing.T) {
+			if err := store.Put(ctx, "schema/person/alice", -1, map[string]any{"name": "Alice", "age": 30}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+		t.Run("Invalid values cannot be put", func(t *testing.T) {
+			err := store.Put(ctx, "schema/person/bob", -1, map[string]any{"name": "Bob", "age": -1})
+			expectValidationError(t, err, "schema/person/bob", "/age")
+			if _, ok, _ := store.Get(ctx, "schema/person/bob", &map[string]any{}); ok {
+				t.Error("expected invalid value not to be stored")
+			}
+		})
+		t.Run("Keys without a schema are not validated", func(t *testing.T) {
+			if err := store.Put(ctx, "schema/other/x", -1, map[string]any{"age": "old"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+		t.Run("Patches are validated after the merge", func(t *testing.T) {
+			err := store.Patch(ctx, "schema/person/alice", -1, map[string]any{"name": nil})
+			expectValidationError(t, err, "schema/person/alice", "/")
+			if err := store.Patch(ctx, "schema/person/alice", -1, map[string]any{"age": 31}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var alice map[string]any
+			r, _, err := store.Get(ctx, "schema/person/alice", &alice)
+			if err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if alice["name"] != "Alice" || alice["age"] != 31.0 {
+				t.Errorf("unexpected value: %v", alice)
+			}
+			if r.Version != 2 {
+				t.Errorf("expected version 2, got %d", r.Version)
+			}
+		})
+		t.Run("Patches to missing keys are validated", func(t *testing.T) {
+			err := store.Patch(ctx, "schema/person/charlie", -1, map[string]any{"age": 20})
+			expectValidationError(t, err, "schema/person/charlie", "/")
+		})
+		t.Run("Patches with the wrong version are rejected", func(t *testing.T) {
+			err := store.Patch(ctx, "schema/person/alice", 1, map[string]any{"age": 32})
+			if !errors.Is(err, db.ErrVersionMismatch) {
+				t.Errorf("expected version mismatch, got %v", err)
+			}
+		})
+		t.Run("Every PutPatches entry is validated before committing", func(t *testing.T) {
+			_, err := store.MutateAll(ctx, db.PutPatches(
+				db.PutInput("schema/person/david", -1, map[string]any{"name": "David"}),
+				db.PatchInput("schema/person/david", -1, map[string]any{"age": 40}),
+				db.PatchInput("schema/person/alice", -1, map[string]any{"email": "alice@example.com"}),
+			))
+			expectValidationError(t, err, "schema/person/alice", "/")
+			if _, ok, _ := store.Get(ctx, "schema/person/david", &map[string]any{}); ok {
+				t.Error("expected no entries to be stored")
+			}
+
+			_, err = store.MutateAll(ctx, db.PutPatches(
+				db.PutInput("schema/person/david", -1, map[string]any{"name": "David"}),
+				db.PatchInput("schema/person/david", -1, map[string]any{"age": 40}),
+			))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var david map[string]any
+			if _, _, err = store.Get(ctx, "schema/person/david", &david); err != nil {
+				t.Fatalf("unexpected error getting data: %v", err)
+			}
+			if david["name"] != "David" || david["age"] != 40.0 {
+				t.Errorf("unexpected value: %v", david)
+			}
+		})
+		t.Run("Values can be tested without being stored", func(t *testing.T) {
+			if err := store.ValidateValue(ctx, "schema/person/eve", map[string]any{"name": "Eve"}); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			err := store.ValidateValue(ctx, "schema/person/eve", map[string]any{"name": 1})
+			expectValidationError(t, err, "schema/person/eve", "/name")
+		})
+		t.Run("Replaced schemas are removed from the cache", func(t *testing.T) {
+			for _, minimum := range []int{0, 1, 0} {
+				personSchema["properties"].(map[string]any)["age"] = map[string]any{"type": "integer", "minimum": minimum}
+				if err := store.RegisterSchema(ctx, "schema/person/", personSchema); err != nil {
+					t.Fatalf("unexpected error registering schema: %v", err)
+				}
+				if err := store.ValidateValue(ctx, "schema/person/eve", map[string]any{"name": "Eve", "age": 0}); (err != nil) != (minimum == 1) {
+					t.Errorf("minimum %d: unexpected error: %v", minimum, err)
+				}
+			}
+			store.schemaMutex.Lock()
+			defer store.schemaMutex.Unlock()
+			if len(store.schemaCache) != 1 {
+				t.Errorf("expected 1 cached schema, got %d", len(store.schemaCache))
+			}
+		})
+		t.Run("Schemas registered by other stores are seen after the cache TTL", func(t *testing.T) {
+			cached := NewStore(store.db)
+			uncached := NewStore(store.db, WithSchemaCacheTTL(-1))
+			if err := cached.ValidateValue(ctx, "schema/late/a", map[string]any{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := store.RegisterSchema(ctx, "schema/late/", map[string]any{"type": "string"}); err != nil {
+				t.Fatalf("unexpected error registering schema: %v", err)
+			}
+			defer store.DeleteSchema(ctx, "schema/late/")
+			if err := cached.ValidateValue(ctx, "schema/late/a", map[string]any{}); err != nil {
+				t.Errorf("expected the cached schemas to be used, got %v", err)
+			}
+			if err := uncached.ValidateValue(ctx, "schema/late/a", map[string]any{}); err == nil {
+				t.Error("expected a validation error from the store without a schema cache")
+			}
+			cached.schemaMutex.Lock()
+			cached.schemasLoadedAt = cached.schemasLoadedAt.Add(-DefaultSchemaCacheTTL)
+			cached.schemaMutex.Unlock()
+			if err := cached.ValidateValue(ctx, "schema/late/a", map[string]any{}); err == nil {
+				t.Error("expected a validation error once the cache expired")
+			}
+		})
+		t.Run("Deleted schemas are no longer enforced", func(t *testing.T) {
+			if err := store.DeleteSchema(ctx, "schema/person/"); err != nil {
+				t.Fatalf("unexpected error deleting schema: %v", err)
+			}
+			if err := store.Put(ctx, "schema/person/frank", -1, map[string]any{"age": -1}); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   any
+		patch    any
+		expected string
+	}{
+		{name: "Adds fields", target: map[string]any{"a": "b"}, patch: map[string]any{"c": "d"}, expected: `{"a":"b","c":"d"}`},
+		{name: "Removes null fields", target: map[string]any{"a": "b", "c": "d"}, patch: map[string]any{"a": nil}, expected: `{"c":"d"}`},
+		{name: "Merges nested objects", target: map[string]any{"a": map[string]any{"b": "c", "d": "e"}}, patch: map[string]any{"a": map[string]any{"b": nil, "f": "g"}}, expected: `{"a":{"d":"e","f":"g"}}`},
+		{name: "Replaces arrays", target: map[string]any{"a": []any{"b"}}, patch: map[string]any{"a": []any{"c"}}, expected: `{"a":["c"]}`},
+		{name: "Replaces non-objects", target: "a", patch: map[string]any{"b": "c"}, expected: `{"b":"c"}`},
+		{name: "Non-object patches replace the target", target: map[string]any{"a": "b"}, patch: "c", expected: `"c"`},
+		{name: "Missing targets are treated as empty objects", target: nil, patch: map[string]any{"a": nil, "b": "c"}, expected: `{"b":"c"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := json.Marshal(mergePatch(test.target, test.patch))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(actual) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package sqlitekv
+
+import (
+	"context"
+	"testing"
+)
+
+func newSearchTest(ctx context.Context, store *Store) func(t *testing.T) {
+	return func(t *testing.T) {
+		defer store.DeletePrefix(ctx, "*", 0, -1)
+		defer store.DropSearchIndex(ctx, "search/article/")
+		defer store.DropSearchIndex(ctx, "search/")
+
+		// Records written before the index is created are indexed when the index is created.
+		if err := store.Put(ctx, "search/article/sqlite", -1, map[string]any{"title": "SQLite", "body": "SQLite is an embedded database engine.", "author": "Richard"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+		if err := store.CreateSearchIndex(ctx, "search/article/", "title", "$.body"); err != nil {
+			t.Fatalf("unexpected error creating search index: %v", err)
+		}
+		// Records written after the index is created are indexed by triggers.
+		if err := store.Put(ctx, "search/article/rqlite", -1, map[string]any{"title": "rqlite", "body": "rqlite is a distributed database built on SQLite.", "author": "Philip"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+		if err := store.Put(ctx, "search/note/unindexed", -1, map[string]any{"title": "SQLite notes"}); err != nil {
+			t.Fatalf("unexpected error putting data: %v", err)
+		}
+
+		t.Run("Can search indexed records", func(t *testing.T) {
+			results, err := store.Search(ctx, "search/", "sqlite", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("expected 2 results, got %d", len(results))
+			}
+			// The SQLite article mentions sqlite twice in a shorter text, so it ranks higher.
+			if results[0].Record.Key != "search/article/sqlite" {
+				t.Errorf("expected first result to be search/article/sqlite, got %q", results[0].Record.Key)
+			}
+			if results[0].Rank > results[1].Rank {
+				t.Errorf("expected results to be ordered by rank, got %v then %v", results[0].Rank, results[1].Rank)
+			}
+			if results[0].Record.Version != 1 {
+				t.Errorf("expected version 1, got %d", results[0].Record.Version)
+			}
+			if results[0].Record.Created.IsZero() {
+				t.Errorf("expected created to be set")
+			}
+			if expected := "<mark>SQLite</mark> <mark>SQLite</mark> is an embedded database engine."; results[0].Snippet != expected {
+				t.Errorf("expected snippet %q, got %q", expected, results[0].Snippet)
+			}
+		})
+		t.Run("Only indexed paths are searched", func(t *testing.T) {
+			results, err := store.Search(ctx, "search/", "Philip", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("expected no results, got %d", len(results))
+			}
+		})
+		t.Run("Updates are reflected in the index", func(t *testing.T) {
+			if err := store.Patch(ctx, "search/article/rqlite", -1, map[string]any{"body": "rqlite is a distributed relational database."}); err != nil {
+				t.Fatalf("unexpected error patching data: %v", err)
+			}
+			results, err := store.Search(ctx, "search/", "relational", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 1 || results[0].Record.Key != "search/article/rqlite" {
+				t.Errorf("expected search/article/rqlite, got %v", results)
+			}
+			results, err = store.Search(ctx, "search/", "built", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("expected no results for replaced text, got %d", len(results))
+			}
+		})
+		t.Run("Deletes are removed from the index", func(t *testing.T) {
+			if _, err := store.Delete(ctx, "search/article/rqlite"); err != nil {
+				t.Fatalf("unexpected error deleting data: %v", err)
+			}
+			results, err := store.Search(ctx, "search/", "relational", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("expected no results, got %d", len(results))
+			}
+		})
+		t.Run("Results can be limited to a prefix", func(t *testing.T) {
+			if err := store.CreateSearchIndex(ctx, "search/", "title"); err != nil {
+				t.Fatalf("unexpected error creating search index: %v", err)
+			}
+			results, err := store.Search(ctx, "search/note/", "sqlite", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 1 || results[0].Record.Key != "search/note/unindexed" {
+				t.Errorf("expected search/note/unindexed, got %v", results)
+			}
+		})
+		t.Run("Dropping an index falls back to an index with a shorter prefix", func(t *testing.T) {
+			if err := store.DropSearchIndex(ctx, "search/article/"); err != nil {
+				t.Fatalf("unexpected error dropping search index: %v", err)
+			}
+			// The body is no longer indexed, only the title.
+			results, err := store.Search(ctx, "search/", "embedded", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("expected no results, got %d", len(results))
+			}
+			results, err = store.Search(ctx, "search/", "sqlite", 0, 10)
+			if err != nil {
+				t.Fatalf("unexpected error searching: %v", err)
+			}
+			if len(results) != 2 {
+				t.Errorf("expected 2 results, got %d", len(results))
+			}
+		})
+		t.Run("Invalid queries return an error", func(t *testing.T) {
+			if _, err := store.Search(ctx, "search/", `"unterminated`, 0, 10); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+		t.Run("At least one path is required", func(t *testing.T) {
+			if err := store.CreateSearchIndex(ctx, "search/"); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
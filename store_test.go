@@ -100,9 +100,11 @@ func runStoreTests(t *testing.T, store *Store) {
 	}
 
 	t.Run("Get", newGetTest(ctx, store))
+	t.Run("GetPath", newGetPathTest(ctx, store))
 	t.Run("GetPrefix", newGetPrefixTest(ctx, store))
 	t.Run("GetRange", newGetRangeTest(ctx, store))
 	t.Run("List", newListTest(ctx, store))
+	t.Run("Find", newFindTest(ctx, store))
 	t.Run("Put", newPutTest(ctx, store))
 	t.Run("Delete", newDeleteTest(ctx, store))
 	t.Run("DeletePrefix", newDeletePrefixTest(ctx, store))
@@ -110,11 +112,23 @@ func runStoreTests(t *testing.T, store *Store) {
 	t.Run("Count", newCountTest(ctx, store))
 	t.Run("CountPrefix", newCountPrefixTest(ctx, store))
 	t.Run("CountRange", newCountRangeTest(ctx, store))
+	t.Run("Aggregate", newAggregateTest(ctx, store))
+	t.Run("Search", newSearchTest(ctx, store))
 	t.Run("Patch", newPatchTest(ctx, store))
+	t.Run("JSONPatch", newJSONPatchTest(ctx, store))
+	t.Run("Codec", newCodecTest(ctx, store))
+	t.Run("Blob", newBlobTest(ctx, store))
+	t.Run("Encryption", newEncryptionTest(ctx, store))
+	t.Run("Compression", newCompressionTest(ctx, store))
+	t.Run("Migrate", newMigrateTest(ctx, store))
+	t.Run("DataMigration", newDataMigrationTest(ctx, store))
+	t.Run("Cache", newCacheTest(ctx, store))
 	t.Run("Query", newQueryTest(ctx, store))
+	t.Run("QueryRows", newQueryRowsTest(ctx, store))
 	t.Run("Mutate", newMutateTest(ctx, store))
 	t.Run("MutateAll", newMutateAllTest(ctx, store))
 	t.Run("PutPatches", newPutPatchesTest(ctx, store))
+	t.Run("Schema", newSchemaTest(ctx, store))
 
 	deleted, err := store.DeletePrefix(ctx, "*", 0, -1)
 	if err != nil {
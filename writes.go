@@ -0,0 +1,217 @@
+package sqlitekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/a-h/sqlitekv/db"
+)
+
+// maxResolvedWriteAttempts is the number of times a resolved write is attempted if another
+// write changes the record between it being read and written.
+const maxResolvedWriteAttempts = 3
+
+// ErrEncodedValuePatch is returned when a merge patch is made to a value that's compressed, encrypted
+// or not JSON encoded, by a store that doesn't decode it. The patch isn't made.
+var ErrEncodedValuePatch = errors.New("encoded values can only be patched by a store that decodes them")
+
+// mutate runs the mutations, after resolving JSON patches and validating the writes they make
+// against the registered schemas.
+func (s *Store) mutate(ctx context.Context, mutations ...db.Mutation) (rowsAffected []int64, err error) {
+	for attempt := 1; ; attempt++ {
+		resolved, pinned, err := s.resolveMutations(ctx, mutations)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range resolved {
+			if m.ArgsError != nil {
+				return nil, m.ArgsError
+			}
+		}
+		rowsAffected, err = s.db.Mutate(ctx, resolved...)
+		if pinned && len(mutations) == 1 && attempt < maxResolvedWriteAttempts && errors.Is(err, db.ErrVersionMismatch) {
+			continue
+		}
+		if errors.Is(err, db.ErrVersionMismatch) {
+			key, ok, keyErr := s.encodedPatchKey(ctx, resolved)
+			if keyErr != nil {
+				return rowsAffected, errors.Join(err, keyErr)
+			}
+			if ok {
+				return rowsAffected, fmt.Errorf("%w: %q: %w", ErrEncodedValuePatch, key, err)
+			}
+		}
+		return rowsAffected, err
+	}
+}
+
+// encodedPatchKey finds a key that a merge patch in the mutations was run against in SQL, but whose
+// value is encoded, so the patch didn't affect any rows.
+func (s *Store) encodedPatchKey(ctx context.Context, mutations []db.Mutation) (key string, ok bool, err error) {
+	var keys []string
+	for _, m := range mutations {
+		for _, w := range m.Writes {
+			if w.Operation == db.OperationPatch {
+				keys = append(keys, w.Key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return "", false, nil
+	}
+	q, err := db.GetKeys(keys...)
+	if err != nil {
+		return "", false, err
+	}
+	outputs, err := s.db.Query(ctx, q)
+	if err != nil {
+		return "", false, err
+	}
+	for _, r := range outputs[0] {
+		if r.Encoding != "" && r.Encoding != db.EncodingJSON && r.Encoding != db.EncodingJSONB {
+			return r.Key, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+type resolvedValue struct {
+	value   any
+	version int64
+	written bool
+}
+
+// resolveMutations prepares the writes made by the mutations.
+//
+// JSON patches, and merge patches to keys that have a schema, are applied to the current value,
+// and replaced with puts of the result, so that the result can be validated before it's written.
+// If the store compresses or encrypts values, patches to those values are resolved, and the values are
+// compressed and encrypted before they're written.
+// If the patch didn't specify a version, the put is pinned to the version that was read, and
+// pinned is set to true.
+func (s *Store) resolveMutations(ctx context.Context, mutations []db.Mutation) (resolved []db.Mutation, pinned bool, err error) {
+	var hasWrites bool
+	for _, m := range mutations {
+		if len(m.Writes) > 0 {
+			hasWrites = true
+			break
+		}
+	}
+	if !hasWrites {
+		return mutations, false, nil
+	}
+	schemas, err := s.compiledSchemas(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	needsResolving := func(w db.PutPatchInput) bool {
+		if w.Operation == db.OperationJSONPatch || s.encodesValue(w.Key) {
+			return true
+		}
+		_, ok := matchSchema(schemas, w.Key)
+		return ok
+	}
+
+	// Read the current values of patched keys.
+	var keys []string
+	patched := make(map[string]bool)
+	for _, m := range mutations {
+		for _, w := range m.Writes {
+			if needsResolving(w) && w.Operation != db.OperationPut && !patched[w.Key] {
+				keys = append(keys, w.Key)
+				patched[w.Key] = true
+			}
+		}
+	}
+	if len(keys) == 0 && len(schemas) == 0 && s.keys == nil && len(s.compression) == 0 {
+		return mutations, false, nil
+	}
+	values := make(map[string]resolvedValue)
+	if len(keys) > 0 {
+		q, err := db.GetKeys(keys...)
+		if err != nil {
+			return nil, false, err
+		}
+		outputs, err := s.db.Query(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, r := range outputs[0] {
+			if r, err = s.decodeRecord(ctx, r); err != nil {
+				return nil, false, err
+			}
+			v, err := toJSONValue(db.Encoded{Encoding: r.Encoding, Data: r.Value})
+			if err != nil {
+				return nil, false, err
+			}
+			values[r.Key] = resolvedValue{value: v, version: r.Version}
+		}
+	}
+
+	resolved = make([]db.Mutation, len(mutations))
+	for i, m := range mutations {
+		resolved[i] = m
+		if len(m.Writes) == 0 {
+			continue
+		}
+		var rewrite bool
+		writes := make([]db.PutPatchInput, len(m.Writes))
+		for j, w := range m.Writes {
+			writes[j] = w
+			// Puts to patched keys are resolved, so that later patches in the batch apply to the put value.
+			if !needsResolving(w) && !patched[w.Key] {
+				continue
+			}
+			current := values[w.Key]
+			var value any
+			switch w.Operation {
+			case db.OperationJSONPatch:
+				ops, err := decodeJSONPatch(w.Value)
+				if err != nil {
+					return nil, false, err
+				}
+				if value, err = applyJSONPatch(current.value, ops); err != nil {
+					return nil, false, err
+				}
+			case db.OperationPatch:
+				patch, err := toJSONValue(w.Value)
+				if err != nil {
+					return nil, false, err
+				}
+				value = mergePatch(current.value, patch)
+			default:
+				value = w.Value
+				// Puts that are only resolved to be compressed or encrypted may have values that aren't JSON.
+				if _, ok := matchSchema(schemas, w.Key); ok || patched[w.Key] {
+					if value, err = toJSONValue(w.Value); err != nil {
+						return nil, false, err
+					}
+				}
+			}
+			if w.Operation != db.OperationPut {
+				version := w.Version
+				if version == -1 && !current.written {
+					version = current.version
+					pinned = true
+				}
+				writes[j] = db.PutInput(w.Key, version, value)
+				rewrite = true
+			}
+			if err = validateValue(schemas, w.Key, value); err != nil {
+				return nil, false, err
+			}
+			values[w.Key] = resolvedValue{value: value, written: true}
+			if s.encodesValue(w.Key) {
+				if writes[j].Value, err = s.encodeValue(ctx, w.Key, writes[j].Value); err != nil {
+					return nil, false, err
+				}
+				rewrite = true
+			}
+		}
+		if rewrite {
+			resolved[i] = db.PutPatches(writes...)
+		}
+	}
+	return resolved, pinned, nil
+}